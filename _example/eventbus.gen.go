@@ -2,8 +2,24 @@
 package events
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Event represents a typed event name.
@@ -15,156 +31,2836 @@ const (
 	EventUserRegistration    Event = "user.registration"
 )
 
+var (
+	// ErrUnknownEvent is returned for event names this bus does not declare.
+	ErrUnknownEvent = errors.New("unknown event")
+	// ErrDropped is returned when an event is dropped because the queue is full.
+	ErrDropped = errors.New("event dropped: queue is full")
+	// ErrPayloadType is returned when a payload does not have the type declared for its event.
+	ErrPayloadType = errors.New("wrong payload type")
+	// ErrEventBusTxDone is returned when a EventBusTx is used after Commit or Rollback.
+	ErrEventBusTxDone = errors.New("transaction has already been committed or rolled back")
+)
+
+// AllEvents returns every declared event, sorted by name.
+func AllEvents() []Event {
+	return []Event{
+		EventRecipeMutation,
+		EventShoppingListCleanup,
+		EventUserRegistration,
+	}
+}
+
+// ParseEvent returns the event named s. It returns
+// ErrUnknownEvent if no such event is declared.
+func ParseEvent(s string) (Event, error) {
+	event := Event(s)
+	if !event.Valid() {
+		return "", fmt.Errorf("%w: %q", ErrUnknownEvent, s)
+	}
+	return event, nil
+}
+
+// Valid reports whether e is a declared event.
+func (e Event) Valid() bool {
+	switch e {
+	case EventRecipeMutation, EventShoppingListCleanup, EventUserRegistration:
+		return true
+	}
+	return false
+}
+
+// PayloadType returns the payload type declared for e, or nil if e is not a
+// declared event.
+func (e Event) PayloadType() reflect.Type {
+	switch e {
+	case EventRecipeMutation:
+		return reflect.TypeOf((*MutationEvent)(nil)).Elem()
+	case EventShoppingListCleanup:
+		return reflect.TypeOf((*ShoppingListCleanup)(nil)).Elem()
+	case EventUserRegistration:
+		return reflect.TypeOf((*UserRegistrationEvent)(nil)).Elem()
+	}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler. Unknown events are rejected.
+func (e Event) MarshalText() ([]byte, error) {
+	if !e.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEvent, string(e))
+	}
+	return []byte(e), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Unknown events are rejected.
+func (e *Event) UnmarshalText(text []byte) error {
+	event, err := ParseEvent(string(text))
+	if err != nil {
+		return err
+	}
+	*e = event
+	return nil
+}
+
 // EventBus provides type-safe publish/subscribe for in-process events.
 type EventBus struct {
 	mu          sync.RWMutex
-	subscribers map[Event][]any
-	ch          chan envelope
+	subscribers map[Event][]*eventBusSubscription
+	nextID      uint64
+	eventOpts   map[Event][]EventBusSubscribeOption
+	queue       EventBusQueue
+	clock       EventBusClock
+	deadLetters DeadLetterSink
+
+	schedMu      sync.Mutex
+	schedule     eventBusScheduleHeap
+	schedTimer   EventBusTimer
+	schedStopped bool
+
+	hookMu      sync.RWMutex
+	onPublish   []eventBusHook[func(Event, any)]
+	onDrop      []eventBusHook[func(Event, any)]
+	onSubscribe []func(Event)
+	onPanic     []eventBusHook[func(Event, any, any)]
+	onRetry     []func(Event, any, error, int)
+	onGiveUp    []func(Event, any, error, int)
+	onStop      []func()
+	onEnqueue   []eventBusHook[func(EventEnvelope)]
+	nextHookID  uint64
+}
+
+// eventBusHook is a registered hook with an ID, so that hooks the bus adds for
+// itself can be removed again.
+type eventBusHook[F any] struct {
+	id uint64
+	fn F
+}
+
+// Publisher publishes every event declared for EventBus.
+// Depend on it instead of *EventBus to substitute a fake in tests.
+type Publisher interface {
+	PublishRecipeMutation(payload MutationEvent)
+	PublishShoppingListCleanup(payload ShoppingListCleanup)
+	PublishUserRegistration(payload UserRegistrationEvent)
+}
+
+// Subscriber subscribes to every event declared for EventBus.
+type Subscriber interface {
+	SubscribeRecipeMutation(fn func(MutationEvent), opts ...EventBusSubscribeOption)
+	SubscribeShoppingListCleanup(fn func(ShoppingListCleanup), opts ...EventBusSubscribeOption)
+	SubscribeUserRegistration(fn func(UserRegistrationEvent), opts ...EventBusSubscribeOption)
+}
+
+// RecipeMutationPublisher publishes recipe.mutation events. Services that emit a
+// single event can depend on it instead of Publisher.
+type RecipeMutationPublisher interface {
+	PublishRecipeMutation(payload MutationEvent)
+}
+
+// RecipeMutationMetadataPublisher publishes recipe.mutation events with
+// metadata. It is the destination type of ForwardRecipeMutation.
+type RecipeMutationMetadataPublisher interface {
+	PublishRecipeMutationWithMetadata(payload MutationEvent, md map[string]string)
+}
+
+// ShoppingListCleanupPublisher publishes shopping_list.cleanup events. Services that emit a
+// single event can depend on it instead of Publisher.
+type ShoppingListCleanupPublisher interface {
+	PublishShoppingListCleanup(payload ShoppingListCleanup)
+}
+
+// ShoppingListCleanupMetadataPublisher publishes shopping_list.cleanup events with
+// metadata. It is the destination type of ForwardShoppingListCleanup.
+type ShoppingListCleanupMetadataPublisher interface {
+	PublishShoppingListCleanupWithMetadata(payload ShoppingListCleanup, md map[string]string)
+}
+
+// UserRegistrationPublisher publishes user.registration events. Services that emit a
+// single event can depend on it instead of Publisher.
+type UserRegistrationPublisher interface {
+	PublishUserRegistration(payload UserRegistrationEvent)
+}
+
+// UserRegistrationMetadataPublisher publishes user.registration events with
+// metadata. It is the destination type of ForwardUserRegistration.
+type UserRegistrationMetadataPublisher interface {
+	PublishUserRegistrationWithMetadata(payload UserRegistrationEvent, md map[string]string)
+}
+
+var (
+	_ Publisher  = (*EventBus)(nil)
+	_ Subscriber = (*EventBus)(nil)
+)
+
+// EventEnvelope is a published event as it travels through the bus queue.
+type EventEnvelope struct {
+	ID      string
+	Time    time.Time
+	Event   Event
+	Payload any
+	// Metadata carries caller-defined values such as trace or tenant IDs
+	// alongside the payload. It is nil unless set with a WithMetadata method.
+	Metadata map[string]string
+	// Subscriber, when set, limits delivery to the subscriptions with this
+	// name. Redrive sets it so that a dead letter is delivered again only to
+	// the subscriber that failed.
+	Subscriber string
+}
+
+type eventBusEnvelopeRecord struct {
+	ID         string            `json:"id"`
+	Time       time.Time         `json:"time"`
+	Event      Event             `json:"event"`
+	Payload    json.RawMessage   `json:"payload"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Subscriber string            `json:"subscriber,omitempty"`
+}
+
+// MarshalJSON encodes the envelope with its payload as JSON.
+func (env EventEnvelope) MarshalJSON() ([]byte, error) {
+	payload, err := json.Marshal(env.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(eventBusEnvelopeRecord{
+		ID:         env.ID,
+		Time:       env.Time,
+		Event:      env.Event,
+		Payload:    payload,
+		Metadata:   env.Metadata,
+		Subscriber: env.Subscriber,
+	})
+}
+
+// UnmarshalJSON decodes an envelope, restoring the payload type of its event.
+func (env *EventEnvelope) UnmarshalJSON(data []byte) error {
+	var rec eventBusEnvelopeRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+
+	payload, err := DecodeEvent(rec.Event, rec.Payload)
+	if err != nil {
+		return err
+	}
+
+	*env = EventEnvelope{
+		ID:         rec.ID,
+		Time:       rec.Time,
+		Event:      rec.Event,
+		Payload:    payload,
+		Metadata:   rec.Metadata,
+		Subscriber: rec.Subscriber,
+	}
+	return nil
+}
+
+// EventBusQueue holds published envelopes until the Start loop dispatches them.
+type EventBusQueue interface {
+	// Push enqueues env without blocking and reports false when the queue is full.
+	Push(env EventEnvelope) bool
+	// Pop blocks until an envelope is available. It returns an error only
+	// once ctx is done.
+	Pop(ctx context.Context) (EventEnvelope, error)
+	// Ack reports that env has been dispatched to every subscriber.
+	Ack(env EventEnvelope) error
+	// Len returns the number of envelopes waiting to be dispatched.
+	Len() int
+	// Cap returns the number of envelopes the queue accepts before it is full.
+	Cap() int
+}
+
+// eventBusChanQueue is the default in-memory queue backed by a buffered channel.
+type eventBusChanQueue struct {
+	ch chan EventEnvelope
+}
+
+func (q eventBusChanQueue) Push(env EventEnvelope) bool {
+	select {
+	case q.ch <- env:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q eventBusChanQueue) Pop(ctx context.Context) (EventEnvelope, error) {
+	select {
+	case <-ctx.Done():
+		return EventEnvelope{}, ctx.Err()
+	case env := <-q.ch:
+		return env, nil
+	}
+}
+
+func (q eventBusChanQueue) Ack(EventEnvelope) error { return nil }
+
+func (q eventBusChanQueue) Len() int { return len(q.ch) }
+
+func (q eventBusChanQueue) Cap() int { return cap(q.ch) }
+
+// EventBusFileQueue is a queue backed by a write-ahead log. Every envelope is
+// appended and synced to the log before Push returns, and acknowledged once
+// dispatched. Envelopes that were never acknowledged, for example because the
+// process crashed, are loaded again when the log is reopened and dispatched
+// first once Start runs. The log is rewritten to hold only unacknowledged
+// envelopes when it is reopened and once enough acknowledgements pile up.
+type EventBusFileQueue struct {
+	mu      sync.Mutex
+	f       *os.File
+	path    string
+	size    int
+	pending []EventEnvelope
+	unacked map[string]EventEnvelope
+	order   []string // IDs of logged envelopes in push order
+	acks    int      // ack lines written since the log was last rewritten
+	// compactAt is the number of ack lines after which Ack rewrites the log,
+	// provided they outnumber the unacknowledged envelopes.
+	compactAt int
+	notify    chan struct{}
+}
+
+type eventBusWALRecord struct {
+	Ack      string         `json:"ack,omitempty"`
+	Envelope *EventEnvelope `json:"envelope,omitempty"`
+}
+
+// OpenEventBusFileQueue opens or creates the write-ahead log at path. The queue
+// accepts up to size new envelopes; envelopes recovered from the log are
+// always loaded.
+func OpenEventBusFileQueue(path string, size int) (*EventBusFileQueue, error) {
+	if size < 1 {
+		size = 1
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading queue log: %w", err)
+	}
+
+	var (
+		order []EventEnvelope
+		acked = map[string]bool{}
+	)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var rec eventBusWALRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("decoding queue log line %d: %w", i+1, err)
+		}
+		if rec.Envelope != nil {
+			order = append(order, *rec.Envelope)
+		}
+		if rec.Ack != "" {
+			acked[rec.Ack] = true
+		}
+	}
+
+	q := &EventBusFileQueue{
+		path:      path,
+		size:      size,
+		unacked:   map[string]EventEnvelope{},
+		compactAt: 1024,
+		notify:    make(chan struct{}, 1),
+	}
+
+	for _, env := range order {
+		if acked[env.ID] {
+			continue
+		}
+		q.pending = append(q.pending, env)
+		q.unacked[env.ID] = env
+		q.order = append(q.order, env.ID)
+	}
+	if err := q.compact(); err != nil {
+		if q.f != nil {
+			_ = q.f.Close()
+		}
+		return nil, err
+	}
+	if len(q.pending) > 0 {
+		q.notify <- struct{}{}
+	}
+
+	return q, nil
+}
+
+// Push appends env to the log and enqueues it. It reports false when the
+// queue is full or the log cannot be written.
+func (q *EventBusFileQueue) Push(env EventEnvelope) bool {
+	line, err := json.Marshal(eventBusWALRecord{Envelope: &env})
+	if err != nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) >= q.size || q.append(line) != nil {
+		return false
+	}
+	q.pending = append(q.pending, env)
+	q.unacked[env.ID] = env
+	q.order = append(q.order, env.ID)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Pop returns the oldest envelope, blocking until one is available.
+func (q *EventBusFileQueue) Pop(ctx context.Context) (EventEnvelope, error) {
+	for {
+		q.mu.Lock()
+		if len(q.pending) > 0 {
+			env := q.pending[0]
+			q.pending[0] = EventEnvelope{}
+			q.pending = q.pending[1:]
+			q.mu.Unlock()
+			return env, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return EventEnvelope{}, ctx.Err()
+		case <-q.notify:
+		}
+	}
+}
+
+// Ack records that env was dispatched. The log is truncated once every
+// envelope in it has been acknowledged, and rewritten without the
+// acknowledged envelopes once compactAt ack lines have been written since the
+// last rewrite and outnumber the envelopes still waiting.
+func (q *EventBusFileQueue) Ack(env EventEnvelope) error {
+	line, err := json.Marshal(eventBusWALRecord{Ack: env.ID})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.unacked, env.ID)
+	if len(q.unacked) == 0 {
+		if err := q.f.Truncate(0); err != nil {
+			return err
+		}
+		q.order = q.order[:0]
+		q.acks = 0
+		return q.f.Sync()
+	}
+
+	q.acks++
+	if q.acks >= q.compactAt && q.acks > len(q.unacked) {
+		return q.compact()
+	}
+	return q.append(line)
+}
+
+// Len returns the number of envelopes waiting to be dispatched.
+func (q *EventBusFileQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Cap returns the number of envelopes the queue accepts before it is full.
+func (q *EventBusFileQueue) Cap() int {
+	return q.size
+}
+
+// Close closes the log file.
+func (q *EventBusFileQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.f.Close()
+}
+
+// compact rewrites the log to hold only the unacknowledged envelopes, in push
+// order, and switches appends to the new log. The new log is written to a
+// temporary file and synced before the rename, then the directory is synced
+// so the rename itself is durable. A crash at any point leaves either the old
+// or the new log in place.
+func (q *EventBusFileQueue) compact() error {
+	var (
+		buf   bytes.Buffer
+		order = make([]string, 0, len(q.unacked))
+	)
+	for _, id := range q.order {
+		env, ok := q.unacked[id]
+		if !ok {
+			continue
+		}
+		line, err := json.Marshal(eventBusWALRecord{Envelope: &env})
+		if err != nil {
+			return fmt.Errorf("encoding queue log: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		order = append(order, id)
+	}
+
+	tmp := q.path + ".tmp"
+	if err := eventBusWriteFileSync(tmp, buf.Bytes()); err != nil {
+		return fmt.Errorf("compacting queue log: %w", err)
+	}
+	// Open the new log before the rename so appends never go to a file
+	// that has already been replaced.
+	f, err := os.OpenFile(tmp, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening queue log: %w", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("compacting queue log: %w", err)
+	}
+
+	if q.f != nil {
+		_ = q.f.Close()
+	}
+	q.f = f
+	q.order = order
+	q.acks = 0
+
+	if err := eventBusSyncDir(filepath.Dir(q.path)); err != nil {
+		return fmt.Errorf("compacting queue log: %w", err)
+	}
+	return nil
+}
+
+func (q *EventBusFileQueue) append(line []byte) error {
+	if _, err := q.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return q.f.Sync()
+}
+
+// eventBusWriteFileSync writes data to a new file at path and syncs it to disk.
+func eventBusWriteFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// eventBusSyncDir syncs the directory at path so that renames and new
+// entries in it survive a crash.
+func eventBusSyncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// eventBusSubscription is a registered handler, named after the handler function
+// unless overridden with EventBusWithName. Handlers that can fail set handle, which
+// is wrapped into fn with the subscription's retry policy. A non-nil filter is
+// consulted before delivery, and once subscriptions remove themselves on their
+// first delivery.
+type eventBusSubscription struct {
+	id     uint64
+	name   string
+	fn     func(any)
+	handle func(any) error
+	filter func(any) bool
+	once   bool
+	fired  atomic.Bool
+	// deliver, when set, receives the whole envelope instead of fn.
+	deliver func(EventEnvelope)
+}
+
+// EventBusClock abstracts time for the timer based features of the bus so tests
+// can control it. The default clock uses the time package.
+type EventBusClock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) EventBusTimer
+}
+
+// EventBusTimer is a pending call scheduled by EventBusClock.AfterFunc.
+type EventBusTimer interface {
+	Stop() bool
+}
+
+type eventBusSystemClock struct{}
+
+func (eventBusSystemClock) Now() time.Time { return time.Now() }
+
+func (eventBusSystemClock) AfterFunc(d time.Duration, f func()) EventBusTimer {
+	return time.AfterFunc(d, f)
+}
+
+// EventBusOption configures an EventBus created by New.
+type EventBusOption func(*EventBus)
+
+// EventBusWithDeadLetterSink sets the sink that records events whose handlers
+// panicked or gave up after retries. The default keeps the most recent 1024
+// dead letters in memory.
+func EventBusWithDeadLetterSink(sink DeadLetterSink) EventBusOption {
+	return func(bus *EventBus) {
+		bus.deadLetters = sink
+	}
+}
+
+// EventBusWithQueue replaces the default channel queue, for example with a
+// EventBusFileQueue that survives restarts. The size passed to New is
+// ignored when a queue is set.
+func EventBusWithQueue(queue EventBusQueue) EventBusOption {
+	return func(bus *EventBus) {
+		bus.queue = queue
+	}
+}
+
+// EventBusWithClock sets the clock used for scheduled publishes, debouncing,
+// throttling, coalescing and batch windows.
+func EventBusWithClock(clock EventBusClock) EventBusOption {
+	return func(bus *EventBus) {
+		bus.clock = clock
+	}
+}
+
+// New creates an EventBus whose default queue buffers up to size events.
+func New(size int, opts ...EventBusOption) *EventBus {
+	if size < 1 {
+		size = 1
+	}
+
+	bus := &EventBus{
+		subscribers: newSubscribersMap(),
+		eventOpts:   map[Event][]EventBusSubscribeOption{},
+		queue:       eventBusChanQueue{ch: make(chan EventEnvelope, size)},
+		clock:       eventBusSystemClock{},
+		deadLetters: NewMemoryDeadLetterSink(1024),
+	}
+	bus.onStop = append(bus.onStop, bus.stopSchedule)
+	for _, opt := range opts {
+		opt(bus)
+	}
+
+	return bus
+}
+
+// EventBusSubscribeOption configures a subscription. Options can be passed to
+// the Subscribe methods or set for every subscription to an event with Configure.
+type EventBusSubscribeOption func(*eventBusSubscribeConfig)
+
+type eventBusSubscribeConfig struct {
+	name           string
+	debounce       time.Duration
+	throttle       time.Duration
+	coalesceWindow time.Duration
+	coalesceKey    func(any) string
+	coalesceEvent  Event
+	retry          EventBusRetryPolicy
+}
+
+// EventBusRetryPolicy controls how handlers registered with a Subscribe...Err
+// method are retried after returning an error. Retries are scheduled on the
+// bus clock and run outside the Start loop, so they never delay other events.
+type EventBusRetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after each attempt. Values below 1 default to 2.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction in either direction.
+	Jitter float64
+	// Retryable reports whether err should be retried. Nil retries every error.
+	Retryable func(err error) bool
+}
+
+func (p EventBusRetryPolicy) backoff(attempt int) time.Duration {
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+
+	d := float64(p.InitialBackoff)
+	for range attempt - 1 {
+		d *= mult
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += (rand.Float64()*2 - 1) * p.Jitter * d
+	}
+
+	return time.Duration(d)
+}
+
+// EventBusWithRetry sets the retry policy for handlers that return errors.
+func EventBusWithRetry(policy EventBusRetryPolicy) EventBusSubscribeOption {
+	return func(cfg *eventBusSubscribeConfig) {
+		cfg.retry = policy
+	}
+}
+
+// EventBusWithName names the subscription in dead letters and diagnostics.
+func EventBusWithName(name string) EventBusSubscribeOption {
+	return func(cfg *eventBusSubscribeConfig) {
+		cfg.name = name
+	}
+}
+
+// EventBusWithDebounce delivers an event only once no further event has arrived
+// for d, discarding the events it replaced (trailing edge).
+func EventBusWithDebounce(d time.Duration) EventBusSubscribeOption {
+	return func(cfg *eventBusSubscribeConfig) {
+		cfg.debounce = d
+	}
+}
+
+// EventBusWithThrottle delivers the first event and discards the following
+// events until d has elapsed (leading edge).
+func EventBusWithThrottle(d time.Duration) EventBusSubscribeOption {
+	return func(cfg *eventBusSubscribeConfig) {
+		cfg.throttle = d
+	}
+}
+
+func newSubscribersMap() map[Event][]*eventBusSubscription {
+	return map[Event][]*eventBusSubscription{
+		EventRecipeMutation:      {},
+		EventShoppingListCleanup: {},
+		EventUserRegistration:    {},
+	}
+}
+
+// Start begins processing events. It blocks until ctx is cancelled, at which
+// point pending batches and held back debounced or coalesced events are
+// delivered, retries waiting for their backoff are given up and dead-lettered,
+// and scheduled events that have not been published are discarded.
+// Start may be called again after it returns; events scheduled while the bus
+// is stopped are discarded.
+func (bus *EventBus) Start(ctx context.Context) {
+	bus.schedMu.Lock()
+	bus.schedStopped = false
+	bus.schedMu.Unlock()
+
+	for {
+		env, err := bus.queue.Pop(ctx)
+		if err != nil {
+			bus.runOnStop()
+			return
+		}
+
+		bus.dispatch(env)
+		// An envelope that cannot be acknowledged is delivered again after a
+		// restart, which is the at-least-once guarantee persistent queues give.
+		_ = bus.queue.Ack(env)
+	}
+}
+
+// dispatch delivers env to every subscriber of its event, or only to those
+// named env.Subscriber when it is set.
+func (bus *EventBus) dispatch(env EventEnvelope) {
+	bus.mu.RLock()
+	subs := make([]*eventBusSubscription, len(bus.subscribers[env.Event]))
+	copy(subs, bus.subscribers[env.Event])
+	bus.mu.RUnlock()
+
+	for _, sub := range subs {
+		if env.Subscriber != "" && sub.name != env.Subscriber {
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					bus.panicked(env.Event, sub.name, env.Payload, r, 1)
+				}
+			}()
+			if sub.filter != nil && !sub.filter(env.Payload) {
+				return
+			}
+			if sub.once {
+				if !sub.fired.CompareAndSwap(false, true) {
+					return
+				}
+				bus.unsubscribe(env.Event, sub.id)
+			}
+			if sub.deliver != nil {
+				sub.deliver(env)
+				return
+			}
+			sub.fn(env.Payload)
+		}()
+	}
+}
+
+// Configure sets default subscribe options for event. They apply to every
+// handler for event registered afterwards with a Subscribe method that takes
+// options, or with SubscribeOnce, before any options passed to the method
+// itself. Batches, channels, iterators, WaitFor and the subscriptions the bus
+// makes for forwarding or streaming are not affected.
+func (bus *EventBus) Configure(event Event, opts ...EventBusSubscribeOption) {
+	bus.mu.Lock()
+	bus.eventOpts[event] = append(bus.eventOpts[event], opts...)
+	bus.mu.Unlock()
+}
+
+// publish enqueues the event without blocking and reports whether it was accepted.
+func (bus *EventBus) publish(event Event, payload any) bool {
+	return bus.publishEnvelope(EventEnvelope{
+		ID:      eventBusNewEnvelopeID(),
+		Time:    bus.clock.Now(),
+		Event:   event,
+		Payload: payload,
+	})
+}
+
+// publishEnvelope enqueues env as is, keeping its ID and time.
+func (bus *EventBus) publishEnvelope(env EventEnvelope) bool {
+	if !bus.queue.Push(env) {
+		bus.runOnDrop(env.Event, env.Payload)
+		return false
+	}
+	bus.runOnEnqueue(env)
+	bus.runOnPublish(env.Event, env.Payload)
+	return true
+}
+
+// eventBusNewEnvelopeID returns a random envelope ID that is unique across restarts.
+func eventBusNewEnvelopeID() string {
+	return strconv.FormatUint(rand.Uint64(), 16) + strconv.FormatUint(rand.Uint64(), 16)
+}
+
+// ScheduledEvent is a handle to an event scheduled for later publishing.
+type ScheduledEvent struct {
+	bus     *EventBus
+	event   Event
+	payload any
+	at      time.Time
+	index   int
+}
+
+// At returns the time the event is scheduled to be published.
+func (s *ScheduledEvent) At() time.Time {
+	return s.at
+}
+
+// Cancel removes the event from the schedule. It returns false if the event
+// was already published, cancelled, or discarded at shutdown.
+func (s *ScheduledEvent) Cancel() bool {
+	bus := s.bus
+	bus.schedMu.Lock()
+	defer bus.schedMu.Unlock()
+
+	if s.index < 0 {
+		return false
+	}
+	heap.Remove(&bus.schedule, s.index)
+	bus.armScheduleLocked()
+	return true
+}
+
+// eventBusScheduleHeap orders scheduled events by publish time.
+type eventBusScheduleHeap []*ScheduledEvent
+
+func (h eventBusScheduleHeap) Len() int           { return len(h) }
+func (h eventBusScheduleHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h eventBusScheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *eventBusScheduleHeap) Push(x any) {
+	s := x.(*ScheduledEvent)
+	s.index = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *eventBusScheduleHeap) Pop() any {
+	old := *h
+	n := len(old)
+	s := old[n-1]
+	old[n-1] = nil
+	s.index = -1
+	*h = old[:n-1]
+	return s
+}
+
+// scheduleAt adds the event to the timer heap. Events scheduled after the bus
+// has shut down are discarded.
+func (bus *EventBus) scheduleAt(event Event, payload any, at time.Time) *ScheduledEvent {
+	s := &ScheduledEvent{bus: bus, event: event, payload: payload, at: at, index: -1}
+
+	bus.schedMu.Lock()
+	defer bus.schedMu.Unlock()
+
+	if bus.schedStopped {
+		return s
+	}
+	heap.Push(&bus.schedule, s)
+	bus.armScheduleLocked()
+	return s
+}
+
+// armScheduleLocked points the single scheduler timer at the earliest event.
+func (bus *EventBus) armScheduleLocked() {
+	if bus.schedTimer != nil {
+		bus.schedTimer.Stop()
+		bus.schedTimer = nil
+	}
+	if len(bus.schedule) == 0 {
+		return
+	}
+	bus.schedTimer = bus.clock.AfterFunc(bus.schedule[0].at.Sub(bus.clock.Now()), bus.runSchedule)
+}
+
+// runSchedule publishes every event that is due and re-arms the timer.
+func (bus *EventBus) runSchedule() {
+	now := bus.clock.Now()
+
+	bus.schedMu.Lock()
+	var due []*ScheduledEvent
+	for len(bus.schedule) > 0 && !bus.schedule[0].at.After(now) {
+		due = append(due, heap.Pop(&bus.schedule).(*ScheduledEvent))
+	}
+	bus.armScheduleLocked()
+	bus.schedMu.Unlock()
+
+	for _, s := range due {
+		bus.publish(s.event, s.payload)
+	}
+}
+
+func (bus *EventBus) stopSchedule() {
+	bus.schedMu.Lock()
+	defer bus.schedMu.Unlock()
+
+	bus.schedStopped = true
+	if bus.schedTimer != nil {
+		bus.schedTimer.Stop()
+		bus.schedTimer = nil
+	}
+	for _, s := range bus.schedule {
+		s.index = -1
+	}
+	bus.schedule = nil
+}
+
+// subscribe registers a handler subscription, applying the options set with
+// Configure for event and then opts. It panics when a coalesce option for
+// another event is among them, since its key function cannot read the payload.
+func (bus *EventBus) subscribe(event Event, sub *eventBusSubscription, opts ...EventBusSubscribeOption) {
+	var cfg eventBusSubscribeConfig
+	bus.mu.RLock()
+	for _, opt := range bus.eventOpts[event] {
+		opt(&cfg)
+	}
+	bus.mu.RUnlock()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.coalesceKey != nil && cfg.coalesceEvent != event {
+		panic(fmt.Sprintf("EventBus: coalesce option for %s used on a %s subscription", cfg.coalesceEvent, event))
+	}
+	if cfg.name != "" {
+		sub.name = cfg.name
+	}
+	if sub.handle != nil {
+		sub.fn = bus.retry(event, sub.name, cfg.retry, sub.handle)
+	}
+	sub.fn = bus.limit(event, sub.name, cfg, sub.fn)
+	bus.register(event, sub)
+}
+
+// register adds sub to the subscribers of event as is. Subscriptions the bus
+// creates for WaitFor, batches, channels, iterators, streams and forwarding
+// use it directly so that options set with Configure do not delay or drop
+// their events.
+func (bus *EventBus) register(event Event, sub *eventBusSubscription) {
+	bus.mu.Lock()
+	bus.nextID++
+	sub.id = bus.nextID
+	bus.subscribers[event] = append(bus.subscribers[event], sub)
+	bus.mu.Unlock()
+	bus.runOnSubscribe(event)
+}
+
+func (bus *EventBus) unsubscribe(event Event, id uint64) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	subs := bus.subscribers[event]
+	for i, sub := range subs {
+		if sub.id == id {
+			bus.subscribers[event] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// limit wraps fn with the rate limiting described by cfg. Limits compose in
+// the order coalesce, debounce, throttle. Payloads held back by coalescing or
+// debouncing are delivered from a clock timer, and any still pending when the
+// bus shuts down are delivered then.
+func (bus *EventBus) limit(event Event, name string, cfg eventBusSubscribeConfig, fn func(any)) func(any) {
+	if cfg.throttle > 0 {
+		fn = bus.throttle(cfg.throttle, fn)
+	}
+	if cfg.debounce > 0 {
+		fn = bus.debounce(event, name, cfg.debounce, fn)
+	}
+	if cfg.coalesceWindow > 0 && cfg.coalesceKey != nil {
+		fn = bus.coalesce(event, name, cfg.coalesceWindow, cfg.coalesceKey, fn)
+	}
+	return fn
+}
+
+func (bus *EventBus) throttle(d time.Duration, fn func(any)) func(any) {
+	var (
+		mu    sync.Mutex
+		until time.Time
+	)
+
+	return func(v any) {
+		now := bus.clock.Now()
+		mu.Lock()
+		if now.Before(until) {
+			mu.Unlock()
+			return
+		}
+		until = now.Add(d)
+		mu.Unlock()
+		fn(v)
+	}
+}
+
+func (bus *EventBus) debounce(event Event, name string, d time.Duration, fn func(any)) func(any) {
+	var (
+		callMu  sync.Mutex
+		mu      sync.Mutex
+		timer   EventBusTimer
+		last    any
+		pending bool
+		gen     uint64
+	)
+
+	deliver := func(want uint64, force bool) {
+		callMu.Lock()
+		defer callMu.Unlock()
+
+		mu.Lock()
+		if !pending || (!force && want != gen) {
+			mu.Unlock()
+			return
+		}
+		v := last
+		last, pending = nil, false
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		mu.Unlock()
+
+		bus.safeCall(event, name, fn, v)
+	}
+
+	bus.hookMu.Lock()
+	bus.onStop = append(bus.onStop, func() { deliver(0, true) })
+	bus.hookMu.Unlock()
+
+	return func(v any) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		last, pending = v, true
+		gen++
+		if timer != nil {
+			timer.Stop()
+		}
+		armed := gen
+		timer = bus.clock.AfterFunc(d, func() { deliver(armed, false) })
+	}
+}
+
+func (bus *EventBus) coalesce(event Event, name string, window time.Duration, key func(any) string, fn func(any)) func(any) {
+	var (
+		callMu  sync.Mutex
+		mu      sync.Mutex
+		pending = map[string]any{}
+		order   []string
+	)
+
+	deliver := func(keys ...string) {
+		callMu.Lock()
+		defer callMu.Unlock()
+
+		for _, k := range keys {
+			mu.Lock()
+			v, ok := pending[k]
+			delete(pending, k)
+			mu.Unlock()
+			if ok {
+				bus.safeCall(event, name, fn, v)
+			}
+		}
+	}
+
+	bus.hookMu.Lock()
+	bus.onStop = append(bus.onStop, func() {
+		mu.Lock()
+		keys := order
+		order = nil
+		mu.Unlock()
+		deliver(keys...)
+	})
+	bus.hookMu.Unlock()
+
+	return func(v any) {
+		k := key(v)
+
+		mu.Lock()
+		_, open := pending[k]
+		pending[k] = v
+		if !open {
+			order = append(order, k)
+		}
+		mu.Unlock()
+
+		if open {
+			return
+		}
+		bus.clock.AfterFunc(window, func() {
+			mu.Lock()
+			for i, o := range order {
+				if o == k {
+					order = append(order[:i:i], order[i+1:]...)
+					break
+				}
+			}
+			mu.Unlock()
+			deliver(k)
+		})
+	}
+}
+
+// retry adapts a handler that can fail into a subscription function. Failed
+// attempts are retried on the bus clock according to policy, and the final
+// failure is reported to the OnGiveUp hooks and the dead-letter sink. Retries
+// still waiting for their backoff when the bus shuts down are given up the
+// same way, so no handler runs after Start returns.
+func (bus *EventBus) retry(event Event, name string, policy EventBusRetryPolicy, handle func(any) error) func(any) {
+	type pendingRetry struct {
+		timer EventBusTimer
+		v     any
+		err   error
+		n     int
+	}
+
+	var (
+		mu      sync.Mutex
+		pending []*pendingRetry
+	)
+
+	// take removes r from pending and reports whether it was still there.
+	take := func(r *pendingRetry) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, p := range pending {
+			if p == r {
+				pending = append(pending[:i:i], pending[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+
+	if policy.MaxAttempts > 1 {
+		bus.hookMu.Lock()
+		bus.onStop = append(bus.onStop, func() {
+			mu.Lock()
+			stopped := pending
+			pending = nil
+			timers := make([]EventBusTimer, 0, len(stopped))
+			for _, r := range stopped {
+				if r.timer != nil {
+					timers = append(timers, r.timer)
+				}
+			}
+			mu.Unlock()
+
+			for _, t := range timers {
+				t.Stop()
+			}
+			for _, r := range stopped {
+				bus.runOnGiveUp(event, r.v, r.err, r.n)
+				bus.deadLetter(event, name, r.v, r.err, nil, r.n)
+			}
+		})
+		bus.hookMu.Unlock()
+	}
+
+	var attempt func(v any, n int)
+	attempt = func(v any, n int) {
+		err := handle(v)
+		if err == nil {
+			return
+		}
+
+		if n >= policy.MaxAttempts || (policy.Retryable != nil && !policy.Retryable(err)) {
+			bus.runOnGiveUp(event, v, err, n)
+			bus.deadLetter(event, name, v, err, nil, n)
+			return
+		}
+
+		bus.runOnRetry(event, v, err, n)
+		r := &pendingRetry{v: v, err: err, n: n}
+		mu.Lock()
+		pending = append(pending, r)
+		mu.Unlock()
+
+		timer := bus.clock.AfterFunc(policy.backoff(n), func() {
+			if !take(r) {
+				return // given up when the bus stopped
+			}
+			defer func() {
+				if r := recover(); r != nil {
+					bus.panicked(event, name, v, r, n+1)
+				}
+			}()
+			attempt(v, n+1)
+		})
+
+		mu.Lock()
+		r.timer = timer
+		mu.Unlock()
+	}
+
+	return func(v any) { attempt(v, 1) }
+}
+
+// safeCall invokes fn outside the Start loop, recovering a panic the same way
+// the Start loop does.
+func (bus *EventBus) safeCall(event Event, name string, fn func(any), v any) {
+	defer func() {
+		if r := recover(); r != nil {
+			bus.panicked(event, name, v, r, 1)
+		}
+	}()
+	fn(v)
+}
+
+// panicked reports a recovered subscriber panic to the OnPanic hooks and the
+// dead-letter sink.
+func (bus *EventBus) panicked(event Event, name string, payload any, recovered any, attempts int) {
+	bus.runOnPanic(event, payload, recovered)
+	bus.deadLetter(event, name, payload, nil, recovered, attempts)
+}
+
+func (bus *EventBus) deadLetter(event Event, name string, payload any, err error, recovered any, attempts int) {
+	dl := DeadLetter{
+		Time:       bus.clock.Now(),
+		Event:      event,
+		Payload:    payload,
+		Subscriber: name,
+		Attempts:   attempts,
+	}
+	if err != nil {
+		dl.Error = err.Error()
+	}
+	if recovered != nil {
+		dl.Panic = fmt.Sprint(recovered)
+	}
+	// The sink is best effort; a failing sink must not disturb delivery.
+	_ = bus.deadLetters.Put(dl)
+}
+
+func eventBusFuncName(fn any) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+		return f.Name()
+	}
+	return ""
+}
+
+// forward registers deliver for every envelope of event. Like any
+// subscription it only receives envelopes while Start is running.
+func (bus *EventBus) forward(event Event, name string, deliver func(EventEnvelope)) {
+	bus.register(event, &eventBusSubscription{name: name, deliver: deliver})
+}
+
+// subscribeStream registers a subscription that hands payloads to send until
+// ctx is done. When send reports a full buffer the payload is passed to the
+// OnDrop hooks. Once ctx is done the subscription is removed and closeFn is
+// called; send is never invoked after closeFn.
+func (bus *EventBus) subscribeStream(ctx context.Context, event Event, send func(any) bool, closeFn func()) {
+	var (
+		mu     sync.Mutex
+		closed bool
+	)
+
+	sub := &eventBusSubscription{
+		fn: func(v any) {
+			mu.Lock()
+			sent := closed || send(v)
+			mu.Unlock()
+			if !sent {
+				bus.runOnDrop(event, v)
+			}
+		},
+	}
+	bus.register(event, sub)
+
+	go func() {
+		<-ctx.Done()
+		bus.unsubscribe(event, sub.id)
+		mu.Lock()
+		closed = true
+		closeFn()
+		mu.Unlock()
+	}()
+}
+
+// subscribeBatch registers a subscription that collects payloads and passes
+// them to flush once maxSize payloads are pending, once maxWait has elapsed
+// since the first pending payload, or when the bus shuts down. Batches are
+// flushed one at a time and in order.
+func (bus *EventBus) subscribeBatch(event Event, name string, maxSize int, maxWait time.Duration, flush func([]any)) {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+
+	var (
+		flushMu sync.Mutex
+		mu      sync.Mutex
+		pending []any
+		timer   EventBusTimer
+		gen     uint64
+	)
+
+	// deliver flushes the pending batch. Timer flushes pass the generation they
+	// were armed for so a batch that was already flushed by size is not split.
+	deliver := func(want uint64, force bool) {
+		flushMu.Lock()
+		defer flushMu.Unlock()
+
+		mu.Lock()
+		if len(pending) == 0 || (!force && want != gen) {
+			mu.Unlock()
+			return
+		}
+		batch := pending
+		pending = nil
+		gen++
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		mu.Unlock()
+
+		defer func() {
+			if r := recover(); r != nil {
+				bus.runOnPanic(event, batch, r)
+				for _, v := range batch {
+					bus.deadLetter(event, name, v, nil, r, 1)
+				}
+			}
+		}()
+		flush(batch)
+	}
+
+	bus.register(event, &eventBusSubscription{
+		name: name,
+		fn: func(v any) {
+			mu.Lock()
+			pending = append(pending, v)
+			full := len(pending) >= maxSize
+			if len(pending) == 1 && !full && maxWait > 0 {
+				armed := gen
+				timer = bus.clock.AfterFunc(maxWait, func() { deliver(armed, false) })
+			}
+			mu.Unlock()
+
+			if full {
+				deliver(0, true)
+			}
+		},
+	})
+
+	bus.hookMu.Lock()
+	bus.onStop = append(bus.onStop, func() { deliver(0, true) })
+	bus.hookMu.Unlock()
+}
+
+// DeadLetter records an event whose handler panicked or gave up after
+// retries.
+type DeadLetter struct {
+	Time       time.Time
+	Event      Event
+	Payload    any
+	Error      string
+	Panic      string
+	Subscriber string
+	Attempts   int
+	// Redacted is set when payload fields tagged gobusgen:"redact" were zeroed
+	// before the letter was stored. Redrive leaves redacted letters in the sink.
+	Redacted bool
+}
+
+type eventBusDeadLetterRecord struct {
+	Time       time.Time       `json:"time"`
+	Event      Event           `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Error      string          `json:"error,omitempty"`
+	Panic      string          `json:"panic,omitempty"`
+	Subscriber string          `json:"subscriber,omitempty"`
+	Attempts   int             `json:"attempts"`
+	Redacted   bool            `json:"redacted,omitempty"`
+}
+
+// MarshalJSON encodes the dead letter with its payload as JSON.
+func (dl DeadLetter) MarshalJSON() ([]byte, error) {
+	payload, err := json.Marshal(dl.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(eventBusDeadLetterRecord{
+		Time:       dl.Time,
+		Event:      dl.Event,
+		Payload:    payload,
+		Error:      dl.Error,
+		Panic:      dl.Panic,
+		Subscriber: dl.Subscriber,
+		Attempts:   dl.Attempts,
+		Redacted:   dl.Redacted,
+	})
+}
+
+// UnmarshalJSON decodes a dead letter, restoring the payload type of its event.
+func (dl *DeadLetter) UnmarshalJSON(data []byte) error {
+	var rec eventBusDeadLetterRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+
+	payload, err := DecodeEvent(rec.Event, rec.Payload)
+	if err != nil {
+		return err
+	}
+
+	*dl = DeadLetter{
+		Time:       rec.Time,
+		Event:      rec.Event,
+		Payload:    payload,
+		Error:      rec.Error,
+		Panic:      rec.Panic,
+		Subscriber: rec.Subscriber,
+		Attempts:   rec.Attempts,
+		Redacted:   rec.Redacted,
+	}
+	return nil
+}
+
+// DeadLetterSink stores dead letters until they are redriven.
+type DeadLetterSink interface {
+	// Put records a dead letter.
+	Put(dl DeadLetter) error
+	// Take removes and returns the dead letters matching filter. A nil filter
+	// matches every dead letter.
+	Take(filter func(DeadLetter) bool) ([]DeadLetter, error)
+}
+
+// MemoryDeadLetterSink keeps dead letters in memory.
+type MemoryDeadLetterSink struct {
+	mu      sync.Mutex
+	limit   int
+	letters []DeadLetter
+}
+
+// NewMemoryDeadLetterSink creates an in-memory sink that keeps at most
+// limit dead letters, discarding the oldest first. A limit below 1 keeps all.
+func NewMemoryDeadLetterSink(limit int) *MemoryDeadLetterSink {
+	return &MemoryDeadLetterSink{limit: limit}
+}
+
+// Put records a dead letter.
+func (s *MemoryDeadLetterSink) Put(dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters = append(s.letters, dl)
+	if s.limit > 0 && len(s.letters) > s.limit {
+		s.letters = append(s.letters[:0:0], s.letters[len(s.letters)-s.limit:]...)
+	}
+	return nil
+}
+
+// Take removes and returns the dead letters matching filter.
+func (s *MemoryDeadLetterSink) Take(filter func(DeadLetter) bool) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var taken, kept []DeadLetter
+	for _, dl := range s.letters {
+		if filter == nil || filter(dl) {
+			taken = append(taken, dl)
+		} else {
+			kept = append(kept, dl)
+		}
+	}
+	s.letters = kept
+	return taken, nil
+}
+
+// FileDeadLetterSink stores dead letters as JSON lines in a file.
+// Payload fields tagged gobusgen:"redact" are written as zero values and the
+// letter is marked Redacted, so Redrive does not publish the incomplete payload.
+type FileDeadLetterSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileDeadLetterSink creates a sink that appends dead letters to the
+// JSONL file at path, creating it on first use.
+func NewFileDeadLetterSink(path string) *FileDeadLetterSink {
+	return &FileDeadLetterSink{path: path}
+}
+
+// Put appends a dead letter to the file.
+func (s *FileDeadLetterSink) Put(dl DeadLetter) error {
+	payload, redacted := eventBusRedactPayload(dl.Payload)
+	dl.Payload = payload
+	dl.Redacted = dl.Redacted || redacted
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("encoding dead letter: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Take removes and returns the dead letters matching filter, rewriting the
+// file with the remaining lines. Lines that cannot be decoded are kept.
+func (s *FileDeadLetterSink) Take(filter func(DeadLetter) bool) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		taken []DeadLetter
+		kept  bytes.Buffer
+	)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var dl DeadLetter
+		if err := json.Unmarshal(line, &dl); err == nil && (filter == nil || filter(dl)) {
+			taken = append(taken, dl)
+			continue
+		}
+		kept.Write(line)
+		kept.WriteByte('\n')
+	}
+
+	if len(taken) == 0 {
+		return nil, nil
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, kept.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
+
+// DeadLetterSink returns the sink that records dead letters for this bus.
+func (bus *EventBus) DeadLetterSink() DeadLetterSink {
+	return bus.deadLetters
+}
+
+// Redrive removes the dead letters matching filter from the sink and publishes
+// each one again to the subscriber that failed it, so subscribers that already
+// handled the event do not see it twice. A letter without a Subscriber goes to
+// every subscriber of its event. A nil filter matches every dead letter. Redacted letters are never matched and stay in the sink, because
+// their payloads are missing the redacted fields. Letters that cannot be
+// enqueued because the buffer is full, or that remain when ctx is done, are
+// returned to the sink. It returns the number of letters published.
+func (bus *EventBus) Redrive(ctx context.Context, filter func(DeadLetter) bool) (int, error) {
+	letters, err := bus.deadLetters.Take(func(dl DeadLetter) bool {
+		return !dl.Redacted && (filter == nil || filter(dl))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("taking dead letters: %w", err)
+	}
+
+	// putBack returns letters that were taken but not published to the sink
+	// and joins any errors from doing so with err.
+	putBack := func(rest []DeadLetter, err error) error {
+		errs := []error{err}
+		for _, dl := range rest {
+			errs = append(errs, bus.deadLetters.Put(dl))
+		}
+		return errors.Join(errs...)
+	}
+
+	n := 0
+	for i, dl := range letters {
+		if ctx.Err() != nil {
+			return n, putBack(letters[i:], ctx.Err())
+		}
+
+		env := EventEnvelope{
+			ID:         eventBusNewEnvelopeID(),
+			Time:       bus.clock.Now(),
+			Event:      dl.Event,
+			Payload:    dl.Payload,
+			Subscriber: dl.Subscriber,
+		}
+		if bus.publishEnvelope(env) {
+			n++
+			continue
+		}
+		if err := bus.deadLetters.Put(dl); err != nil {
+			return n, putBack(letters[i+1:], fmt.Errorf("returning dead letter: %w", err))
+		}
+	}
+
+	return n, nil
+}
+
+// EventBusTx buffers events in memory until Commit enqueues them on the bus or
+// Rollback discards them. It is safe for concurrent use.
+type EventBusTx struct {
+	bus     *EventBus
+	mu      sync.Mutex
+	pending []EventEnvelope
+	done    bool
+}
+
+var _ Publisher = (*EventBusTx)(nil)
+
+// Begin starts a transaction whose events are published only on Commit.
+func (bus *EventBus) Begin() *EventBusTx {
+	return &EventBusTx{bus: bus}
+}
+
+func (tx *EventBusTx) add(event Event, payload any, md map[string]string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return
+	}
+	tx.pending = append(tx.pending, EventEnvelope{Event: event, Payload: payload, Metadata: maps.Clone(md)})
+}
+
+// Commit enqueues the buffered events in the order they were published. Every
+// event is attempted; if any are dropped because the queue is full, Commit
+// returns an error wrapping ErrDropped. It returns ErrEventBusTxDone if
+// the transaction has already finished.
+func (tx *EventBusTx) Commit() error {
+	tx.mu.Lock()
+	if tx.done {
+		tx.mu.Unlock()
+		return ErrEventBusTxDone
+	}
+	tx.done = true
+	pending := tx.pending
+	tx.pending = nil
+	tx.mu.Unlock()
+
+	dropped := 0
+	for _, env := range pending {
+		env.ID = eventBusNewEnvelopeID()
+		env.Time = tx.bus.clock.Now()
+		if !tx.bus.publishEnvelope(env) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		return fmt.Errorf("%w: %d of %d transaction events", ErrDropped, dropped, len(pending))
+	}
+	return nil
+}
+
+// Rollback discards the buffered events. It returns ErrEventBusTxDone if the
+// transaction has already finished, so it is safe to defer after Commit.
+func (tx *EventBusTx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrEventBusTxDone
+	}
+	tx.done = true
+	tx.pending = nil
+	return nil
+}
+
+// PublishRecipeMutation buffers a recipe.mutation event until Commit. Events published
+// after the transaction has finished are discarded.
+func (tx *EventBusTx) PublishRecipeMutation(payload MutationEvent) {
+	tx.add(EventRecipeMutation, payload, nil)
+}
+
+// PublishRecipeMutationWithMetadata buffers a recipe.mutation event with metadata
+// until Commit.
+func (tx *EventBusTx) PublishRecipeMutationWithMetadata(payload MutationEvent, md map[string]string) {
+	tx.add(EventRecipeMutation, payload, md)
+}
+
+// PublishShoppingListCleanup buffers a shopping_list.cleanup event until Commit. Events published
+// after the transaction has finished are discarded.
+func (tx *EventBusTx) PublishShoppingListCleanup(payload ShoppingListCleanup) {
+	tx.add(EventShoppingListCleanup, payload, nil)
+}
+
+// PublishShoppingListCleanupWithMetadata buffers a shopping_list.cleanup event with metadata
+// until Commit.
+func (tx *EventBusTx) PublishShoppingListCleanupWithMetadata(payload ShoppingListCleanup, md map[string]string) {
+	tx.add(EventShoppingListCleanup, payload, md)
+}
+
+// PublishUserRegistration buffers a user.registration event until Commit. Events published
+// after the transaction has finished are discarded.
+func (tx *EventBusTx) PublishUserRegistration(payload UserRegistrationEvent) {
+	tx.add(EventUserRegistration, payload, nil)
+}
+
+// PublishUserRegistrationWithMetadata buffers a user.registration event with metadata
+// until Commit.
+func (tx *EventBusTx) PublishUserRegistrationWithMetadata(payload UserRegistrationEvent, md map[string]string) {
+	tx.add(EventUserRegistration, payload, md)
+}
+
+type eventBusTxContextKey struct{}
+
+// EventBusContextWithTx returns a copy of ctx that carries tx.
+func EventBusContextWithTx(ctx context.Context, tx *EventBusTx) context.Context {
+	return context.WithValue(ctx, eventBusTxContextKey{}, tx)
+}
+
+// EventBusTxFromContext returns the transaction stored in ctx, if any.
+func EventBusTxFromContext(ctx context.Context) (*EventBusTx, bool) {
+	tx, ok := ctx.Value(eventBusTxContextKey{}).(*EventBusTx)
+	return tx, ok && tx != nil
+}
+
+// PublisherFrom returns the transaction stored in ctx when it belongs to this
+// bus, and the bus itself otherwise. Callers deep in a request can publish
+// through it without knowing whether a transaction is open.
+func (bus *EventBus) PublisherFrom(ctx context.Context) Publisher {
+	if tx, ok := EventBusTxFromContext(ctx); ok && tx.bus == bus {
+		return tx
+	}
+	return bus
+}
+
+// Recorder writes envelopes as JSON lines to an append-only log that
+// Replay can read back. Register it with EventBus.Record.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewRecorder creates a recorder that writes to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Write appends env to the log. After the first failed write the recorder
+// stops writing and keeps returning that error.
+func (r *Recorder) Write(env EventEnvelope) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.enc.Encode(env); err != nil {
+		r.err = fmt.Errorf("recording %s: %w", env.Event, err)
+	}
+	return r.err
+}
+
+// Err returns the first write error, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Record writes every envelope accepted by the queue to rec, including its ID
+// and publish time. Write errors are available from rec.Err.
+func (bus *EventBus) Record(rec *Recorder) {
+	bus.addEnqueueHook(func(env EventEnvelope) { _ = rec.Write(env) })
+}
+
+// EventBusReplayOptions selects which recorded envelopes Replay dispatches and
+// how fast.
+type EventBusReplayOptions struct {
+	// Events limits replay to these events. Empty replays every event.
+	Events []Event
+	// Since skips envelopes published before it. Zero means no lower bound.
+	Since time.Time
+	// Until skips envelopes published at or after it. Zero means no upper bound.
+	Until time.Time
+	// Speed scales the original gaps between envelopes: 1 replays in real
+	// time and 2 twice as fast. Zero or less replays without waiting.
+	Speed float64
+}
+
+// Replay reads a log written by a Recorder from r and pushes the
+// selected envelopes onto the queue, where Start dispatches them to the current
+// subscribers. Replayed envelopes bypass the enqueue and publish hooks, so they
+// are not recorded or forwarded again. While the queue is full Replay waits for
+// room, so it does not finish until Start has caught up. It returns the number
+// of envelopes queued.
+func (bus *EventBus) Replay(ctx context.Context, r io.Reader, opts EventBusReplayOptions) (int, error) {
+	var events map[Event]bool
+	if len(opts.Events) > 0 {
+		events = make(map[Event]bool, len(opts.Events))
+		for _, event := range opts.Events {
+			events[event] = true
+		}
+	}
+
+	dec := json.NewDecoder(r)
+	var last time.Time
+	n := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		var env EventEnvelope
+		if err := dec.Decode(&env); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, fmt.Errorf("reading event log: %w", err)
+		}
+
+		if events != nil && !events[env.Event] {
+			continue
+		}
+		if !opts.Since.IsZero() && env.Time.Before(opts.Since) {
+			continue
+		}
+		if !opts.Until.IsZero() && !env.Time.Before(opts.Until) {
+			continue
+		}
+
+		if opts.Speed > 0 && !last.IsZero() {
+			if gap := env.Time.Sub(last); gap > 0 {
+				if err := bus.sleep(ctx, time.Duration(float64(gap)/opts.Speed)); err != nil {
+					return n, err
+				}
+			}
+		}
+		last = env.Time
+
+		backoff := time.Millisecond
+		for !bus.queue.Push(env) {
+			if err := bus.sleep(ctx, backoff); err != nil {
+				return n, err
+			}
+			backoff = min(2*backoff, 100*time.Millisecond)
+		}
+		n++
+	}
+}
+
+// sleep waits for d on the bus clock and returns ctx.Err() if ctx is done first.
+func (bus *EventBus) sleep(ctx context.Context, d time.Duration) error {
+	wake := make(chan struct{})
+	timer := bus.clock.AfterFunc(d, func() { close(wake) })
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	case <-wake:
+		return nil
+	}
+}
+
+// EventBusTapOptions selects which events Tap writes and which payload fields
+// it hides.
+type EventBusTapOptions struct {
+	// Events limits the tap to these events. Empty taps every event.
+	Events []Event
+	// Redact names top-level JSON payload fields whose values are replaced
+	// with "[REDACTED]".
+	Redact []string
+}
+
+type eventBusTapRecord struct {
+	Time        time.Time       `json:"time"`
+	Event       Event           `json:"event"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Outcome     string          `json:"outcome"`
+	Subscribers int             `json:"subscribers"`
+	Panic       string          `json:"panic,omitempty"`
+}
+
+// Tap writes one JSON object per line to w for every event that is published,
+// dropped or panics a subscriber, with the event name, payload, outcome and
+// the number of subscribers at that moment. It is built on the OnPublish,
+// OnDrop and OnPanic hooks, so a bus without a tap pays nothing for it.
+// Payload fields tagged gobusgen:"redact" are always written as zero values.
+// Tap stops writing after the first write error. Calling stop removes the
+// hooks; once it returns nothing more is written to w.
+func (bus *EventBus) Tap(w io.Writer, opts EventBusTapOptions) (stop func()) {
+	var events map[Event]bool
+	if len(opts.Events) > 0 {
+		events = make(map[Event]bool, len(opts.Events))
+		for _, event := range opts.Events {
+			events[event] = true
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		enc     = json.NewEncoder(w)
+		failed  bool
+		stopped bool
+	)
+	write := func(event Event, payload any, outcome string, recovered any) {
+		if events != nil && !events[event] {
+			return
+		}
+		bus.mu.RLock()
+		n := len(bus.subscribers[event])
+		bus.mu.RUnlock()
+
+		rec := eventBusTapRecord{
+			Time:        bus.clock.Now(),
+			Event:       event,
+			Outcome:     outcome,
+			Subscribers: n,
+		}
+		if data, err := json.Marshal(EventBusRedact(payload)); err == nil {
+			rec.Payload = eventBusRedactJSON(data, opts.Redact)
+		}
+		if recovered != nil {
+			rec.Panic = fmt.Sprint(recovered)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failed || stopped {
+			return
+		}
+		failed = enc.Encode(rec) != nil
+	}
+
+	removers := []func(){
+		eventBusAddHook(bus, &bus.onPublish, func(event Event, payload any) { write(event, payload, "published", nil) }),
+		eventBusAddHook(bus, &bus.onDrop, func(event Event, payload any) { write(event, payload, "dropped", nil) }),
+		eventBusAddHook(bus, &bus.onPanic, func(event Event, payload any, recovered any) { write(event, payload, "panic", recovered) }),
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, remove := range removers {
+				remove()
+			}
+			// A hook that was already running finishes its write before
+			// stop returns; later ones see stopped and skip it.
+			mu.Lock()
+			stopped = true
+			mu.Unlock()
+		})
+	}
+}
+
+// eventBusRedactJSON replaces the named top-level fields of the JSON object in data
+// with "[REDACTED]". Data that is not an object is returned unchanged.
+func eventBusRedactJSON(data []byte, fields []string) json.RawMessage {
+	if len(fields) == 0 {
+		return data
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return data
+	}
+	for _, field := range fields {
+		if _, ok := obj[field]; ok {
+			obj[field] = json.RawMessage(strconv.Quote("[REDACTED]"))
+		}
+	}
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// eventBusCheckPayload reports whether payload has the type declared for event.
+func eventBusCheckPayload(event Event, payload any) error {
+	switch event {
+	case EventRecipeMutation:
+		if _, ok := payload.(MutationEvent); !ok {
+			return fmt.Errorf("%w: %s wants MutationEvent, got %T", ErrPayloadType, event, payload)
+		}
+		return nil
+	case EventShoppingListCleanup:
+		if _, ok := payload.(ShoppingListCleanup); !ok {
+			return fmt.Errorf("%w: %s wants ShoppingListCleanup, got %T", ErrPayloadType, event, payload)
+		}
+		return nil
+	case EventUserRegistration:
+		if _, ok := payload.(UserRegistrationEvent); !ok {
+			return fmt.Errorf("%w: %s wants UserRegistrationEvent, got %T", ErrPayloadType, event, payload)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", ErrUnknownEvent, event)
+}
+
+// eventBusRedactZero sets *v to its zero value and reports whether it was not
+// zero already.
+func eventBusRedactZero[T any](v *T) bool {
+	if reflect.ValueOf(v).Elem().IsZero() {
+		return false
+	}
+	var zero T
+	*v = zero
+	return true
+}
 
-	hookMu      sync.RWMutex
-	onPublish   []func(Event, any)
-	onDrop      []func(Event, any)
-	onSubscribe []func(Event)
-	onPanic     []func(Event, any, any)
+// eventBusRedactUserRegistrationEvent returns a copy of p with the fields tagged
+// gobusgen:"redact" set to their zero values, including fields of nested
+// values, and reports whether any of them was not zero. Nested pointers,
+// slices and maps are copied rather than modified.
+func eventBusRedactUserRegistrationEvent(p UserRegistrationEvent) (UserRegistrationEvent, bool) {
+	changed := false
+	changed = eventBusRedactZero(&p.Email) || changed
+	return p, changed
 }
 
-type envelope struct {
-	event   Event
-	payload any
+// EventBusRedact returns a copy of payload with the fields tagged
+// gobusgen:"redact" set to their zero values, for use by loggers, trace
+// exporters and other sinks that record payloads. Batches are redacted element
+// by element. Payloads without tagged fields are returned unchanged.
+func EventBusRedact(payload any) any {
+	redacted, _ := eventBusRedactPayload(payload)
+	return redacted
 }
 
-// New creates an EventBus with the given channel buffer size.
-func New(size int) *EventBus {
-	if size < 1 {
-		size = 1
+// eventBusRedactPayload implements EventBusRedact and also reports whether
+// a tagged field that was not zero was removed.
+func eventBusRedactPayload(payload any) (any, bool) {
+	switch p := payload.(type) {
+	case UserRegistrationEvent:
+		return eventBusRedactUserRegistrationEvent(p)
+	case []UserRegistrationEvent:
+		out := make([]UserRegistrationEvent, len(p))
+		changed := false
+		for i := range p {
+			var c bool
+			out[i], c = eventBusRedactUserRegistrationEvent(p[i])
+			changed = changed || c
+		}
+		return out, changed
+	case []any:
+		// Panicking batch handlers report their batch as []any.
+		out := make([]any, len(p))
+		changed := false
+		for i := range p {
+			var c bool
+			out[i], c = eventBusRedactPayload(p[i])
+			changed = changed || c
+		}
+		return out, changed
 	}
+	return payload, false
+}
 
-	return &EventBus{
-		subscribers: newSubscribersMap(),
-		ch:          make(chan envelope, size),
+// EncodeEvent encodes payload as JSON after checking that it has the
+// payload type declared for event.
+func EncodeEvent(event Event, payload any) ([]byte, error) {
+	if err := eventBusCheckPayload(event, payload); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s payload: %w", event, err)
 	}
+	return data, nil
 }
 
-func newSubscribersMap() map[Event][]any {
-	return map[Event][]any{
-		EventRecipeMutation:      {},
-		EventShoppingListCleanup: {},
-		EventUserRegistration:    {},
+// DecodeEvent decodes JSON data into the payload type declared for event.
+// The returned value holds the payload type itself, not a pointer to it.
+func DecodeEvent(event Event, data []byte) (any, error) {
+	switch event {
+	case EventRecipeMutation:
+		var payload MutationEvent
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, fmt.Errorf("decoding %s payload: %w", event, err)
+		}
+		return payload, nil
+	case EventShoppingListCleanup:
+		var payload ShoppingListCleanup
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, fmt.Errorf("decoding %s payload: %w", event, err)
+		}
+		return payload, nil
+	case EventUserRegistration:
+		var payload UserRegistrationEvent
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, fmt.Errorf("decoding %s payload: %w", event, err)
+		}
+		return payload, nil
 	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownEvent, event)
 }
 
-// Start begins processing events. It blocks until ctx is cancelled.
-func (bus *EventBus) Start(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case env := <-bus.ch:
-			bus.mu.RLock()
-			subs := make([]any, len(bus.subscribers[env.event]))
-			copy(subs, bus.subscribers[env.event])
-			bus.mu.RUnlock()
+// PublishRaw decodes a JSON payload for event and publishes it as if the
+// typed Publish method had been called. It returns ErrUnknownEvent
+// for events this bus does not declare and ErrDropped when the queue is full.
+func (bus *EventBus) PublishRaw(ctx context.Context, event Event, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-			for _, sub := range subs {
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							bus.runOnPanic(env.event, env.payload, r)
-						}
-					}()
-					if fn, ok := sub.(func(any)); ok {
-						fn(env.payload)
-					}
-				}()
-			}
-		}
+	payload, err := DecodeEvent(event, data)
+	if err != nil {
+		return err
+	}
+
+	if !bus.publish(event, payload) {
+		return ErrDropped
+	}
+	return nil
+}
+
+// Publish publishes payload for event without a compile-time type check. It
+// returns ErrUnknownEvent for events this bus does not declare,
+// ErrPayloadType when payload does not have the declared type, and
+// ErrDropped when the queue is full.
+func (bus *EventBus) Publish(event Event, payload any) error {
+	if err := eventBusCheckPayload(event, payload); err != nil {
+		return err
+	}
+
+	if !bus.publish(event, payload) {
+		return ErrDropped
+	}
+	return nil
+}
+
+// SubscribeAny registers a handler that receives the payloads of event as
+// any. It returns ErrUnknownEvent for events this bus does not declare.
+func (bus *EventBus) SubscribeAny(event Event, fn func(any), opts ...EventBusSubscribeOption) error {
+	if !event.Valid() {
+		return fmt.Errorf("%w: %q", ErrUnknownEvent, event)
 	}
+
+	bus.subscribe(event, &eventBusSubscription{name: eventBusFuncName(fn), fn: fn}, opts...)
+	return nil
 }
 
 // PublishRecipeMutation publishes a recipe.mutation event.
 func (bus *EventBus) PublishRecipeMutation(payload MutationEvent) {
+	bus.publish(EventRecipeMutation, payload)
+}
+
+// PublishRecipeMutationWithMetadata publishes a recipe.mutation event carrying md in
+// its envelope. md is copied.
+func (bus *EventBus) PublishRecipeMutationWithMetadata(payload MutationEvent, md map[string]string) {
+	bus.publishEnvelope(EventEnvelope{
+		ID:       eventBusNewEnvelopeID(),
+		Time:     bus.clock.Now(),
+		Event:    EventRecipeMutation,
+		Payload:  payload,
+		Metadata: maps.Clone(md),
+	})
+}
+
+// PublishRecipeMutationAfter publishes a recipe.mutation event once d has elapsed.
+func (bus *EventBus) PublishRecipeMutationAfter(d time.Duration, payload MutationEvent) *ScheduledEvent {
+	return bus.scheduleAt(EventRecipeMutation, payload, bus.clock.Now().Add(d))
+}
+
+// PublishRecipeMutationAt publishes a recipe.mutation event at t.
+func (bus *EventBus) PublishRecipeMutationAt(t time.Time, payload MutationEvent) *ScheduledEvent {
+	return bus.scheduleAt(EventRecipeMutation, payload, t)
+}
+
+// SubscribeRecipeMutation registers a handler for recipe.mutation events.
+func (bus *EventBus) SubscribeRecipeMutation(fn func(MutationEvent), opts ...EventBusSubscribeOption) {
+	bus.subscribe(EventRecipeMutation, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		fn: func(v any) {
+			payload, ok := v.(MutationEvent)
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	}, opts...)
+}
+
+// SubscribeRecipeMutationErr registers a handler for recipe.mutation events that can
+// fail. Failed attempts are retried according to the retry policy set with
+// EventBusWithRetry, and failures that are not retried are reported to the
+// OnGiveUp hooks.
+func (bus *EventBus) SubscribeRecipeMutationErr(fn func(MutationEvent) error, opts ...EventBusSubscribeOption) {
+	bus.subscribe(EventRecipeMutation, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		handle: func(v any) error {
+			payload, ok := v.(MutationEvent)
+			if !ok {
+				return nil
+			}
+			return fn(payload)
+		},
+	}, opts...)
+}
+
+// SubscribeRecipeMutationOnce registers a handler for the next recipe.mutation event.
+// The handler is removed before it is called and never runs more than once.
+func (bus *EventBus) SubscribeRecipeMutationOnce(fn func(MutationEvent)) {
+	bus.subscribe(EventRecipeMutation, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		once: true,
+		fn: func(v any) {
+			payload, ok := v.(MutationEvent)
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	})
+}
+
+// SubscribeRecipeMutationWhere registers a handler for recipe.mutation events that
+// satisfy pred. Events rejected by pred are not delivered to fn.
+func (bus *EventBus) SubscribeRecipeMutationWhere(pred func(MutationEvent) bool, fn func(MutationEvent), opts ...EventBusSubscribeOption) {
+	bus.subscribe(EventRecipeMutation, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		filter: func(v any) bool {
+			payload, ok := v.(MutationEvent)
+			return ok && pred(payload)
+		},
+		fn: func(v any) {
+			payload, ok := v.(MutationEvent)
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	}, opts...)
+}
+
+// WaitForRecipeMutation blocks until a recipe.mutation event satisfying pred is
+// dispatched and returns its payload. A nil pred matches every event. The
+// temporary subscription is removed when WaitForRecipeMutation returns, and
+// ctx.Err() is returned if ctx is done first.
+func (bus *EventBus) WaitForRecipeMutation(ctx context.Context, pred func(MutationEvent) bool) (MutationEvent, error) {
+	ch := make(chan MutationEvent, 1)
+	sub := &eventBusSubscription{
+		name: "WaitForRecipeMutation",
+		once: true,
+		filter: func(v any) bool {
+			payload, ok := v.(MutationEvent)
+			return ok && (pred == nil || pred(payload))
+		},
+		fn: func(v any) {
+			ch <- v.(MutationEvent)
+		},
+	}
+	bus.register(EventRecipeMutation, sub)
+
 	select {
-	case bus.ch <- envelope{event: EventRecipeMutation, payload: payload}:
-		bus.runOnPublish(EventRecipeMutation, payload)
-	default:
-		bus.runOnDrop(EventRecipeMutation, payload)
+	case payload := <-ch:
+		return payload, nil
+	case <-ctx.Done():
+		bus.unsubscribe(EventRecipeMutation, sub.id)
+		var zero MutationEvent
+		return zero, ctx.Err()
 	}
 }
 
-// SubscribeRecipeMutation registers a handler for recipe.mutation events.
-func (bus *EventBus) SubscribeRecipeMutation(fn func(MutationEvent)) {
-	bus.mu.Lock()
-	bus.subscribers[EventRecipeMutation] = append(bus.subscribers[EventRecipeMutation], func(v any) {
+// ForwardRecipeMutation republishes every recipe.mutation event on dst with its
+// metadata while this bus is running. Forwarding stops when Start returns and
+// resumes if Start is called again. dst is typically another bus, possibly from
+// a different generated package, that declares the same payload type.
+func (bus *EventBus) ForwardRecipeMutation(dst RecipeMutationMetadataPublisher) {
+	bus.forward(EventRecipeMutation, "ForwardRecipeMutation", func(env EventEnvelope) {
+		if payload, ok := env.Payload.(MutationEvent); ok {
+			dst.PublishRecipeMutationWithMetadata(payload, env.Metadata)
+		}
+	})
+}
+
+// EventBusCoalesceRecipeMutation holds recipe.mutation events by the key returned from
+// key and delivers only the last event per key once window has passed since
+// the first event for that key. Subscribing to another event with it panics.
+func EventBusCoalesceRecipeMutation(window time.Duration, key func(MutationEvent) string) EventBusSubscribeOption {
+	return func(cfg *eventBusSubscribeConfig) {
+		cfg.coalesceWindow = window
+		cfg.coalesceEvent = EventRecipeMutation
+		cfg.coalesceKey = func(v any) string {
+			payload, _ := v.(MutationEvent)
+			return key(payload)
+		}
+	}
+}
+
+// SubscribeRecipeMutationBatch registers a handler that receives recipe.mutation events
+// in batches. A batch is delivered once it holds maxSize events, once maxWait
+// has passed since its first event, or when the bus shuts down. A maxWait of
+// zero disables the time window.
+func (bus *EventBus) SubscribeRecipeMutationBatch(maxSize int, maxWait time.Duration, fn func([]MutationEvent)) {
+	bus.subscribeBatch(EventRecipeMutation, eventBusFuncName(fn), maxSize, maxWait, func(items []any) {
+		batch := make([]MutationEvent, 0, len(items))
+		for _, v := range items {
+			if payload, ok := v.(MutationEvent); ok {
+				batch = append(batch, payload)
+			}
+		}
+		fn(batch)
+	})
+}
+
+// RecipeMutationChan returns a channel that receives recipe.mutation events until ctx
+// is done, after which the subscription is removed and the channel is closed.
+// The channel buffers up to size events. When the consumer falls behind and
+// the buffer is full, new events are discarded for this channel only and
+// reported to the OnDrop hooks.
+func (bus *EventBus) RecipeMutationChan(ctx context.Context, size int) <-chan MutationEvent {
+	if size < 1 {
+		size = 1
+	}
+
+	ch := make(chan MutationEvent, size)
+	bus.subscribeStream(ctx, EventRecipeMutation, func(v any) bool {
 		payload, ok := v.(MutationEvent)
 		if !ok {
-			return
+			return true
 		}
-		fn(payload)
-	})
-	bus.mu.Unlock()
-	bus.runOnSubscribe(EventRecipeMutation)
+		select {
+		case ch <- payload:
+			return true
+		default:
+			return false
+		}
+	}, func() { close(ch) })
+
+	return ch
+}
+
+// RecipeMutationSeq returns an iterator over recipe.mutation events. The subscription
+// is created when iteration starts and removed when the loop exits or ctx is
+// done. Events are buffered up to the bus queue capacity with the same overflow
+// policy as RecipeMutationChan: events arriving while the buffer is full are
+// discarded and reported to the OnDrop hooks.
+func (bus *EventBus) RecipeMutationSeq(ctx context.Context) iter.Seq[MutationEvent] {
+	return func(yield func(MutationEvent) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		ch := bus.RecipeMutationChan(ctx, bus.queue.Cap())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case payload, ok := <-ch:
+				if !ok || !yield(payload) {
+					return
+				}
+			}
+		}
+	}
 }
 
 // PublishShoppingListCleanup publishes a shopping_list.cleanup event.
 func (bus *EventBus) PublishShoppingListCleanup(payload ShoppingListCleanup) {
+	bus.publish(EventShoppingListCleanup, payload)
+}
+
+// PublishShoppingListCleanupWithMetadata publishes a shopping_list.cleanup event carrying md in
+// its envelope. md is copied.
+func (bus *EventBus) PublishShoppingListCleanupWithMetadata(payload ShoppingListCleanup, md map[string]string) {
+	bus.publishEnvelope(EventEnvelope{
+		ID:       eventBusNewEnvelopeID(),
+		Time:     bus.clock.Now(),
+		Event:    EventShoppingListCleanup,
+		Payload:  payload,
+		Metadata: maps.Clone(md),
+	})
+}
+
+// PublishShoppingListCleanupAfter publishes a shopping_list.cleanup event once d has elapsed.
+func (bus *EventBus) PublishShoppingListCleanupAfter(d time.Duration, payload ShoppingListCleanup) *ScheduledEvent {
+	return bus.scheduleAt(EventShoppingListCleanup, payload, bus.clock.Now().Add(d))
+}
+
+// PublishShoppingListCleanupAt publishes a shopping_list.cleanup event at t.
+func (bus *EventBus) PublishShoppingListCleanupAt(t time.Time, payload ShoppingListCleanup) *ScheduledEvent {
+	return bus.scheduleAt(EventShoppingListCleanup, payload, t)
+}
+
+// SubscribeShoppingListCleanup registers a handler for shopping_list.cleanup events.
+func (bus *EventBus) SubscribeShoppingListCleanup(fn func(ShoppingListCleanup), opts ...EventBusSubscribeOption) {
+	bus.subscribe(EventShoppingListCleanup, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		fn: func(v any) {
+			payload, ok := v.(ShoppingListCleanup)
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	}, opts...)
+}
+
+// SubscribeShoppingListCleanupErr registers a handler for shopping_list.cleanup events that can
+// fail. Failed attempts are retried according to the retry policy set with
+// EventBusWithRetry, and failures that are not retried are reported to the
+// OnGiveUp hooks.
+func (bus *EventBus) SubscribeShoppingListCleanupErr(fn func(ShoppingListCleanup) error, opts ...EventBusSubscribeOption) {
+	bus.subscribe(EventShoppingListCleanup, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		handle: func(v any) error {
+			payload, ok := v.(ShoppingListCleanup)
+			if !ok {
+				return nil
+			}
+			return fn(payload)
+		},
+	}, opts...)
+}
+
+// SubscribeShoppingListCleanupOnce registers a handler for the next shopping_list.cleanup event.
+// The handler is removed before it is called and never runs more than once.
+func (bus *EventBus) SubscribeShoppingListCleanupOnce(fn func(ShoppingListCleanup)) {
+	bus.subscribe(EventShoppingListCleanup, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		once: true,
+		fn: func(v any) {
+			payload, ok := v.(ShoppingListCleanup)
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	})
+}
+
+// SubscribeShoppingListCleanupWhere registers a handler for shopping_list.cleanup events that
+// satisfy pred. Events rejected by pred are not delivered to fn.
+func (bus *EventBus) SubscribeShoppingListCleanupWhere(pred func(ShoppingListCleanup) bool, fn func(ShoppingListCleanup), opts ...EventBusSubscribeOption) {
+	bus.subscribe(EventShoppingListCleanup, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		filter: func(v any) bool {
+			payload, ok := v.(ShoppingListCleanup)
+			return ok && pred(payload)
+		},
+		fn: func(v any) {
+			payload, ok := v.(ShoppingListCleanup)
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	}, opts...)
+}
+
+// WaitForShoppingListCleanup blocks until a shopping_list.cleanup event satisfying pred is
+// dispatched and returns its payload. A nil pred matches every event. The
+// temporary subscription is removed when WaitForShoppingListCleanup returns, and
+// ctx.Err() is returned if ctx is done first.
+func (bus *EventBus) WaitForShoppingListCleanup(ctx context.Context, pred func(ShoppingListCleanup) bool) (ShoppingListCleanup, error) {
+	ch := make(chan ShoppingListCleanup, 1)
+	sub := &eventBusSubscription{
+		name: "WaitForShoppingListCleanup",
+		once: true,
+		filter: func(v any) bool {
+			payload, ok := v.(ShoppingListCleanup)
+			return ok && (pred == nil || pred(payload))
+		},
+		fn: func(v any) {
+			ch <- v.(ShoppingListCleanup)
+		},
+	}
+	bus.register(EventShoppingListCleanup, sub)
+
 	select {
-	case bus.ch <- envelope{event: EventShoppingListCleanup, payload: payload}:
-		bus.runOnPublish(EventShoppingListCleanup, payload)
-	default:
-		bus.runOnDrop(EventShoppingListCleanup, payload)
+	case payload := <-ch:
+		return payload, nil
+	case <-ctx.Done():
+		bus.unsubscribe(EventShoppingListCleanup, sub.id)
+		var zero ShoppingListCleanup
+		return zero, ctx.Err()
 	}
 }
 
-// SubscribeShoppingListCleanup registers a handler for shopping_list.cleanup events.
-func (bus *EventBus) SubscribeShoppingListCleanup(fn func(ShoppingListCleanup)) {
-	bus.mu.Lock()
-	bus.subscribers[EventShoppingListCleanup] = append(bus.subscribers[EventShoppingListCleanup], func(v any) {
+// ForwardShoppingListCleanup republishes every shopping_list.cleanup event on dst with its
+// metadata while this bus is running. Forwarding stops when Start returns and
+// resumes if Start is called again. dst is typically another bus, possibly from
+// a different generated package, that declares the same payload type.
+func (bus *EventBus) ForwardShoppingListCleanup(dst ShoppingListCleanupMetadataPublisher) {
+	bus.forward(EventShoppingListCleanup, "ForwardShoppingListCleanup", func(env EventEnvelope) {
+		if payload, ok := env.Payload.(ShoppingListCleanup); ok {
+			dst.PublishShoppingListCleanupWithMetadata(payload, env.Metadata)
+		}
+	})
+}
+
+// EventBusCoalesceShoppingListCleanup holds shopping_list.cleanup events by the key returned from
+// key and delivers only the last event per key once window has passed since
+// the first event for that key. Subscribing to another event with it panics.
+func EventBusCoalesceShoppingListCleanup(window time.Duration, key func(ShoppingListCleanup) string) EventBusSubscribeOption {
+	return func(cfg *eventBusSubscribeConfig) {
+		cfg.coalesceWindow = window
+		cfg.coalesceEvent = EventShoppingListCleanup
+		cfg.coalesceKey = func(v any) string {
+			payload, _ := v.(ShoppingListCleanup)
+			return key(payload)
+		}
+	}
+}
+
+// SubscribeShoppingListCleanupBatch registers a handler that receives shopping_list.cleanup events
+// in batches. A batch is delivered once it holds maxSize events, once maxWait
+// has passed since its first event, or when the bus shuts down. A maxWait of
+// zero disables the time window.
+func (bus *EventBus) SubscribeShoppingListCleanupBatch(maxSize int, maxWait time.Duration, fn func([]ShoppingListCleanup)) {
+	bus.subscribeBatch(EventShoppingListCleanup, eventBusFuncName(fn), maxSize, maxWait, func(items []any) {
+		batch := make([]ShoppingListCleanup, 0, len(items))
+		for _, v := range items {
+			if payload, ok := v.(ShoppingListCleanup); ok {
+				batch = append(batch, payload)
+			}
+		}
+		fn(batch)
+	})
+}
+
+// ShoppingListCleanupChan returns a channel that receives shopping_list.cleanup events until ctx
+// is done, after which the subscription is removed and the channel is closed.
+// The channel buffers up to size events. When the consumer falls behind and
+// the buffer is full, new events are discarded for this channel only and
+// reported to the OnDrop hooks.
+func (bus *EventBus) ShoppingListCleanupChan(ctx context.Context, size int) <-chan ShoppingListCleanup {
+	if size < 1 {
+		size = 1
+	}
+
+	ch := make(chan ShoppingListCleanup, size)
+	bus.subscribeStream(ctx, EventShoppingListCleanup, func(v any) bool {
 		payload, ok := v.(ShoppingListCleanup)
 		if !ok {
-			return
+			return true
 		}
-		fn(payload)
-	})
-	bus.mu.Unlock()
-	bus.runOnSubscribe(EventShoppingListCleanup)
+		select {
+		case ch <- payload:
+			return true
+		default:
+			return false
+		}
+	}, func() { close(ch) })
+
+	return ch
+}
+
+// ShoppingListCleanupSeq returns an iterator over shopping_list.cleanup events. The subscription
+// is created when iteration starts and removed when the loop exits or ctx is
+// done. Events are buffered up to the bus queue capacity with the same overflow
+// policy as ShoppingListCleanupChan: events arriving while the buffer is full are
+// discarded and reported to the OnDrop hooks.
+func (bus *EventBus) ShoppingListCleanupSeq(ctx context.Context) iter.Seq[ShoppingListCleanup] {
+	return func(yield func(ShoppingListCleanup) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		ch := bus.ShoppingListCleanupChan(ctx, bus.queue.Cap())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case payload, ok := <-ch:
+				if !ok || !yield(payload) {
+					return
+				}
+			}
+		}
+	}
 }
 
 // PublishUserRegistration publishes a user.registration event.
 func (bus *EventBus) PublishUserRegistration(payload UserRegistrationEvent) {
+	bus.publish(EventUserRegistration, payload)
+}
+
+// PublishUserRegistrationWithMetadata publishes a user.registration event carrying md in
+// its envelope. md is copied.
+func (bus *EventBus) PublishUserRegistrationWithMetadata(payload UserRegistrationEvent, md map[string]string) {
+	bus.publishEnvelope(EventEnvelope{
+		ID:       eventBusNewEnvelopeID(),
+		Time:     bus.clock.Now(),
+		Event:    EventUserRegistration,
+		Payload:  payload,
+		Metadata: maps.Clone(md),
+	})
+}
+
+// PublishUserRegistrationAfter publishes a user.registration event once d has elapsed.
+func (bus *EventBus) PublishUserRegistrationAfter(d time.Duration, payload UserRegistrationEvent) *ScheduledEvent {
+	return bus.scheduleAt(EventUserRegistration, payload, bus.clock.Now().Add(d))
+}
+
+// PublishUserRegistrationAt publishes a user.registration event at t.
+func (bus *EventBus) PublishUserRegistrationAt(t time.Time, payload UserRegistrationEvent) *ScheduledEvent {
+	return bus.scheduleAt(EventUserRegistration, payload, t)
+}
+
+// SubscribeUserRegistration registers a handler for user.registration events.
+func (bus *EventBus) SubscribeUserRegistration(fn func(UserRegistrationEvent), opts ...EventBusSubscribeOption) {
+	bus.subscribe(EventUserRegistration, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		fn: func(v any) {
+			payload, ok := v.(UserRegistrationEvent)
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	}, opts...)
+}
+
+// SubscribeUserRegistrationErr registers a handler for user.registration events that can
+// fail. Failed attempts are retried according to the retry policy set with
+// EventBusWithRetry, and failures that are not retried are reported to the
+// OnGiveUp hooks.
+func (bus *EventBus) SubscribeUserRegistrationErr(fn func(UserRegistrationEvent) error, opts ...EventBusSubscribeOption) {
+	bus.subscribe(EventUserRegistration, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		handle: func(v any) error {
+			payload, ok := v.(UserRegistrationEvent)
+			if !ok {
+				return nil
+			}
+			return fn(payload)
+		},
+	}, opts...)
+}
+
+// SubscribeUserRegistrationOnce registers a handler for the next user.registration event.
+// The handler is removed before it is called and never runs more than once.
+func (bus *EventBus) SubscribeUserRegistrationOnce(fn func(UserRegistrationEvent)) {
+	bus.subscribe(EventUserRegistration, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		once: true,
+		fn: func(v any) {
+			payload, ok := v.(UserRegistrationEvent)
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	})
+}
+
+// SubscribeUserRegistrationWhere registers a handler for user.registration events that
+// satisfy pred. Events rejected by pred are not delivered to fn.
+func (bus *EventBus) SubscribeUserRegistrationWhere(pred func(UserRegistrationEvent) bool, fn func(UserRegistrationEvent), opts ...EventBusSubscribeOption) {
+	bus.subscribe(EventUserRegistration, &eventBusSubscription{
+		name: eventBusFuncName(fn),
+		filter: func(v any) bool {
+			payload, ok := v.(UserRegistrationEvent)
+			return ok && pred(payload)
+		},
+		fn: func(v any) {
+			payload, ok := v.(UserRegistrationEvent)
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	}, opts...)
+}
+
+// WaitForUserRegistration blocks until a user.registration event satisfying pred is
+// dispatched and returns its payload. A nil pred matches every event. The
+// temporary subscription is removed when WaitForUserRegistration returns, and
+// ctx.Err() is returned if ctx is done first.
+func (bus *EventBus) WaitForUserRegistration(ctx context.Context, pred func(UserRegistrationEvent) bool) (UserRegistrationEvent, error) {
+	ch := make(chan UserRegistrationEvent, 1)
+	sub := &eventBusSubscription{
+		name: "WaitForUserRegistration",
+		once: true,
+		filter: func(v any) bool {
+			payload, ok := v.(UserRegistrationEvent)
+			return ok && (pred == nil || pred(payload))
+		},
+		fn: func(v any) {
+			ch <- v.(UserRegistrationEvent)
+		},
+	}
+	bus.register(EventUserRegistration, sub)
+
 	select {
-	case bus.ch <- envelope{event: EventUserRegistration, payload: payload}:
-		bus.runOnPublish(EventUserRegistration, payload)
-	default:
-		bus.runOnDrop(EventUserRegistration, payload)
+	case payload := <-ch:
+		return payload, nil
+	case <-ctx.Done():
+		bus.unsubscribe(EventUserRegistration, sub.id)
+		var zero UserRegistrationEvent
+		return zero, ctx.Err()
 	}
 }
 
-// SubscribeUserRegistration registers a handler for user.registration events.
-func (bus *EventBus) SubscribeUserRegistration(fn func(UserRegistrationEvent)) {
-	bus.mu.Lock()
-	bus.subscribers[EventUserRegistration] = append(bus.subscribers[EventUserRegistration], func(v any) {
+// ForwardUserRegistration republishes every user.registration event on dst with its
+// metadata while this bus is running. Forwarding stops when Start returns and
+// resumes if Start is called again. dst is typically another bus, possibly from
+// a different generated package, that declares the same payload type.
+func (bus *EventBus) ForwardUserRegistration(dst UserRegistrationMetadataPublisher) {
+	bus.forward(EventUserRegistration, "ForwardUserRegistration", func(env EventEnvelope) {
+		if payload, ok := env.Payload.(UserRegistrationEvent); ok {
+			dst.PublishUserRegistrationWithMetadata(payload, env.Metadata)
+		}
+	})
+}
+
+// EventBusCoalesceUserRegistration holds user.registration events by the key returned from
+// key and delivers only the last event per key once window has passed since
+// the first event for that key. Subscribing to another event with it panics.
+func EventBusCoalesceUserRegistration(window time.Duration, key func(UserRegistrationEvent) string) EventBusSubscribeOption {
+	return func(cfg *eventBusSubscribeConfig) {
+		cfg.coalesceWindow = window
+		cfg.coalesceEvent = EventUserRegistration
+		cfg.coalesceKey = func(v any) string {
+			payload, _ := v.(UserRegistrationEvent)
+			return key(payload)
+		}
+	}
+}
+
+// SubscribeUserRegistrationBatch registers a handler that receives user.registration events
+// in batches. A batch is delivered once it holds maxSize events, once maxWait
+// has passed since its first event, or when the bus shuts down. A maxWait of
+// zero disables the time window.
+func (bus *EventBus) SubscribeUserRegistrationBatch(maxSize int, maxWait time.Duration, fn func([]UserRegistrationEvent)) {
+	bus.subscribeBatch(EventUserRegistration, eventBusFuncName(fn), maxSize, maxWait, func(items []any) {
+		batch := make([]UserRegistrationEvent, 0, len(items))
+		for _, v := range items {
+			if payload, ok := v.(UserRegistrationEvent); ok {
+				batch = append(batch, payload)
+			}
+		}
+		fn(batch)
+	})
+}
+
+// UserRegistrationChan returns a channel that receives user.registration events until ctx
+// is done, after which the subscription is removed and the channel is closed.
+// The channel buffers up to size events. When the consumer falls behind and
+// the buffer is full, new events are discarded for this channel only and
+// reported to the OnDrop hooks.
+func (bus *EventBus) UserRegistrationChan(ctx context.Context, size int) <-chan UserRegistrationEvent {
+	if size < 1 {
+		size = 1
+	}
+
+	ch := make(chan UserRegistrationEvent, size)
+	bus.subscribeStream(ctx, EventUserRegistration, func(v any) bool {
 		payload, ok := v.(UserRegistrationEvent)
 		if !ok {
-			return
+			return true
 		}
-		fn(payload)
-	})
-	bus.mu.Unlock()
-	bus.runOnSubscribe(EventUserRegistration)
+		select {
+		case ch <- payload:
+			return true
+		default:
+			return false
+		}
+	}, func() { close(ch) })
+
+	return ch
+}
+
+// UserRegistrationSeq returns an iterator over user.registration events. The subscription
+// is created when iteration starts and removed when the loop exits or ctx is
+// done. Events are buffered up to the bus queue capacity with the same overflow
+// policy as UserRegistrationChan: events arriving while the buffer is full are
+// discarded and reported to the OnDrop hooks.
+func (bus *EventBus) UserRegistrationSeq(ctx context.Context) iter.Seq[UserRegistrationEvent] {
+	return func(yield func(UserRegistrationEvent) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		ch := bus.UserRegistrationChan(ctx, bus.queue.Cap())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case payload, ok := <-ch:
+				if !ok || !yield(payload) {
+					return
+				}
+			}
+		}
+	}
 }
 
 // OnPublish registers a hook that fires after an event is successfully enqueued.
 func (bus *EventBus) OnPublish(fn func(Event, any)) {
-	bus.hookMu.Lock()
-	bus.onPublish = append(bus.onPublish, fn)
-	bus.hookMu.Unlock()
+	eventBusAddHook(bus, &bus.onPublish, fn)
 }
 
-// OnDrop registers a hook that fires when an event is dropped due to a full buffer.
+// OnDrop registers a hook that fires when an event is dropped due to a full
+// buffer, either the bus buffer or the buffer of a channel or iterator subscriber.
 func (bus *EventBus) OnDrop(fn func(Event, any)) {
-	bus.hookMu.Lock()
-	bus.onDrop = append(bus.onDrop, fn)
-	bus.hookMu.Unlock()
+	eventBusAddHook(bus, &bus.onDrop, fn)
 }
 
 // OnSubscribe registers a hook that fires after a subscriber is registered.
@@ -176,28 +2872,80 @@ func (bus *EventBus) OnSubscribe(fn func(Event)) {
 
 // OnPanic registers a hook that fires when a subscriber panics.
 func (bus *EventBus) OnPanic(fn func(Event, any, any)) {
+	eventBusAddHook(bus, &bus.onPanic, fn)
+}
+
+// OnRetry registers a hook that fires when a handler returns an error and
+// another attempt is scheduled. The int is the number of the failed attempt,
+// starting at 1.
+func (bus *EventBus) OnRetry(fn func(Event, any, error, int)) {
+	bus.hookMu.Lock()
+	bus.onRetry = append(bus.onRetry, fn)
+	bus.hookMu.Unlock()
+}
+
+// OnGiveUp registers a hook that fires when a handler returns an error that
+// will not be retried. The int is the total number of attempts made.
+func (bus *EventBus) OnGiveUp(fn func(Event, any, error, int)) {
+	bus.hookMu.Lock()
+	bus.onGiveUp = append(bus.onGiveUp, fn)
+	bus.hookMu.Unlock()
+}
+
+// addEnqueueHook registers fn to run with every envelope accepted by the
+// queue and returns a func that removes it again.
+func (bus *EventBus) addEnqueueHook(fn func(EventEnvelope)) (remove func()) {
+	return eventBusAddHook(bus, &bus.onEnqueue, fn)
+}
+
+// eventBusAddHook appends fn to hooks, one of the hook lists of bus, and returns
+// a func that removes it again.
+func eventBusAddHook[F any](bus *EventBus, hooks *[]eventBusHook[F], fn F) (remove func()) {
 	bus.hookMu.Lock()
-	bus.onPanic = append(bus.onPanic, fn)
+	bus.nextHookID++
+	id := bus.nextHookID
+	*hooks = append(*hooks, eventBusHook[F]{id: id, fn: fn})
 	bus.hookMu.Unlock()
+
+	return func() {
+		bus.hookMu.Lock()
+		defer bus.hookMu.Unlock()
+		for i, h := range *hooks {
+			if h.id == id {
+				*hooks = append((*hooks)[:i:i], (*hooks)[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (bus *EventBus) runOnEnqueue(env EventEnvelope) {
+	bus.hookMu.RLock()
+	hooks := make([]eventBusHook[func(EventEnvelope)], len(bus.onEnqueue))
+	copy(hooks, bus.onEnqueue)
+	bus.hookMu.RUnlock()
+	for _, h := range hooks {
+		h.fn(env)
+	}
 }
 
 func (bus *EventBus) runOnPublish(event Event, payload any) {
 	bus.hookMu.RLock()
-	hooks := make([]func(Event, any), len(bus.onPublish))
+	hooks := make([]eventBusHook[func(Event, any)], len(bus.onPublish))
 	copy(hooks, bus.onPublish)
 	bus.hookMu.RUnlock()
-	for _, fn := range hooks {
-		fn(event, payload)
+	for _, h := range hooks {
+		h.fn(event, payload)
 	}
 }
 
 func (bus *EventBus) runOnDrop(event Event, payload any) {
 	bus.hookMu.RLock()
-	hooks := make([]func(Event, any), len(bus.onDrop))
+	hooks := make([]eventBusHook[func(Event, any)], len(bus.onDrop))
 	copy(hooks, bus.onDrop)
 	bus.hookMu.RUnlock()
-	for _, fn := range hooks {
-		fn(event, payload)
+	for _, h := range hooks {
+		h.fn(event, payload)
 	}
 }
 
@@ -213,16 +2961,46 @@ func (bus *EventBus) runOnSubscribe(event Event) {
 
 func (bus *EventBus) runOnPanic(event Event, payload any, recovered any) {
 	bus.hookMu.RLock()
-	hooks := make([]func(Event, any, any), len(bus.onPanic))
+	hooks := make([]eventBusHook[func(Event, any, any)], len(bus.onPanic))
 	copy(hooks, bus.onPanic)
 	bus.hookMu.RUnlock()
-	for _, fn := range hooks {
+	for _, h := range hooks {
 		func() {
 			defer func() { recover() }()
-			fn(event, payload, recovered)
+			h.fn(event, payload, recovered)
 		}()
 	}
 }
 
+func (bus *EventBus) runOnRetry(event Event, payload any, err error, attempt int) {
+	bus.hookMu.RLock()
+	hooks := make([]func(Event, any, error, int), len(bus.onRetry))
+	copy(hooks, bus.onRetry)
+	bus.hookMu.RUnlock()
+	for _, fn := range hooks {
+		fn(event, payload, err, attempt)
+	}
+}
+
+func (bus *EventBus) runOnGiveUp(event Event, payload any, err error, attempts int) {
+	bus.hookMu.RLock()
+	hooks := make([]func(Event, any, error, int), len(bus.onGiveUp))
+	copy(hooks, bus.onGiveUp)
+	bus.hookMu.RUnlock()
+	for _, fn := range hooks {
+		fn(event, payload, err, attempts)
+	}
+}
+
+func (bus *EventBus) runOnStop() {
+	bus.hookMu.RLock()
+	hooks := make([]func(), len(bus.onStop))
+	copy(hooks, bus.onStop)
+	bus.hookMu.RUnlock()
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
 // Reference the source variable to suppress unused-variable lint.
 var _ = Events
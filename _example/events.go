@@ -11,7 +11,7 @@ type MutationEvent struct {
 // UserRegistrationEvent is published when a new user registers.
 type UserRegistrationEvent struct {
 	UserID string
-	Email  string
+	Email  string `gobusgen:"redact"`
 }
 
 // ShoppingListCleanup is published when a shopping list cleanup is requested.
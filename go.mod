@@ -5,10 +5,13 @@ go 1.26
 require (
 	github.com/rs/zerolog v1.33.0
 	github.com/urfave/cli/v3 v3.6.2
+	golang.org/x/tools v0.47.0
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/mod v0.37.0 // indirect
+	golang.org/x/sync v0.21.0 // indirect
+	golang.org/x/sys v0.46.0 // indirect
 )
@@ -16,8 +16,12 @@ import (
 
 // GenerateCmd implements the generate command
 type GenerateCmd struct {
-	flags  *Flags
-	output string
+	flags     *Flags
+	output    string
+	fake      bool
+	outbox    bool
+	transport bool
+	http      bool
 }
 
 // NewGenerateCmd creates a new generate command
@@ -30,7 +34,7 @@ func (cmd *GenerateCmd) Register(app *cli.Command) *cli.Command {
 	app.Commands = append(app.Commands, &cli.Command{
 		Name:                      "generate",
 		Usage:                     "generate type-safe event bus from map variable declaration",
-		UsageText:                 "gobusgen generate [-p <dir>.<Var>] [-o <file>]",
+		UsageText:                 "gobusgen generate [-p <dir>.<Var>] [-o <file>] [--fake] [--outbox] [--transport] [--http]",
 		DisableSliceFlagSeparator: true,
 		Description: `Reads a Go package for a map[string]any variable and generates typed
 publish/subscribe wrappers for each entry. Map keys are event names and
@@ -56,7 +60,21 @@ Use the //gobusgen:prefix directive to override the prefix:
 
 An empty directive (//gobusgen:prefix) produces no prefix. The directive
 may appear above the var keyword or above the variable name inside a
-grouped var() block.`,
+grouped var() block.
+
+The --fake flag also generates Fake<Prefix>Bus (FakeEventBus for an empty
+prefix), a Publisher that records published events for assertions in tests.
+
+The --outbox flag also generates the transactional outbox: Tx.CommitOutbox,
+RelayOutbox and in-memory and database/sql stores. It is opt-in so that
+buses which don't use it don't import database/sql.
+
+The --transport flag also generates SendTo and ReceiveFrom for moving events
+between processes, together with a Unix domain socket transport.
+
+The --http flag also generates IngressHandler, which publishes events posted
+as JSON over HTTP, SSEHandler, which streams events as Server-Sent Events,
+and DebugHandler, which serves the statistics read by gobusgen monitor.`,
 		Flags: []cli.Flag{
 			&cli.StringSliceFlag{
 				Name:    "package",
@@ -69,6 +87,26 @@ grouped var() block.`,
 				Usage:       "output file path (only valid with a single --package target)",
 				Destination: &cmd.output,
 			},
+			&cli.BoolFlag{
+				Name:        "fake",
+				Usage:       "also generate a recording fake bus for tests",
+				Destination: &cmd.fake,
+			},
+			&cli.BoolFlag{
+				Name:        "outbox",
+				Usage:       "also generate the transactional outbox and its database/sql store",
+				Destination: &cmd.outbox,
+			},
+			&cli.BoolFlag{
+				Name:        "transport",
+				Usage:       "also generate SendTo, ReceiveFrom and the Unix socket transport",
+				Destination: &cmd.transport,
+			},
+			&cli.BoolFlag{
+				Name:        "http",
+				Usage:       "also generate the net/http handlers",
+				Destination: &cmd.http,
+			},
 		},
 		Action: cmd.run,
 	})
@@ -133,6 +171,10 @@ func (cmd *GenerateCmd) run(ctx context.Context, c *cli.Command) error {
 		if err != nil {
 			return fmt.Errorf("parsing events in %s: %w", t, err)
 		}
+		input.Fake = cmd.fake
+		input.Outbox = cmd.outbox
+		input.Transport = cmd.transport
+		input.HTTP = cmd.http
 
 		output := cmd.output
 		if output == "" {
@@ -0,0 +1,295 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+)
+
+// MonitorCmd implements the monitor command
+type MonitorCmd struct {
+	flags    *Flags
+	socket   string
+	interval time.Duration
+	json     bool
+	count    int
+}
+
+// NewMonitorCmd creates a new monitor command
+func NewMonitorCmd(flags *Flags) *MonitorCmd {
+	return &MonitorCmd{flags: flags}
+}
+
+// Register adds the monitor command to the application
+func (cmd *MonitorCmd) Register(app *cli.Command) *cli.Command {
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:      "monitor",
+		Usage:     "show live statistics of a running event bus",
+		UsageText: "gobusgen monitor [--socket <path>] [--interval <duration>] [--count <n>] [--json] <url|path>",
+		Description: `Polls the DebugHandler of a running application and shows per-event
+publish rates, totals, drops and panics together with the queue depth,
+refreshing the terminal on every sample. DebugHandler is generated with
+gobusgen generate --http.
+
+  mux.Handle("/debug/bus", bus.DebugHandler())
+
+  gobusgen monitor http://localhost:6060/debug/bus
+
+When the handler is served on a Unix domain socket, pass the socket with
+--socket and the handler path as the argument (default /debug/bus):
+
+  gobusgen monitor --socket /run/app/debug.sock /debug/bus
+
+The --json flag prints one JSON object per sample instead, with the rate of
+each event in events per second, for use in scripts. --count stops after
+that many samples.`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "socket",
+				Aliases:     []string{"s"},
+				Usage:       "connect to the debug handler over this Unix domain socket",
+				Destination: &cmd.socket,
+			},
+			&cli.DurationFlag{
+				Name:        "interval",
+				Aliases:     []string{"i"},
+				Usage:       "time between samples",
+				Value:       time.Second,
+				Destination: &cmd.interval,
+			},
+			&cli.IntFlag{
+				Name:        "count",
+				Aliases:     []string{"n"},
+				Usage:       "stop after this many samples (0 runs until interrupted)",
+				Destination: &cmd.count,
+			},
+			&cli.BoolFlag{
+				Name:        "json",
+				Usage:       "print one JSON object per sample instead of a table",
+				Destination: &cmd.json,
+			},
+		},
+		Action: cmd.run,
+	})
+
+	return app
+}
+
+// busSnapshot mirrors the JSON served by a generated DebugHandler.
+type busSnapshot struct {
+	Time          time.Time    `json:"time"`
+	QueueDepth    int          `json:"queue_depth"`
+	QueueCapacity int          `json:"queue_capacity"`
+	Events        []eventStats `json:"events"`
+	Drops         []busEntry   `json:"drops"`
+	Panics        []busEntry   `json:"panics"`
+}
+
+type eventStats struct {
+	Name        string   `json:"name"`
+	Subscribers []string `json:"subscribers"`
+	Published   int      `json:"published"`
+	Dropped     int      `json:"dropped"`
+	Panics      int      `json:"panics"`
+	Rate        float64  `json:"rate"`
+}
+
+type busEntry struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Panic string    `json:"panic,omitempty"`
+}
+
+// newDebugClient returns an HTTP client and URL for target. With a socket,
+// target is the handler path on the server listening on that socket.
+func newDebugClient(target, socket string) (*http.Client, string, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	if socket != "" {
+		if target == "" {
+			target = "/debug/bus"
+		}
+		if !strings.HasPrefix(target, "/") {
+			return nil, "", fmt.Errorf("with --socket the argument must be a path, got %q", target)
+		}
+
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		target = "http://unix" + target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid debug endpoint %q: want a URL such as http://localhost:6060/debug/bus", target)
+	}
+
+	q := u.Query()
+	q.Set("format", "json")
+	u.RawQuery = q.Encode()
+
+	return client, u.String(), nil
+}
+
+// fetchSnapshot reads one snapshot from the debug handler at endpoint.
+func fetchSnapshot(ctx context.Context, client *http.Client, endpoint string) (busSnapshot, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return busSnapshot{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return busSnapshot{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return busSnapshot{}, fmt.Errorf("debug endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var snap busSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return busSnapshot{}, fmt.Errorf("decoding debug snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// computeRates sets the publish rate of every event in cur from the counters
+// in prev. Rates stay zero for the first sample and after a restart of the
+// application, which resets its counters.
+func computeRates(prev, cur *busSnapshot) {
+	if prev == nil {
+		return
+	}
+
+	elapsed := cur.Time.Sub(prev.Time).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	published := make(map[string]int, len(prev.Events))
+	for _, e := range prev.Events {
+		published[e.Name] = e.Published
+	}
+
+	for i, e := range cur.Events {
+		if n, ok := published[e.Name]; ok && e.Published >= n {
+			cur.Events[i].Rate = float64(e.Published-n) / elapsed
+		}
+	}
+}
+
+// renderSnapshot writes a terminal view of snap to w.
+func renderSnapshot(w io.Writer, endpoint string, snap busSnapshot) {
+	fmt.Fprintf(w, "%s  %s\n", endpoint, snap.Time.Format(time.TimeOnly))
+	fmt.Fprintf(w, "queue %d / %d\n\n", snap.QueueDepth, snap.QueueCapacity)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "EVENT\tRATE/S\tPUBLISHED\tDROPPED\tPANICS\tSUBSCRIBERS")
+	for _, e := range snap.Events {
+		fmt.Fprintf(tw, "%s\t%.1f\t%d\t%d\t%d\t%d\n", e.Name, e.Rate, e.Published, e.Dropped, e.Panics, len(e.Subscribers))
+	}
+	_ = tw.Flush()
+
+	recent := func(title string, entries []busEntry) {
+		if len(entries) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s\n", title)
+		for i := len(entries) - 1; i >= 0 && i >= len(entries)-5; i-- {
+			e := entries[i]
+			line := fmt.Sprintf("  %s  %s", e.Time.Format(time.TimeOnly), e.Event)
+			if e.Panic != "" {
+				line += "  " + e.Panic
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+	recent("recent drops", snap.Drops)
+	recent("recent panics", snap.Panics)
+}
+
+func (cmd *MonitorCmd) run(ctx context.Context, c *cli.Command) error {
+	if c.Args().Len() > 1 {
+		return fmt.Errorf("monitor takes a single debug endpoint, got %d arguments", c.Args().Len())
+	}
+
+	target := c.Args().First()
+	if target == "" && cmd.socket == "" {
+		return fmt.Errorf("missing debug endpoint: pass a URL or --socket")
+	}
+
+	if cmd.interval <= 0 {
+		return fmt.Errorf("--interval must be positive, got %s", cmd.interval)
+	}
+
+	client, endpoint, err := newDebugClient(target, cmd.socket)
+	if err != nil {
+		return err
+	}
+	display := target
+	if cmd.socket != "" {
+		display = "unix:" + cmd.socket
+	}
+
+	log.Debug().Str("endpoint", endpoint).Dur("interval", cmd.interval).Msg("monitoring event bus")
+
+	enc := json.NewEncoder(os.Stdout)
+	ticker := time.NewTicker(cmd.interval)
+	defer ticker.Stop()
+
+	var prev *busSnapshot
+	for n := 0; cmd.count == 0 || n < cmd.count; n++ {
+		if n > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+
+		snap, err := fetchSnapshot(ctx, client, endpoint)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil && prev == nil:
+			return fmt.Errorf("reading %s: %w", display, err)
+		case err != nil:
+			log.Warn().Err(err).Str("endpoint", display).Msg("sample failed")
+			continue
+		}
+
+		computeRates(prev, &snap)
+		prev = &snap
+
+		if cmd.json {
+			if err := enc.Encode(snap); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Move the cursor home and clear the screen before redrawing.
+		fmt.Fprint(os.Stdout, "\033[H\033[2J")
+		renderSnapshot(os.Stdout, display, snap)
+	}
+
+	return nil
+}
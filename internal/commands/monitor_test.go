@@ -0,0 +1,167 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDebugClient(t *testing.T) {
+	tests := []struct {
+		target  string
+		socket  string
+		want    string
+		wantErr bool
+	}{
+		{
+			target: "http://localhost:6060/debug/bus",
+			want:   "http://localhost:6060/debug/bus?format=json",
+		},
+		{
+			target: "http://localhost:6060/debug/bus?format=html",
+			want:   "http://localhost:6060/debug/bus?format=json",
+		},
+		{
+			socket: "/run/app/debug.sock",
+			want:   "http://unix/debug/bus?format=json",
+		},
+		{
+			target: "/bus",
+			socket: "/run/app/debug.sock",
+			want:   "http://unix/bus?format=json",
+		},
+		{
+			target:  "localhost:6060",
+			socket:  "/run/app/debug.sock",
+			wantErr: true,
+		},
+		{
+			target:  "localhost:6060/debug/bus",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target+tt.socket, func(t *testing.T) {
+			_, got, err := newDebugClient(tt.target, tt.socket)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("newDebugClient(%q, %q) = %q, want error", tt.target, tt.socket, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("newDebugClient(%q, %q) = %q, want %q", tt.target, tt.socket, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchSnapshotOverUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "debug.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/bus", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "json" {
+			http.Error(w, "want format=json", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"queue_depth":    2,
+			"queue_capacity": 8,
+			"events":         []map[string]any{{"name": "user.created", "published": 3}},
+		})
+	})
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Close() }()
+
+	client, endpoint, err := newDebugClient("", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := fetchSnapshot(context.Background(), client, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.QueueDepth != 2 || snap.QueueCapacity != 8 || len(snap.Events) != 1 || snap.Events[0].Published != 3 {
+		t.Errorf("snapshot = %+v", snap)
+	}
+
+	_, missing, _ := newDebugClient("/missing", socket)
+	if _, err := fetchSnapshot(context.Background(), client, missing); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("fetching a missing path: err = %v, want a 404 error", err)
+	}
+}
+
+func TestComputeRates(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	prev := &busSnapshot{Time: start, Events: []eventStats{
+		{Name: "a", Published: 10},
+		{Name: "b", Published: 50},
+	}}
+	cur := &busSnapshot{Time: start.Add(2 * time.Second), Events: []eventStats{
+		{Name: "a", Published: 30},
+		{Name: "b", Published: 5}, // counters reset by a restart
+		{Name: "c", Published: 7}, // not in the previous sample
+	}}
+
+	computeRates(nil, prev)
+	computeRates(prev, cur)
+
+	for i, want := range []float64{10, 0, 0} {
+		if got := cur.Events[i].Rate; got != want {
+			t.Errorf("%s rate = %v, want %v", cur.Events[i].Name, got, want)
+		}
+	}
+	for _, e := range prev.Events {
+		if e.Rate != 0 {
+			t.Errorf("first sample %s rate = %v, want 0", e.Name, e.Rate)
+		}
+	}
+}
+
+func TestRenderSnapshot(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	snap := busSnapshot{
+		Time:          at,
+		QueueDepth:    3,
+		QueueCapacity: 1024,
+		Events: []eventStats{
+			{Name: "user.created", Subscribers: []string{"a", "b"}, Published: 42, Dropped: 1, Panics: 2, Rate: 2.5},
+		},
+		Panics: []busEntry{{Time: at, Event: "user.created", Panic: "nil map"}},
+	}
+
+	var buf bytes.Buffer
+	renderSnapshot(&buf, "http://localhost:6060/debug/bus", snap)
+	out := buf.String()
+
+	for _, want := range []string{
+		"http://localhost:6060/debug/bus  12:00:00",
+		"queue 3 / 1024",
+		"EVENT         RATE/S  PUBLISHED  DROPPED  PANICS  SUBSCRIBERS",
+		"user.created  2.5     42         1        2       2",
+		"recent panics\n  12:00:00  user.created  nil map",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "recent drops") {
+		t.Errorf("output lists drops without any:\n%s", out)
+	}
+}
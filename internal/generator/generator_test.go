@@ -62,6 +62,87 @@ func TestGenerate(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "fake_bus",
+			input: model.GenerateInput{
+				PackageName: "commands",
+				VarName:     "Commands",
+				Prefix:      "Command",
+				Fake:        true,
+				Events: []model.EventDef{
+					{Name: "order.create", PayloadType: "CreateOrderCmd"},
+					{Name: "order.cancel", PayloadType: "CancelOrderCmd"},
+				},
+			},
+		},
+		{
+			name: "outbox_bus",
+			input: model.GenerateInput{
+				PackageName: "events",
+				VarName:     "Events",
+				Outbox:      true,
+				Events: []model.EventDef{
+					{Name: "order.placed", PayloadType: "OrderPlacedEvent"},
+				},
+			},
+		},
+		{
+			name: "transport_bus",
+			input: model.GenerateInput{
+				PackageName: "events",
+				VarName:     "Events",
+				Transport:   true,
+				Events: []model.EventDef{
+					{Name: "order.placed", PayloadType: "OrderPlacedEvent"},
+				},
+			},
+		},
+		{
+			name: "http_bus",
+			input: model.GenerateInput{
+				PackageName: "events",
+				VarName:     "Events",
+				HTTP:        true,
+				Events: []model.EventDef{
+					{Name: "order.placed", PayloadType: "OrderPlacedEvent"},
+				},
+			},
+		},
+		{
+			name: "redacted_fields",
+			input: model.GenerateInput{
+				PackageName: "events",
+				VarName:     "Events",
+				Events: []model.EventDef{
+					{Name: "user.invited", PayloadType: "SignupEvent"},
+					{Name: "user.signup", PayloadType: "SignupEvent"},
+				},
+				Redact: []model.RedactType{
+					{Name: "SignupEvent", Value: &model.RedactValue{
+						Kind: model.RedactStruct,
+						Fields: []model.RedactField{
+							{Name: "Email"},
+							{Name: "Phone"},
+							{Name: "Referrer", Value: &model.RedactValue{
+								Kind: model.RedactPointer,
+								Elem: &model.RedactValue{Kind: model.RedactStruct, Fields: []model.RedactField{{Name: "Email"}}},
+							}},
+							{Name: "Contacts", Value: &model.RedactValue{
+								Kind: model.RedactSlice,
+								Elem: &model.RedactValue{Kind: model.RedactStruct, Fields: []model.RedactField{{Name: "Phone"}}},
+							}},
+							{Name: "Devices", Value: &model.RedactValue{
+								Kind: model.RedactMap,
+								Elem: &model.RedactValue{
+									Kind: model.RedactArray,
+									Elem: &model.RedactValue{Kind: model.RedactStruct, Fields: []model.RedactField{{Name: "Token"}}},
+								},
+							}},
+						},
+					}},
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -1,12 +1,14 @@
 package generator_test
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"testing"
 
 	"github.com/hay-kot/gobusgen/internal/generator"
+	"github.com/hay-kot/gobusgen/internal/model"
 	"github.com/hay-kot/gobusgen/internal/parser"
 )
 
@@ -456,3 +458,3679 @@ var Events = map[string]any{
 		t.Fatalf("generated code does not compile:\n%s\n%v", out, err)
 	}
 }
+
+// orderEventsSource is a minimal event package shared by the runtime tests.
+const orderEventsSource = `package demo
+
+type OrderCreated struct {
+	OrderID string
+}
+
+type OrderShipped struct {
+	OrderID    string
+	TrackingNo string
+}
+
+var Events = map[string]any{
+	"order.created": OrderCreated{},
+	"order.shipped": OrderShipped{},
+}
+`
+
+// runGeneratedTests writes source into a temp package, generates the event
+// bus for its Events variable, and runs testFile against the result. Any
+// helpers are written as additional test files.
+func runGeneratedTests(t *testing.T, source, testFile string, helpers ...string) {
+	t.Helper()
+	runGeneratedTestsWith(t, source, func(*model.GenerateInput) {}, testFile, helpers...)
+}
+
+// runGeneratedTestsWith is runGeneratedTests with a hook to adjust the parsed
+// input, e.g. to enable optional output, before generating.
+func runGeneratedTestsWith(t *testing.T, source string, configure func(*model.GenerateInput), testFile string, helpers ...string) {
+	t.Helper()
+	runGenerated(t, source, configure, nil, testFile, helpers...)
+}
+
+// runGeneratedRaceTests is runGeneratedTests with the race detector enabled,
+// for behavior that is only wrong when goroutines share state.
+func runGeneratedRaceTests(t *testing.T, source, testFile string, helpers ...string) {
+	t.Helper()
+	runGenerated(t, source, func(*model.GenerateInput) {}, []string{"-race"}, testFile, helpers...)
+}
+
+func runGenerated(t *testing.T, source string, configure func(*model.GenerateInput), testArgs []string, testFile string, helpers ...string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "events.go"), []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Parse type-checks sources with gobusgen tags, which needs a module.
+	goMod := "module demo\n\ngo 1.23\n"
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := parser.Parse(dir, "Events")
+	if err != nil {
+		t.Fatalf("parser.Parse: %v", err)
+	}
+	configure(&input)
+
+	src, err := generator.Generate(input)
+	if err != nil {
+		t.Fatalf("generator.Generate: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "eventbus.gen.go"), src, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "eventbus_test.go"), []byte(testFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, helper := range helpers {
+		name := fmt.Sprintf("helper%d_test.go", i)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(helper), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := append([]string{"test", "-v", "-count=1"}, testArgs...)
+	cmd := exec.Command("go", append(args, "./...")...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("runtime tests failed:\n%s\n%v", out, err)
+	}
+	t.Logf("runtime test output:\n%s", out)
+}
+
+// TestIntegration_SharedPackage verifies that two buses generated into the
+// same package do not produce conflicting declarations.
+func TestIntegration_SharedPackage(t *testing.T) {
+	dir := t.TempDir()
+
+	source := `package demo
+
+type UserCreated struct {
+	UserID string
+	Email  string ` + "`" + `gobusgen:"redact"` + "`" + `
+}
+
+type PlaceOrder struct {
+	OrderID string
+}
+
+var Events = map[string]any{
+	"user.created": UserCreated{},
+}
+
+// Both buses carry UserCreated, so both redact it.
+var Commands = map[string]any{
+	"order.place":  PlaceOrder{},
+	"user.created": UserCreated{},
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "events.go"), []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Parse type-checks sources with gobusgen tags, which needs a module.
+	goMod := "module demo\n\ngo 1.22\n"
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []struct{ varName, file string }{
+		{"Events", "eventbus.gen.go"},
+		{"Commands", "commandsbus.gen.go"},
+	} {
+		input, err := parser.Parse(dir, target.varName)
+		if err != nil {
+			t.Fatalf("parser.Parse %s: %v", target.varName, err)
+		}
+		// Enable every optional feature so its declarations are checked too.
+		input.Fake = true
+		input.Outbox = true
+		input.Transport = true
+		input.HTTP = true
+
+		src, err := generator.Generate(input)
+		if err != nil {
+			t.Fatalf("generator.Generate %s: %v", target.varName, err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, target.file), src, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "vet", "./...")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("generated code does not compile:\n%s\n%v", out, err)
+	}
+}
+
+func TestIntegration_SubscribeOnceAndWhere(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscribeOnce(t *testing.T) {
+	bus := New(10)
+
+	received := make(chan string, 10)
+	bus.SubscribeOrderCreatedOnce(func(e OrderCreated) {
+		received <- e.OrderID
+	})
+
+	// A second subscriber acts as a barrier so we know both events were dispatched.
+	done := make(chan struct{}, 10)
+	bus.SubscribeOrderCreated(func(OrderCreated) { done <- struct{}{} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	bus.PublishOrderCreated(OrderCreated{OrderID: "2"})
+
+	for range 2 {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("events not dispatched")
+		}
+	}
+
+	if got := len(received); got != 1 {
+		t.Fatalf("once handler called %d times, want 1", got)
+	}
+	if id := <-received; id != "1" {
+		t.Errorf("once handler received %q, want %q", id, "1")
+	}
+
+	bus.mu.RLock()
+	n := len(bus.subscribers[EventOrderCreated])
+	bus.mu.RUnlock()
+	if n != 1 {
+		t.Errorf("subscriber count = %d, want 1 after once handler fired", n)
+	}
+}
+
+func TestSubscribeWhere(t *testing.T) {
+	bus := New(10)
+
+	received := make(chan string, 10)
+	bus.SubscribeOrderShippedWhere(func(e OrderShipped) bool {
+		return e.OrderID == "match"
+	}, func(e OrderShipped) {
+		received <- e.TrackingNo
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	bus.PublishOrderShipped(OrderShipped{OrderID: "other", TrackingNo: "T1"})
+	bus.PublishOrderShipped(OrderShipped{OrderID: "match", TrackingNo: "T2"})
+
+	select {
+	case got := <-received:
+		if got != "T2" {
+			t.Errorf("received %q, want %q", got, "T2")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("filtered handler not called")
+	}
+}
+
+func TestSubscribeWherePanicInFilter(t *testing.T) {
+	bus := New(10)
+
+	panics := make(chan any, 1)
+	bus.OnPanic(func(e Event, p any, r any) { panics <- r })
+	bus.SubscribeOrderCreatedWhere(func(OrderCreated) bool {
+		panic("filter boom")
+	}, func(OrderCreated) {
+		t.Error("handler called despite filter panic")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+
+	select {
+	case r := <-panics:
+		if r != "filter boom" {
+			t.Errorf("panic value = %v, want %q", r, "filter boom")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnPanic hook not called for filter panic")
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_ChanAndSeq(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChan(t *testing.T) {
+	bus := New(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	ch := bus.OrderCreatedChan(subCtx, 4)
+
+	go bus.Start(ctx)
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	bus.PublishOrderCreated(OrderCreated{OrderID: "2"})
+
+	for _, want := range []string{"1", "2"} {
+		select {
+		case got := <-ch:
+			if got.OrderID != want {
+				t.Errorf("received %q, want %q", got.OrderID, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event not received on channel")
+		}
+	}
+
+	subCancel()
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("received event after ctx was cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after ctx was cancelled")
+	}
+}
+
+func TestChanOverflowReportsDrop(t *testing.T) {
+	bus := New(10)
+
+	var dropped atomic.Int32
+	bus.OnDrop(func(e Event, p any) { dropped.Add(1) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := bus.OrderCreatedChan(ctx, 1)
+
+	done := make(chan struct{}, 3)
+	bus.SubscribeOrderCreated(func(OrderCreated) { done <- struct{}{} })
+
+	go bus.Start(ctx)
+
+	for _, id := range []string{"1", "2", "3"} {
+		bus.PublishOrderCreated(OrderCreated{OrderID: id})
+	}
+	for range 3 {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("events not dispatched")
+		}
+	}
+
+	if got := dropped.Load(); got != 2 {
+		t.Errorf("OnDrop called %d times, want 2", got)
+	}
+	if got := (<-ch).OrderID; got != "1" {
+		t.Errorf("buffered event = %q, want %q", got, "1")
+	}
+}
+
+func TestSeq(t *testing.T) {
+	bus := New(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	subscribed := make(chan struct{})
+	bus.OnSubscribe(func(Event) { close(subscribed) })
+
+	go func() {
+		<-subscribed
+		bus.PublishOrderShipped(OrderShipped{OrderID: "1"})
+		bus.PublishOrderShipped(OrderShipped{OrderID: "2"})
+		bus.PublishOrderShipped(OrderShipped{OrderID: "3"})
+	}()
+
+	var got []string
+	for e := range bus.OrderShippedSeq(ctx) {
+		got = append(got, e.OrderID)
+		if len(got) == 2 {
+			break
+		}
+	}
+
+	if len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Errorf("iterated %v, want [1 2]", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		bus.mu.RLock()
+		n := len(bus.subscribers[EventOrderShipped])
+		bus.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("iterator subscription not removed after break")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_SubscribeBatch(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func ids(batch []OrderCreated) []string {
+	out := make([]string, len(batch))
+	for i, e := range batch {
+		out[i] = e.OrderID
+	}
+	return out
+}
+
+func TestBatchFlushesWhenFull(t *testing.T) {
+	bus := New(10)
+
+	batches := make(chan []string, 10)
+	bus.SubscribeOrderCreatedBatch(2, time.Hour, func(batch []OrderCreated) {
+		batches <- ids(batch)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		bus.PublishOrderCreated(OrderCreated{OrderID: id})
+	}
+
+	for _, want := range [][]string{{"1", "2"}, {"3", "4"}} {
+		select {
+		case got := <-batches:
+			if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+				t.Errorf("batch = %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("full batch not flushed")
+		}
+	}
+}
+
+func TestBatchFlushesAfterWindow(t *testing.T) {
+	bus := New(10)
+
+	batches := make(chan []string, 10)
+	bus.SubscribeOrderCreatedBatch(100, 20*time.Millisecond, func(batch []OrderCreated) {
+		batches <- ids(batch)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	bus.PublishOrderCreated(OrderCreated{OrderID: "2"})
+
+	select {
+	case got := <-batches:
+		if len(got) != 2 {
+			t.Errorf("batch = %v, want 2 events", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch not flushed after window")
+	}
+}
+
+func TestBatchFlushesOnShutdown(t *testing.T) {
+	bus := New(10)
+
+	batches := make(chan []string, 10)
+	bus.SubscribeOrderCreatedBatch(100, 0, func(batch []OrderCreated) {
+		batches <- ids(batch)
+	})
+
+	dispatched := make(chan struct{}, 1)
+	bus.SubscribeOrderCreated(func(OrderCreated) { dispatched <- struct{}{} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		bus.Start(ctx)
+		close(stopped)
+	}()
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	<-dispatched
+
+	select {
+	case got := <-batches:
+		t.Fatalf("batch %v flushed before shutdown", got)
+	default:
+	}
+
+	cancel()
+	<-stopped
+
+	select {
+	case got := <-batches:
+		if len(got) != 1 || got[0] != "1" {
+			t.Errorf("batch = %v, want [1]", got)
+		}
+	default:
+		t.Fatal("pending batch not flushed on shutdown")
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+// fakeClockSource is a manual EventBusClock implementation for runtime tests of the
+// timer based bus features.
+const fakeClockSource = `package demo
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	fn      func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, fn func()) EventBusTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), fn: fn}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := !t.stopped
+	t.stopped = true
+	return was
+}
+
+// Advance moves the clock forward by d and runs due timers in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	rest := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.at.After(c.now):
+			t.stopped = true
+			due = append(due, t)
+		default:
+			rest = append(rest, t)
+		}
+	}
+	c.timers = rest
+	c.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.fn()
+	}
+}
+`
+
+func TestIntegration_RateLimiting(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (r *recorder) add(id string) {
+	r.mu.Lock()
+	r.ids = append(r.ids, id)
+	r.mu.Unlock()
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.ids...)
+}
+
+// publishAll publishes the ids and waits until the Start loop has dispatched them.
+func publishAll(t *testing.T, bus *EventBus, ids ...string) {
+	t.Helper()
+	done := make(chan struct{}, len(ids))
+	for _, id := range ids {
+		bus.SubscribeOrderShippedOnce(func(OrderShipped) { done <- struct{}{} })
+		bus.PublishOrderCreated(OrderCreated{OrderID: id})
+		bus.PublishOrderShipped(OrderShipped{})
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("events not dispatched")
+		}
+	}
+}
+
+func startBus(t *testing.T, bus *EventBus) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go bus.Start(ctx)
+}
+
+func TestDebounce(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+	startBus(t, bus)
+
+	var got recorder
+	bus.SubscribeOrderCreated(func(e OrderCreated) { got.add(e.OrderID) }, EventBusWithDebounce(time.Second))
+
+	publishAll(t, bus, "1", "2")
+	clock.Advance(500 * time.Millisecond)
+	publishAll(t, bus, "3")
+	clock.Advance(500 * time.Millisecond)
+
+	if ids := got.get(); len(ids) != 0 {
+		t.Fatalf("debounced handler called early with %v", ids)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+
+	if ids := got.get(); len(ids) != 1 || ids[0] != "3" {
+		t.Errorf("debounced deliveries = %v, want [3]", ids)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+	startBus(t, bus)
+
+	var got recorder
+	bus.SubscribeOrderCreated(func(e OrderCreated) { got.add(e.OrderID) }, EventBusWithThrottle(time.Second))
+
+	publishAll(t, bus, "1", "2")
+	clock.Advance(time.Second)
+	publishAll(t, bus, "3", "4")
+
+	if ids := got.get(); len(ids) != 2 || ids[0] != "1" || ids[1] != "3" {
+		t.Errorf("throttled deliveries = %v, want [1 3]", ids)
+	}
+}
+
+func TestCoalescePerEventConfig(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+	startBus(t, bus)
+
+	bus.Configure(EventOrderCreated, EventBusCoalesceOrderCreated(time.Second, func(e OrderCreated) string {
+		return e.OrderID[:1]
+	}))
+
+	var got recorder
+	bus.SubscribeOrderCreated(func(e OrderCreated) { got.add(e.OrderID) })
+
+	publishAll(t, bus, "a1", "b1", "a2", "a3")
+	clock.Advance(time.Second)
+
+	ids := got.get()
+	if len(ids) != 2 {
+		t.Fatalf("coalesced deliveries = %v, want 2", ids)
+	}
+	seen := map[string]bool{ids[0]: true, ids[1]: true}
+	if !seen["a3"] || !seen["b1"] {
+		t.Errorf("coalesced deliveries = %v, want a3 and b1", ids)
+	}
+}
+
+func TestCoalesceRejectsOtherEvent(t *testing.T) {
+	bus := New(10)
+	bus.Configure(EventOrderShipped, EventBusCoalesceOrderCreated(time.Second, func(e OrderCreated) string {
+		return e.OrderID
+	}))
+
+	defer func() {
+		if recover() == nil {
+			t.Error("subscribing with another event's coalesce option did not panic")
+		}
+	}()
+	bus.SubscribeOrderShipped(func(OrderShipped) {})
+}
+
+func TestConfigureSkipsInternalSubscriptions(t *testing.T) {
+	bus := New(10)
+	startBus(t, bus)
+
+	subscribed := make(chan struct{}, 3)
+	bus.OnSubscribe(func(Event) { subscribed <- struct{}{} })
+	bus.Configure(EventOrderCreated, EventBusWithDebounce(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ch := bus.OrderCreatedChan(ctx, 1)
+	batches := make(chan []OrderCreated, 1)
+	bus.SubscribeOrderCreatedBatch(1, 0, func(b []OrderCreated) { batches <- b })
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := bus.WaitForOrderCreated(ctx, nil)
+		waited <- err
+	}()
+	for range 3 {
+		<-subscribed
+	}
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+
+	if err := <-waited; err != nil {
+		t.Errorf("WaitForOrderCreated() error: %v", err)
+	}
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		t.Error("OrderCreatedChan did not receive the event")
+	}
+	select {
+	case <-batches:
+	case <-ctx.Done():
+		t.Error("batch handler did not receive the event")
+	}
+}
+
+func TestDebounceFlushesOnShutdown(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		bus.Start(ctx)
+		close(stopped)
+	}()
+
+	var got recorder
+	bus.SubscribeOrderCreated(func(e OrderCreated) { got.add(e.OrderID) }, EventBusWithDebounce(time.Hour))
+
+	publishAll(t, bus, "1")
+	cancel()
+	<-stopped
+
+	if ids := got.get(); len(ids) != 1 || ids[0] != "1" {
+		t.Errorf("deliveries after shutdown = %v, want [1]", ids)
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile, fakeClockSource)
+}
+
+func TestIntegration_ScheduledPublish(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPublishAfterAndAt(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+
+	var published []string
+	bus.OnPublish(func(e Event, p any) {
+		published = append(published, p.(OrderCreated).OrderID)
+	})
+
+	bus.PublishOrderCreatedAfter(2*time.Second, OrderCreated{OrderID: "later"})
+	bus.PublishOrderCreatedAt(clock.Now().Add(time.Second), OrderCreated{OrderID: "sooner"})
+
+	clock.Advance(500 * time.Millisecond)
+	if len(published) != 0 {
+		t.Fatalf("published %v before due", published)
+	}
+
+	clock.Advance(time.Second)
+	if len(published) != 1 || published[0] != "sooner" {
+		t.Fatalf("published %v, want [sooner]", published)
+	}
+
+	clock.Advance(time.Second)
+	if len(published) != 2 || published[1] != "later" {
+		t.Fatalf("published %v, want [sooner later]", published)
+	}
+}
+
+func TestScheduledCancel(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+
+	var published int
+	bus.OnPublish(func(Event, any) { published++ })
+
+	first := bus.PublishOrderCreatedAfter(time.Second, OrderCreated{OrderID: "1"})
+	bus.PublishOrderCreatedAfter(2*time.Second, OrderCreated{OrderID: "2"})
+
+	if !first.Cancel() {
+		t.Fatal("Cancel() = false, want true for pending event")
+	}
+	if first.Cancel() {
+		t.Error("second Cancel() = true, want false")
+	}
+
+	clock.Advance(3 * time.Second)
+	if published != 1 {
+		t.Errorf("published %d events, want 1", published)
+	}
+}
+
+func TestScheduledDiscardedOnShutdown(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+
+	var published int
+	bus.OnPublish(func(Event, any) { published++ })
+
+	pending := bus.PublishOrderCreatedAfter(time.Second, OrderCreated{OrderID: "1"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bus.Start(ctx)
+
+	if pending.Cancel() {
+		t.Error("Cancel() = true after shutdown, want false")
+	}
+
+	bus.PublishOrderCreatedAfter(time.Second, OrderCreated{OrderID: "2"})
+	clock.Advance(2 * time.Second)
+
+	if published != 0 {
+		t.Errorf("published %d events after shutdown, want 0", published)
+	}
+}
+
+func TestScheduledAfterRestart(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+
+	var published int
+	bus.OnPublish(func(Event, any) { published++ })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bus.Start(ctx)
+
+	// A stopped bus that is started again schedules events as before.
+	ctx, cancel = context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		bus.Start(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for published == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("event scheduled after restart was not published")
+		}
+		bus.PublishOrderCreatedAfter(time.Second, OrderCreated{OrderID: "1"})
+		clock.Advance(2 * time.Second)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScheduledDeliveredToSubscribers(t *testing.T) {
+	bus := New(10)
+
+	received := make(chan string, 1)
+	bus.SubscribeOrderShipped(func(e OrderShipped) { received <- e.OrderID })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	bus.PublishOrderShippedAfter(10*time.Millisecond, OrderShipped{OrderID: "1"})
+
+	select {
+	case id := <-received:
+		if id != "1" {
+			t.Errorf("received %q, want %q", id, "1")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("scheduled event not delivered")
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile, fakeClockSource)
+}
+
+func TestIntegration_RetryPolicies(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTransient = errors.New("transient")
+
+func startBus(t *testing.T, bus *EventBus) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go bus.Start(ctx)
+}
+
+func waitFor(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+	startBus(t, bus)
+
+	var (
+		mu       sync.Mutex
+		attempts int
+		retries  []int
+	)
+	called := make(chan struct{}, 10)
+	bus.OnRetry(func(e Event, p any, err error, attempt int) {
+		mu.Lock()
+		retries = append(retries, attempt)
+		mu.Unlock()
+	})
+	bus.OnGiveUp(func(Event, any, error, int) { t.Error("OnGiveUp called for a handler that succeeded") })
+
+	bus.SubscribeOrderCreatedErr(func(OrderCreated) error {
+		defer func() { called <- struct{}{} }()
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			return errTransient
+		}
+		return nil
+	}, EventBusWithRetry(EventBusRetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second}))
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	waitFor(t, called)
+
+	clock.Advance(time.Second)
+	waitFor(t, called)
+
+	// Second retry backs off exponentially.
+	clock.Advance(time.Second)
+	select {
+	case <-called:
+		t.Fatal("retry ran before backoff elapsed")
+	default:
+	}
+	clock.Advance(time.Second)
+	waitFor(t, called)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+	if len(retries) != 2 || retries[0] != 1 || retries[1] != 2 {
+		t.Errorf("OnRetry attempts = %v, want [1 2]", retries)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+	startBus(t, bus)
+
+	gaveUp := make(chan int, 1)
+	bus.OnGiveUp(func(e Event, p any, err error, attempts int) {
+		if !errors.Is(err, errTransient) {
+			t.Errorf("OnGiveUp err = %v, want %v", err, errTransient)
+		}
+		gaveUp <- attempts
+	})
+
+	called := make(chan struct{}, 10)
+	bus.Configure(EventOrderCreated, EventBusWithRetry(EventBusRetryPolicy{MaxAttempts: 2, InitialBackoff: time.Second}))
+	bus.SubscribeOrderCreatedErr(func(OrderCreated) error {
+		called <- struct{}{}
+		return errTransient
+	})
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	waitFor(t, called)
+	clock.Advance(time.Second)
+	waitFor(t, called)
+
+	select {
+	case n := <-gaveUp:
+		if n != 2 {
+			t.Errorf("OnGiveUp attempts = %d, want 2", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnGiveUp not called")
+	}
+}
+
+func TestRetryableFilter(t *testing.T) {
+	bus := New(10)
+	startBus(t, bus)
+
+	gaveUp := make(chan int, 1)
+	bus.OnGiveUp(func(e Event, p any, err error, attempts int) { gaveUp <- attempts })
+
+	permanent := errors.New("permanent")
+	bus.SubscribeOrderCreatedErr(func(OrderCreated) error {
+		return permanent
+	}, EventBusWithRetry(EventBusRetryPolicy{
+		MaxAttempts: 5,
+		Retryable:   func(err error) bool { return !errors.Is(err, permanent) },
+	}))
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+
+	select {
+	case n := <-gaveUp:
+		if n != 1 {
+			t.Errorf("OnGiveUp attempts = %d, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnGiveUp not called for non-retryable error")
+	}
+}
+
+func TestRetryDoesNotBlockLoop(t *testing.T) {
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+	startBus(t, bus)
+
+	bus.SubscribeOrderCreatedErr(func(OrderCreated) error {
+		return errTransient
+	}, EventBusWithRetry(EventBusRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}))
+
+	shipped := make(chan struct{}, 1)
+	bus.SubscribeOrderShipped(func(OrderShipped) { shipped <- struct{}{} })
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	bus.PublishOrderShipped(OrderShipped{OrderID: "1"})
+
+	waitFor(t, shipped)
+}
+
+func TestRetryGivenUpWhenBusStops(t *testing.T) {
+	clock := newFakeClock()
+	sink := NewMemoryDeadLetterSink(0)
+	bus := New(10, EventBusWithClock(clock), EventBusWithDeadLetterSink(sink))
+
+	gaveUp := make(chan int, 1)
+	bus.OnGiveUp(func(e Event, p any, err error, attempts int) { gaveUp <- attempts })
+
+	called := make(chan struct{}, 10)
+	bus.SubscribeOrderCreatedErr(func(OrderCreated) error {
+		called <- struct{}{}
+		return errTransient
+	}, EventBusWithRetry(EventBusRetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		bus.Start(ctx)
+		close(stopped)
+	}()
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	waitFor(t, called)
+	cancel()
+	<-stopped
+
+	select {
+	case n := <-gaveUp:
+		if n != 1 {
+			t.Errorf("OnGiveUp attempts = %d, want 1", n)
+		}
+	default:
+		t.Fatal("pending retry not given up when the bus stopped")
+	}
+	sink.mu.Lock()
+	letters := len(sink.letters)
+	sink.mu.Unlock()
+	if letters != 1 {
+		t.Errorf("dead letters = %d, want 1", letters)
+	}
+
+	clock.Advance(time.Hour)
+	select {
+	case <-called:
+		t.Error("handler retried after the bus stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile, fakeClockSource)
+}
+
+func TestIntegration_DeadLetters(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startBus(t *testing.T, bus *EventBus) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go bus.Start(ctx)
+}
+
+// waitForLetters polls the sink until it holds n dead letters.
+func waitForLetters(t *testing.T, sink *MemoryDeadLetterSink, n int) []DeadLetter {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		sink.mu.Lock()
+		letters := append([]DeadLetter(nil), sink.letters...)
+		sink.mu.Unlock()
+		if len(letters) >= n {
+			return letters
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d dead letters, want %d", len(letters), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPanicIsDeadLettered(t *testing.T) {
+	sink := NewMemoryDeadLetterSink(0)
+	bus := New(10, EventBusWithDeadLetterSink(sink))
+	startBus(t, bus)
+
+	bus.SubscribeOrderCreated(func(OrderCreated) { panic("boom") }, EventBusWithName("billing"))
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+
+	letters := waitForLetters(t, sink, 1)
+	dl := letters[0]
+	if dl.Event != EventOrderCreated {
+		t.Errorf("Event = %q, want %q", dl.Event, EventOrderCreated)
+	}
+	if p, ok := dl.Payload.(OrderCreated); !ok || p.OrderID != "1" {
+		t.Errorf("Payload = %#v, want OrderCreated{OrderID: 1}", dl.Payload)
+	}
+	if dl.Panic != "boom" || dl.Subscriber != "billing" || dl.Attempts != 1 {
+		t.Errorf("dead letter = %+v, want panic boom from billing after 1 attempt", dl)
+	}
+}
+
+func TestGiveUpIsDeadLettered(t *testing.T) {
+	sink := NewMemoryDeadLetterSink(0)
+	bus := New(10, EventBusWithDeadLetterSink(sink))
+	startBus(t, bus)
+
+	bus.SubscribeOrderCreatedErr(func(OrderCreated) error {
+		return errors.New("unavailable")
+	}, EventBusWithRetry(EventBusRetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}))
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+
+	dl := waitForLetters(t, sink, 1)[0]
+	if dl.Error != "unavailable" || dl.Attempts != 2 {
+		t.Errorf("dead letter = %+v, want error unavailable after 2 attempts", dl)
+	}
+	if dl.Subscriber == "" {
+		t.Error("Subscriber is empty, want handler function name")
+	}
+}
+
+func TestRedrive(t *testing.T) {
+	sink := NewMemoryDeadLetterSink(0)
+	bus := New(10, EventBusWithDeadLetterSink(sink))
+	startBus(t, bus)
+
+	fixed := make(chan struct{})
+	received := make(chan string, 10)
+	bus.SubscribeOrderCreated(func(e OrderCreated) {
+		select {
+		case <-fixed:
+			received <- e.OrderID
+		default:
+			panic("not yet")
+		}
+	})
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	bus.PublishOrderCreated(OrderCreated{OrderID: "2"})
+	waitForLetters(t, sink, 2)
+
+	close(fixed)
+	n, err := bus.Redrive(context.Background(), func(dl DeadLetter) bool {
+		return dl.Payload.(OrderCreated).OrderID == "2"
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("Redrive() = %d, %v, want 1, nil", n, err)
+	}
+
+	select {
+	case id := <-received:
+		if id != "2" {
+			t.Errorf("redriven event = %q, want %q", id, "2")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("redriven event not delivered")
+	}
+
+	if left := waitForLetters(t, sink, 1); len(left) != 1 {
+		t.Errorf("sink holds %d letters after redrive, want 1", len(left))
+	}
+}
+
+// flakySink fails the next fail calls to Put.
+type flakySink struct {
+	*MemoryDeadLetterSink
+	fail atomic.Int32
+}
+
+func (s *flakySink) Put(dl DeadLetter) error {
+	if s.fail.Add(-1) >= 0 {
+		return errors.New("disk full")
+	}
+	return s.MemoryDeadLetterSink.Put(dl)
+}
+
+func TestRedriveKeepsLettersWhenPutFails(t *testing.T) {
+	sink := &flakySink{MemoryDeadLetterSink: NewMemoryDeadLetterSink(0)}
+	bus := New(1, EventBusWithDeadLetterSink(sink)) // not started: holds one event
+
+	for _, id := range []string{"1", "2", "3"} {
+		_ = sink.MemoryDeadLetterSink.Put(DeadLetter{Event: EventOrderCreated, Payload: OrderCreated{OrderID: id}})
+	}
+	sink.fail.Store(1)
+
+	n, err := bus.Redrive(context.Background(), nil)
+	if n != 1 || err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("Redrive() = %d, %v; want 1 and the Put error", n, err)
+	}
+
+	// Letter 1 was published and letter 2 could not be returned, but letter 3
+	// must not be lost.
+	left, _ := sink.Take(nil)
+	if len(left) != 1 || left[0].Payload.(OrderCreated).OrderID != "3" {
+		t.Errorf("sink after Redrive = %+v, want letter 3", left)
+	}
+}
+
+func TestRedriveOnlyFailedSubscriber(t *testing.T) {
+	sink := NewMemoryDeadLetterSink(0)
+	bus := New(10, EventBusWithDeadLetterSink(sink))
+	startBus(t, bus)
+
+	var healthy atomic.Int32
+	bus.SubscribeOrderCreated(func(OrderCreated) { healthy.Add(1) }, EventBusWithName("audit"))
+
+	var failed atomic.Bool
+	retried := make(chan struct{})
+	bus.SubscribeOrderCreated(func(OrderCreated) {
+		if failed.CompareAndSwap(false, true) {
+			panic("boom")
+		}
+		close(retried)
+	}, EventBusWithName("billing"))
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	if dl := waitForLetters(t, sink, 1)[0]; dl.Subscriber != "billing" {
+		t.Fatalf("Subscriber = %q, want billing", dl.Subscriber)
+	}
+
+	if n, err := bus.Redrive(context.Background(), nil); err != nil || n != 1 {
+		t.Fatalf("Redrive() = %d, %v, want 1, nil", n, err)
+	}
+	select {
+	case <-retried:
+	case <-time.After(time.Second):
+		t.Fatal("redriven event not delivered to billing")
+	}
+
+	// Events are dispatched in order, so once a later event is handled the
+	// redriven one has reached every subscriber it is going to reach.
+	done := make(chan struct{})
+	bus.SubscribeOrderShipped(func(OrderShipped) { close(done) })
+	bus.PublishOrderShipped(OrderShipped{})
+	<-done
+
+	if got := healthy.Load(); got != 1 {
+		t.Errorf("audit handled the event %d times, want 1", got)
+	}
+}
+
+func TestFileDeadLetterSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	sink := NewFileDeadLetterSink(path)
+
+	for _, id := range []string{"1", "2"} {
+		err := sink.Put(DeadLetter{
+			Time:       time.Unix(10, 0).UTC(),
+			Event:      EventOrderShipped,
+			Payload:    OrderShipped{OrderID: id, TrackingNo: "T" + id},
+			Panic:      "boom",
+			Subscriber: "shipping",
+			Attempts:   1,
+		})
+		if err != nil {
+			t.Fatalf("Put() error: %v", err)
+		}
+	}
+
+	// A fresh sink reads what the first one wrote.
+	taken, err := NewFileDeadLetterSink(path).Take(func(dl DeadLetter) bool {
+		return dl.Payload.(OrderShipped).OrderID == "1"
+	})
+	if err != nil {
+		t.Fatalf("Take() error: %v", err)
+	}
+	if len(taken) != 1 {
+		t.Fatalf("Take() returned %d letters, want 1", len(taken))
+	}
+	if p := taken[0].Payload.(OrderShipped); p.TrackingNo != "T1" {
+		t.Errorf("payload = %+v, want TrackingNo T1", p)
+	}
+	if taken[0].Subscriber != "shipping" || !taken[0].Time.Equal(time.Unix(10, 0)) {
+		t.Errorf("dead letter = %+v, metadata not preserved", taken[0])
+	}
+
+	rest, err := sink.Take(nil)
+	if err != nil || len(rest) != 1 {
+		t.Fatalf("Take(nil) = %d letters, %v, want 1, nil", len(rest), err)
+	}
+	if rest, _ := sink.Take(nil); len(rest) != 0 {
+		t.Errorf("sink not empty after taking all letters")
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_FileQueue(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileQueueRecoversUnacked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+
+	// First process: publishes but crashes before dispatching.
+	q, err := OpenEventBusFileQueue(path, 10)
+	if err != nil {
+		t.Fatalf("OpenEventBusFileQueue() error: %v", err)
+	}
+	bus := New(0, EventBusWithQueue(q))
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	bus.PublishOrderShipped(OrderShipped{OrderID: "1", TrackingNo: "T1"})
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second process: replays the unacknowledged events on Start.
+	q, err = OpenEventBusFileQueue(path, 10)
+	if err != nil {
+		t.Fatalf("reopening queue: %v", err)
+	}
+	if got := q.Len(); got != 2 {
+		t.Fatalf("recovered Len() = %d, want 2", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("compaction left its temporary file behind: %v", err)
+	}
+
+	bus = New(0, EventBusWithQueue(q))
+	created := make(chan string, 1)
+	shipped := make(chan string, 1)
+	bus.SubscribeOrderCreated(func(e OrderCreated) { created <- e.OrderID })
+	bus.SubscribeOrderShipped(func(e OrderShipped) { shipped <- e.TrackingNo })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		bus.Start(ctx)
+		close(stopped)
+	}()
+
+	for _, ch := range []chan string{created, shipped} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("recovered event not dispatched")
+		}
+	}
+	cancel()
+	<-stopped
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything was acknowledged, so nothing is replayed again.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("log size = %d after all events were acknowledged, want 0", info.Size())
+	}
+
+	q, err = OpenEventBusFileQueue(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if got := q.Len(); got != 0 {
+		t.Errorf("Len() after full ack = %d, want 0", got)
+	}
+}
+
+func TestFileQueueCompactsWhileRunning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	q, err := OpenEventBusFileQueue(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.compactAt = 4
+
+	const n = 20
+	for i := range n {
+		env := EventEnvelope{ID: fmt.Sprint(i), Event: EventOrderCreated, Payload: OrderCreated{OrderID: fmt.Sprint(i)}}
+		if !q.Push(env) {
+			t.Fatalf("Push(%d) failed", i)
+		}
+	}
+	var popped []EventEnvelope
+	for range n {
+		env, err := q.Pop(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		popped = append(popped, env)
+	}
+	// The first envelope stays unacknowledged, so the log is never truncated.
+	for _, env := range popped[1:] {
+		if err := q.Ack(env); err != nil {
+			t.Fatalf("Ack(%s) error: %v", env.ID, err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines >= n {
+		t.Errorf("log has %d lines after %d acks, want it compacted below %d", lines, n-1, n)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("compaction left its temporary file behind: %v", err)
+	}
+
+	q, err = OpenEventBusFileQueue(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if got := q.Len(); got != 1 {
+		t.Fatalf("recovered Len() = %d, want 1", got)
+	}
+	env, err := q.Pop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.ID != "0" || env.Payload != (OrderCreated{OrderID: "0"}) {
+		t.Errorf("recovered envelope = %+v, want the unacknowledged one", env)
+	}
+}
+
+func TestFileQueueFull(t *testing.T) {
+	q, err := OpenEventBusFileQueue(filepath.Join(t.TempDir(), "queue.wal"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	bus := New(0, EventBusWithQueue(q))
+	var dropped int
+	bus.OnDrop(func(Event, any) { dropped++ })
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	bus.PublishOrderCreated(OrderCreated{OrderID: "2"})
+
+	if dropped != 1 {
+		t.Errorf("dropped = %d, want 1", dropped)
+	}
+	if q.Cap() != 1 || q.Len() != 1 {
+		t.Errorf("Len/Cap = %d/%d, want 1/1", q.Len(), q.Cap())
+	}
+}
+
+func TestEnvelopeJSONRoundTrip(t *testing.T) {
+	env := EventEnvelope{
+		ID:      "abc",
+		Time:    time.Unix(5, 0).UTC(),
+		Event:   EventOrderShipped,
+		Payload: OrderShipped{OrderID: "1", TrackingNo: "T1"},
+	}
+
+	data, err := env.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got EventEnvelope
+	if err := got.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != env.ID || !got.Time.Equal(env.Time) || got.Event != env.Event || got.Payload != env.Payload {
+		t.Errorf("round trip = %+v, want %+v", got, env)
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_Codec(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	data, err := EncodeEvent(EventOrderShipped, OrderShipped{OrderID: "1", TrackingNo: "T1"})
+	if err != nil {
+		t.Fatalf("EncodeEvent() error: %v", err)
+	}
+
+	got, err := DecodeEvent(EventOrderShipped, data)
+	if err != nil {
+		t.Fatalf("DecodeEvent() error: %v", err)
+	}
+	if got != (OrderShipped{OrderID: "1", TrackingNo: "T1"}) {
+		t.Errorf("DecodeEvent() = %#v", got)
+	}
+}
+
+func TestEncodeRejectsWrongPayload(t *testing.T) {
+	if _, err := EncodeEvent(EventOrderCreated, OrderShipped{}); err == nil {
+		t.Error("EncodeEvent() with mismatched payload type succeeded")
+	}
+	if _, err := EncodeEvent(Event("nope"), OrderCreated{}); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("EncodeEvent() unknown event error = %v, want ErrUnknownEvent", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	if _, err := DecodeEvent(Event("nope"), []byte("{}")); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("DecodeEvent() unknown event error = %v, want ErrUnknownEvent", err)
+	}
+	if _, err := DecodeEvent(EventOrderCreated, []byte("{")); err == nil || errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("DecodeEvent() malformed error = %v", err)
+	}
+}
+
+func TestPublishRaw(t *testing.T) {
+	bus := New(1)
+	got := make(chan OrderCreated, 1)
+	bus.SubscribeOrderCreated(func(e OrderCreated) { got <- e })
+
+	ctx := context.Background()
+	if err := bus.PublishRaw(ctx, EventOrderCreated, []byte(` + "`" + `{"OrderID":"42"}` + "`" + `)); err != nil {
+		t.Fatalf("PublishRaw() error: %v", err)
+	}
+	if err := bus.PublishRaw(ctx, EventOrderCreated, []byte("{}")); !errors.Is(err, ErrDropped) {
+		t.Errorf("PublishRaw() on full queue = %v, want ErrDropped", err)
+	}
+	if err := bus.PublishRaw(ctx, Event("nope"), []byte("{}")); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("PublishRaw() unknown event = %v, want ErrUnknownEvent", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := bus.PublishRaw(cancelled, EventOrderCreated, []byte("{}")); !errors.Is(err, context.Canceled) {
+		t.Errorf("PublishRaw() with cancelled ctx = %v, want context.Canceled", err)
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go bus.Start(runCtx)
+
+	select {
+	case e := <-got:
+		if e.OrderID != "42" {
+			t.Errorf("OrderID = %q, want 42", e.OrderID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("raw event not dispatched")
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_DynamicPublish(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPublishChecksPayloadType(t *testing.T) {
+	bus := New(1)
+
+	if err := bus.Publish(EventOrderCreated, OrderShipped{}); !errors.Is(err, ErrPayloadType) {
+		t.Errorf("Publish() mismatched payload = %v, want ErrPayloadType", err)
+	}
+	if err := bus.Publish(EventOrderCreated, &OrderCreated{}); !errors.Is(err, ErrPayloadType) {
+		t.Errorf("Publish() pointer payload = %v, want ErrPayloadType", err)
+	}
+	if err := bus.Publish(Event("nope"), OrderCreated{}); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("Publish() unknown event = %v, want ErrUnknownEvent", err)
+	}
+	if err := bus.Publish(EventOrderCreated, OrderCreated{OrderID: "1"}); err != nil {
+		t.Fatalf("Publish() error: %v", err)
+	}
+	if err := bus.Publish(EventOrderCreated, OrderCreated{OrderID: "2"}); !errors.Is(err, ErrDropped) {
+		t.Errorf("Publish() on full queue = %v, want ErrDropped", err)
+	}
+}
+
+func TestSubscribeAny(t *testing.T) {
+	bus := New(10)
+
+	if err := bus.SubscribeAny(Event("nope"), func(any) {}); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("SubscribeAny() unknown event = %v, want ErrUnknownEvent", err)
+	}
+
+	got := make(chan any, 1)
+	if err := bus.SubscribeAny(EventOrderShipped, func(v any) { got <- v }); err != nil {
+		t.Fatalf("SubscribeAny() error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	bus.PublishOrderShipped(OrderShipped{OrderID: "1", TrackingNo: "T1"})
+
+	select {
+	case v := <-got:
+		if v != (OrderShipped{OrderID: "1", TrackingNo: "T1"}) {
+			t.Errorf("payload = %#v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SubscribeAny handler not called")
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_EventEnum(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAllEvents(t *testing.T) {
+	got := AllEvents()
+	want := []Event{EventOrderCreated, EventOrderShipped}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AllEvents() = %v, want %v", got, want)
+	}
+
+	got[0] = "mutated"
+	if AllEvents()[0] != EventOrderCreated {
+		t.Error("AllEvents() returned a shared slice")
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	event, err := ParseEvent("order.shipped")
+	if err != nil || event != EventOrderShipped {
+		t.Errorf("ParseEvent() = %q, %v", event, err)
+	}
+	if _, err := ParseEvent("order.lost"); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("ParseEvent() unknown = %v, want ErrUnknownEvent", err)
+	}
+}
+
+func TestValidAndPayloadType(t *testing.T) {
+	if !EventOrderCreated.Valid() || Event("nope").Valid() {
+		t.Error("Valid() mismatch")
+	}
+	if got := EventOrderShipped.PayloadType(); got != reflect.TypeOf(OrderShipped{}) {
+		t.Errorf("PayloadType() = %v", got)
+	}
+	if got := Event("nope").PayloadType(); got != nil {
+		t.Errorf("PayloadType() unknown = %v, want nil", got)
+	}
+}
+
+func TestEventText(t *testing.T) {
+	var cfg struct {
+		Events []Event
+	}
+	if err := json.Unmarshal([]byte(` + "`" + `{"Events":["order.created"]}` + "`" + `), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if len(cfg.Events) != 1 || cfg.Events[0] != EventOrderCreated {
+		t.Errorf("Events = %v", cfg.Events)
+	}
+
+	if err := json.Unmarshal([]byte(` + "`" + `{"Events":["order.lost"]}` + "`" + `), &cfg); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("Unmarshal() unknown = %v, want ErrUnknownEvent", err)
+	}
+	if _, err := json.Marshal(Event("order.lost")); !errors.Is(err, ErrUnknownEvent) {
+		t.Errorf("Marshal() unknown = %v, want ErrUnknownEvent", err)
+	}
+
+	data, err := json.Marshal(EventOrderShipped)
+	if err != nil || string(data) != ` + "`" + `"order.shipped"` + "`" + ` {
+		t.Errorf("Marshal() = %s, %v", data, err)
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_PublisherInterfaces(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type shipper struct {
+	events OrderShippedPublisher
+}
+
+func (s shipper) ship(id string) {
+	s.events.PublishOrderShipped(OrderShipped{OrderID: id, TrackingNo: "T-" + id})
+}
+
+type recordingPublisher struct {
+	shipped []OrderShipped
+}
+
+func (r *recordingPublisher) PublishOrderShipped(e OrderShipped) {
+	r.shipped = append(r.shipped, e)
+}
+
+func TestNarrowPublisherAcceptsFake(t *testing.T) {
+	rec := &recordingPublisher{}
+	shipper{events: rec}.ship("1")
+	if len(rec.shipped) != 1 || rec.shipped[0].TrackingNo != "T-1" {
+		t.Errorf("shipped = %+v", rec.shipped)
+	}
+}
+
+func TestBusSatisfiesInterfaces(t *testing.T) {
+	bus := New(10)
+	var pub Publisher = bus
+	var sub Subscriber = bus
+
+	got := make(chan string, 1)
+	sub.SubscribeOrderShipped(func(e OrderShipped) { got <- e.TrackingNo })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	shipper{events: pub}.ship("2")
+
+	select {
+	case tn := <-got:
+		if tn != "T-2" {
+			t.Errorf("TrackingNo = %q, want T-2", tn)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered")
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_FakeBus(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type recordingT struct {
+	failed string
+}
+
+func (r *recordingT) Helper() {}
+
+func (r *recordingT) Fatalf(format string, args ...any) {
+	r.failed = fmt.Sprintf(format, args...)
+}
+
+func TestFakeRecordsPublishes(t *testing.T) {
+	var fake FakeEventBus
+	var pub Publisher = &fake
+
+	pub.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	pub.PublishOrderShipped(OrderShipped{OrderID: "1", TrackingNo: "T1"})
+	pub.PublishOrderCreated(OrderCreated{OrderID: "2"})
+
+	created := fake.PublishedOrderCreated()
+	if len(created) != 2 || created[0].OrderID != "1" || created[1].OrderID != "2" {
+		t.Errorf("PublishedOrderCreated() = %+v", created)
+	}
+	if all := fake.Published(); len(all) != 3 || all[1].Event != EventOrderShipped {
+		t.Errorf("Published() = %+v", all)
+	}
+
+	fake.RequirePublished(t, EventOrderCreated, 2)
+	fake.RequirePublished(t, EventOrderShipped, 1)
+
+	rec := &recordingT{}
+	fake.RequirePublished(rec, EventOrderShipped, 2)
+	if rec.failed != "order.shipped published 1 times, want 2" {
+		t.Errorf("RequirePublished() failure = %q", rec.failed)
+	}
+
+	fake.Reset()
+	fake.RequirePublished(t, EventOrderCreated, 0)
+	if got := fake.PublishedOrderShipped(); got != nil {
+		t.Errorf("PublishedOrderShipped() after Reset = %+v", got)
+	}
+}
+
+func TestFakeConcurrentPublish(t *testing.T) {
+	var fake FakeEventBus
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fake.PublishOrderCreated(OrderCreated{})
+		}()
+	}
+	wg.Wait()
+	fake.RequirePublished(t, EventOrderCreated, 50)
+}
+`
+	runGeneratedTestsWith(t, orderEventsSource, func(in *model.GenerateInput) { in.Fake = true }, testFile)
+}
+
+func TestIntegration_WaitFor(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitForMatchingEvent(t *testing.T) {
+	bus := New(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	subscribed := make(chan struct{})
+	bus.OnSubscribe(func(Event) { close(subscribed) })
+
+	go func() {
+		<-subscribed
+		bus.PublishOrderShipped(OrderShipped{OrderID: "1", TrackingNo: "T1"})
+		bus.PublishOrderShipped(OrderShipped{OrderID: "2", TrackingNo: "T2"})
+	}()
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, time.Second)
+	defer waitCancel()
+	got, err := bus.WaitForOrderShipped(waitCtx, func(e OrderShipped) bool { return e.OrderID == "2" })
+	if err != nil {
+		t.Fatalf("WaitForOrderShipped() error: %v", err)
+	}
+	if got.TrackingNo != "T2" {
+		t.Errorf("TrackingNo = %q, want T2", got.TrackingNo)
+	}
+
+	bus.mu.RLock()
+	n := len(bus.subscribers[EventOrderShipped])
+	bus.mu.RUnlock()
+	if n != 0 {
+		t.Errorf("%d subscribers left after WaitFor returned, want 0", n)
+	}
+}
+
+func TestWaitForTimeout(t *testing.T) {
+	bus := New(10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := bus.WaitForOrderCreated(ctx, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitForOrderCreated() error = %v, want DeadlineExceeded", err)
+	}
+
+	bus.mu.RLock()
+	n := len(bus.subscribers[EventOrderCreated])
+	bus.mu.RUnlock()
+	if n != 0 {
+		t.Errorf("%d subscribers left after timeout, want 0", n)
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_Transactions(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTxCommitPublishesInOrder(t *testing.T) {
+	bus := New(10)
+	var got []string
+	bus.OnPublish(func(e Event, v any) {
+		switch p := v.(type) {
+		case OrderCreated:
+			got = append(got, "created:"+p.OrderID)
+		case OrderShipped:
+			got = append(got, "shipped:"+p.OrderID)
+		}
+	})
+
+	tx := bus.Begin()
+	tx.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	tx.PublishOrderShipped(OrderShipped{OrderID: "1"})
+	if len(got) != 0 || bus.queue.Len() != 0 {
+		t.Fatalf("events published before Commit: %v", got)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+	if len(got) != 2 || got[0] != "created:1" || got[1] != "shipped:1" {
+		t.Errorf("published = %v", got)
+	}
+
+	if err := tx.Commit(); !errors.Is(err, ErrEventBusTxDone) {
+		t.Errorf("second Commit() = %v, want ErrEventBusTxDone", err)
+	}
+	if err := tx.Rollback(); !errors.Is(err, ErrEventBusTxDone) {
+		t.Errorf("Rollback() after Commit = %v, want ErrEventBusTxDone", err)
+	}
+
+	tx.PublishOrderCreated(OrderCreated{OrderID: "late"})
+	if bus.queue.Len() != 2 {
+		t.Errorf("queue Len() = %d after publishing to a finished tx, want 2", bus.queue.Len())
+	}
+}
+
+func TestTxRollbackDiscards(t *testing.T) {
+	bus := New(10)
+	tx := bus.Begin()
+	tx.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback() error: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrEventBusTxDone) {
+		t.Errorf("Commit() after Rollback = %v, want ErrEventBusTxDone", err)
+	}
+	if bus.queue.Len() != 0 {
+		t.Errorf("queue Len() = %d, want 0", bus.queue.Len())
+	}
+}
+
+func TestTxCommitReportsDrops(t *testing.T) {
+	bus := New(1)
+	tx := bus.Begin()
+	tx.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	tx.PublishOrderCreated(OrderCreated{OrderID: "2"})
+	if err := tx.Commit(); !errors.Is(err, ErrDropped) {
+		t.Errorf("Commit() = %v, want ErrDropped", err)
+	}
+}
+
+func TestPublisherFromContext(t *testing.T) {
+	bus := New(10)
+	other := New(10)
+
+	ship := func(ctx context.Context) {
+		bus.PublisherFrom(ctx).PublishOrderShipped(OrderShipped{OrderID: "1"})
+	}
+
+	tx := bus.Begin()
+	ship(EventBusContextWithTx(context.Background(), tx))
+	if bus.queue.Len() != 0 {
+		t.Fatal("PublisherFrom bypassed the transaction in ctx")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if bus.queue.Len() != 1 {
+		t.Errorf("queue Len() after Commit = %d, want 1", bus.queue.Len())
+	}
+
+	ship(EventBusContextWithTx(context.Background(), other.Begin()))
+	if bus.queue.Len() != 2 {
+		t.Error("PublisherFrom used a transaction from another bus")
+	}
+
+	if _, ok := EventBusTxFromContext(context.Background()); ok {
+		t.Error("EventBusTxFromContext() found a transaction in an empty context")
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_Outbox(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCommitOutboxThenRelay(t *testing.T) {
+	bus := New(10)
+	store := NewMemoryOutboxStore()
+
+	tx := bus.Begin()
+	tx.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	tx.PublishOrderShipped(OrderShipped{OrderID: "1", TrackingNo: "T1"})
+	if err := tx.CommitOutbox(context.Background(), nil, store); err != nil {
+		t.Fatalf("CommitOutbox() error: %v", err)
+	}
+	if bus.queue.Len() != 0 {
+		t.Fatal("CommitOutbox published directly to the bus")
+	}
+	if store.Len() != 2 {
+		t.Fatalf("store Len() = %d, want 2", store.Len())
+	}
+	if err := tx.Rollback(); !errors.Is(err, ErrEventBusTxDone) {
+		t.Errorf("Rollback() after CommitOutbox = %v, want ErrEventBusTxDone", err)
+	}
+	pending, _ := store.FetchPending(context.Background(), 10)
+	if pending[0].ID == "" || pending[0].ID == pending[1].ID {
+		t.Errorf("envelope IDs = %q, %q", pending[0].ID, pending[1].ID)
+	}
+
+	var mu sync.Mutex
+	var got []string
+	done := make(chan struct{})
+	bus.SubscribeOrderShipped(func(OrderShipped) { close(done) })
+	bus.OnPublish(func(e Event, _ any) {
+		mu.Lock()
+		got = append(got, string(e))
+		mu.Unlock()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	relayed := make(chan error, 1)
+	go func() { relayed <- bus.RelayOutbox(ctx, store, EventBusRelayOptions{Interval: 10 * time.Millisecond}) }()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("outbox events not relayed")
+	}
+
+	mu.Lock()
+	if len(got) != 2 || got[0] != "order.created" || got[1] != "order.shipped" {
+		t.Errorf("published = %v", got)
+	}
+	mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for store.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if store.Len() != 0 {
+		t.Errorf("store Len() = %d after relay, want 0", store.Len())
+	}
+
+	cancel()
+	if err := <-relayed; !errors.Is(err, context.Canceled) {
+		t.Errorf("RelayOutbox() = %v, want context.Canceled", err)
+	}
+}
+
+func TestRelayRetriesWhenQueueFull(t *testing.T) {
+	bus := New(1)
+	store := NewMemoryOutboxStore()
+	for _, id := range []string{"1", "2"} {
+		_ = store.Insert(context.Background(), nil, EventEnvelope{ID: id, Event: EventOrderCreated, Payload: OrderCreated{OrderID: id}})
+	}
+
+	n, err := bus.relayOutbox(context.Background(), store, 10)
+	if err != nil || n != 1 {
+		t.Fatalf("relayOutbox() = %d, %v; want 1, nil", n, err)
+	}
+	if store.Len() != 1 {
+		t.Errorf("store Len() = %d, want 1 left for the next poll", store.Len())
+	}
+}
+
+// recordingDriver is a minimal database/sql driver that records statements
+// and answers SELECT queries with canned envelope rows.
+type recordingDriver struct {
+	mu      sync.Mutex
+	queries []string
+	args    [][]driver.Value
+	rows    []string
+}
+
+func (d *recordingDriver) Open(string) (driver.Conn, error) { return &recordingConn{d: d}, nil }
+
+func (d *recordingDriver) record(query string, args []driver.Value) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queries = append(d.queries, query)
+	d.args = append(d.args, args)
+}
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{d: c.d, query: query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return recordingTx{}, nil }
+
+type recordingTx struct{}
+
+func (recordingTx) Commit() error   { return nil }
+func (recordingTx) Rollback() error { return nil }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.record(s.query, args)
+	return driver.RowsAffected(1), nil
+}
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.record(s.query, args)
+	return &recordingRows{rows: s.d.rows}, nil
+}
+
+type recordingRows struct{ rows []string }
+
+func (r *recordingRows) Columns() []string { return []string{"envelope"} }
+func (r *recordingRows) Close() error      { return nil }
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	dest[0], r.rows = r.rows[0], r.rows[1:]
+	return nil
+}
+
+func TestSQLOutboxStore(t *testing.T) {
+	d := &recordingDriver{}
+	sql.Register("recording", d)
+	db, err := sql.Open("recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := NewSQLOutboxStore(db, "", func(n int) string { return fmt.Sprintf("$%d", n) })
+	if schema := store.Schema(); !strings.HasPrefix(schema, "CREATE TABLE IF NOT EXISTS event_outbox (") {
+		t.Errorf("Schema() = %q", schema)
+	}
+
+	env := EventEnvelope{ID: "abc", Time: time.Unix(5, 0), Event: EventOrderCreated, Payload: OrderCreated{OrderID: "1"}}
+	sqlTx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Insert(context.Background(), sqlTx, env); err != nil {
+		t.Fatalf("Insert() error: %v", err)
+	}
+	if err := sqlTx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.rows = []string{d.args[0][2].(string)}
+	pending, err := store.FetchPending(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("FetchPending() error: %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != "abc" || pending[0].Payload != (OrderCreated{OrderID: "1"}) {
+		t.Errorf("FetchPending() = %+v", pending)
+	}
+
+	if err := store.MarkDelivered(context.Background(), []string{"abc", "def"}); err != nil {
+		t.Fatalf("MarkDelivered() error: %v", err)
+	}
+
+	want := []string{
+		"INSERT INTO event_outbox (id, created_at, envelope) VALUES ($1, $2, $3)",
+		"SELECT envelope FROM event_outbox WHERE delivered_at IS NULL ORDER BY created_at, id LIMIT 5",
+		"UPDATE event_outbox SET delivered_at = $1 WHERE id IN ($2, $3)",
+	}
+	if len(d.queries) != len(want) {
+		t.Fatalf("queries = %q", d.queries)
+	}
+	for i := range want {
+		if d.queries[i] != want[i] {
+			t.Errorf("query %d = %q, want %q", i, d.queries[i], want[i])
+		}
+	}
+	if got := d.args[2][1:]; len(got) != 2 || got[0] != "abc" || got[1] != "def" {
+		t.Errorf("MarkDelivered args = %v", got)
+	}
+}
+`
+	runGeneratedTestsWith(t, orderEventsSource, func(in *model.GenerateInput) { in.Outbox = true }, testFile)
+}
+
+func TestIntegration_RecordReplay(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func recordOrders(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+	var log bytes.Buffer
+	rec := NewRecorder(&log)
+	bus.Record(rec)
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	clock.Advance(time.Minute)
+	bus.PublishOrderShipped(OrderShipped{OrderID: "1", TrackingNo: "T1"})
+	clock.Advance(time.Minute)
+	bus.PublishOrderCreated(OrderCreated{OrderID: "2"})
+
+	if err := rec.Err(); err != nil {
+		t.Fatalf("Recorder error: %v", err)
+	}
+	return &log
+}
+
+func TestRecordWritesEnvelopes(t *testing.T) {
+	log := recordOrders(t)
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("recorded %d lines, want 3:\n%s", len(lines), log)
+	}
+	if !strings.Contains(lines[1], ` + "`" + `"event":"order.shipped"` + "`" + `) {
+		t.Errorf("line 2 = %s", lines[1])
+	}
+}
+
+func expectCreated(t *testing.T, got chan string, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		select {
+		case e := <-got:
+			if e != id {
+				t.Fatalf("dispatched order %q, want %q", e, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("order %q not dispatched", id)
+		}
+	}
+}
+
+func TestReplayFilters(t *testing.T) {
+	log := recordOrders(t)
+
+	bus := New(10)
+	created := make(chan string, 10)
+	bus.SubscribeOrderCreated(func(e OrderCreated) { created <- e.OrderID })
+	shipped := make(chan struct{}, 10)
+	bus.SubscribeOrderShipped(func(OrderShipped) { shipped <- struct{}{} })
+
+	// Replayed envelopes skip the enqueue and publish hooks.
+	var again bytes.Buffer
+	bus.Record(NewRecorder(&again))
+	var published atomic.Int32
+	bus.OnPublish(func(Event, any) { published.Add(1) })
+
+	n, err := bus.Replay(context.Background(), bytes.NewReader(log.Bytes()), EventBusReplayOptions{
+		Events: []Event{EventOrderCreated},
+		Since:  time.Unix(30, 0),
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("Replay() = %d, %v; want 1, nil", n, err)
+	}
+	n, err = bus.Replay(context.Background(), bytes.NewReader(log.Bytes()), EventBusReplayOptions{Until: time.Unix(60, 0)})
+	if err != nil || n != 1 {
+		t.Fatalf("Replay(Until) = %d, %v; want 1, nil", n, err)
+	}
+	if got := bus.queue.Len(); got != 2 {
+		t.Fatalf("queue holds %d envelopes, want 2 until Start dispatches them", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+	expectCreated(t, created, "2", "1")
+
+	select {
+	case <-shipped:
+		t.Error("replayed an event outside the selection")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if again.Len() != 0 || published.Load() != 0 {
+		t.Errorf("replay ran hooks: recorded %q, %d publish hooks", again.String(), published.Load())
+	}
+}
+
+func TestReplayWaitsForRoom(t *testing.T) {
+	log := recordOrders(t)
+
+	bus := New(1)
+	created := make(chan string, 10)
+	bus.SubscribeOrderCreated(func(e OrderCreated) { created <- e.OrderID })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan int, 1)
+	go func() {
+		n, err := bus.Replay(ctx, log, EventBusReplayOptions{Events: []Event{EventOrderCreated}})
+		if err != nil {
+			t.Errorf("Replay() error: %v", err)
+		}
+		done <- n
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Replay returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go bus.Start(ctx)
+	expectCreated(t, created, "1", "2")
+	if n := <-done; n != 2 {
+		t.Errorf("Replay() = %d, want 2", n)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	log := recordOrders(t)
+
+	clock := newFakeClock()
+	bus := New(10, EventBusWithClock(clock))
+	got := make(chan string, 3)
+	bus.SubscribeOrderCreated(func(e OrderCreated) { got <- "created" })
+	bus.SubscribeOrderShipped(func(e OrderShipped) { got <- "shipped" })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := bus.Replay(ctx, log, EventBusReplayOptions{Speed: 2})
+		done <- err
+	}()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case e := <-got:
+			if e != want {
+				t.Fatalf("dispatched %s, want %s", e, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not dispatched", want)
+		}
+	}
+	waitTimer := func() {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			clock.mu.Lock()
+			n := len(clock.timers)
+			clock.mu.Unlock()
+			if n > 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("replay is not waiting")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	expect("created")
+	waitTimer()
+	clock.Advance(29 * time.Second)
+	select {
+	case e := <-got:
+		t.Fatalf("%s dispatched before the scaled gap", e)
+	default:
+	}
+	clock.Advance(time.Second)
+	expect("shipped")
+	waitTimer()
+	clock.Advance(30 * time.Second)
+	expect("created")
+
+	if err := <-done; err != nil {
+		t.Fatalf("Replay() error: %v", err)
+	}
+}
+
+func TestReplayCancelledWhileWaiting(t *testing.T) {
+	log := recordOrders(t)
+	bus := New(10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	n, err := bus.Replay(ctx, log, EventBusReplayOptions{Speed: 1})
+	if !errors.Is(err, context.DeadlineExceeded) || n != 1 {
+		t.Errorf("Replay() = %d, %v; want 1, DeadlineExceeded", n, err)
+	}
+}
+
+func TestReplayRejectsCorruptLog(t *testing.T) {
+	bus := New(10)
+	if _, err := bus.Replay(context.Background(), strings.NewReader("{not json"), EventBusReplayOptions{}); err == nil {
+		t.Error("Replay() of corrupt log succeeded")
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile, fakeClockSource)
+}
+
+func TestIntegration_ReplayWhileRunning(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestReplayWhileRunning(t *testing.T) {
+	const n = 50
+
+	var log bytes.Buffer
+	recorder := New(n)
+	recorder.Record(NewRecorder(&log))
+	for i := 0; i < n; i++ {
+		recorder.PublishOrderCreated(OrderCreated{OrderID: "replayed"})
+	}
+
+	bus := New(2 * n)
+	count := 0 // only safe if every handler call runs on the Start goroutine
+	done := make(chan struct{})
+	bus.SubscribeOrderCreated(func(OrderCreated) {
+		count++
+		if count == 2*n {
+			close(done)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	replayed := make(chan error, 1)
+	go func() {
+		_, err := bus.Replay(ctx, &log, EventBusReplayOptions{})
+		replayed <- err
+	}()
+	for i := 0; i < n; i++ {
+		bus.PublishOrderCreated(OrderCreated{OrderID: "live"})
+	}
+
+	if err := <-replayed; err != nil {
+		t.Fatalf("Replay() error: %v", err)
+	}
+	<-done
+}
+`
+	runGeneratedRaceTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_UnixTransport(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func receiveOrders(t *testing.T, ctx context.Context, transport *UnixTransport, size int) (*EventBus, chan OrderCreated) {
+	t.Helper()
+	bus := New(size)
+	got := make(chan OrderCreated, 10)
+	bus.SubscribeOrderCreated(func(e OrderCreated) { got <- e })
+	go bus.ReceiveFrom(ctx, transport)
+	return bus, got
+}
+
+// startSendTo runs SendTo in the background and waits until it is forwarding.
+func startSendTo(t *testing.T, ctx context.Context, bus *EventBus, transport Transport, events ...Event) {
+	t.Helper()
+	bus.hookMu.RLock()
+	before := len(bus.onEnqueue)
+	bus.hookMu.RUnlock()
+
+	go bus.SendTo(ctx, transport, events...)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		bus.hookMu.RLock()
+		n := len(bus.onEnqueue)
+		bus.hookMu.RUnlock()
+		if n > before {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("SendTo did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectOrder(t *testing.T, got chan OrderCreated, id string) {
+	t.Helper()
+	select {
+	case e := <-got:
+		if e.OrderID != id {
+			t.Fatalf("received order %q, want %q", e.OrderID, id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("order %q not received", id)
+	}
+}
+
+func TestUnixTransportDelivers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bus.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// The sender starts first and keeps dialing until the receiver listens.
+	sender := New(10)
+	out := NewUnixTransport(path)
+	sent := make(chan EventEnvelope, 10)
+	sender.addEnqueueHook(func(env EventEnvelope) { sent <- env })
+	startSendTo(t, ctx, sender, out, EventOrderCreated)
+	sender.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	sender.PublishOrderShipped(OrderShipped{OrderID: "ignored"})
+
+	in := NewUnixTransport(path)
+	receiver, got := receiveOrders(t, ctx, in, 10)
+	received := make(chan EventEnvelope, 10)
+	receiver.addEnqueueHook(func(env EventEnvelope) { received <- env })
+	shipped := make(chan struct{}, 1)
+	receiver.SubscribeOrderShipped(func(OrderShipped) { shipped <- struct{}{} })
+	go receiver.Start(ctx)
+
+	expectOrder(t, got, "1")
+	if want, env := <-sent, <-received; env.ID != want.ID || !env.Time.Equal(want.Time) {
+		t.Errorf("received envelope %s at %v, want %s at %v", env.ID, env.Time, want.ID, want.Time)
+	}
+	select {
+	case <-shipped:
+		t.Error("event outside the SendTo selection was forwarded")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUnixTransportReconnects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bus.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	sender := New(10)
+	out := NewUnixTransport(path)
+	startSendTo(t, ctx, sender, out)
+
+	recvCtx, stopReceiver := context.WithCancel(ctx)
+	receiver := New(10)
+	got := make(chan OrderCreated, 10)
+	receiver.SubscribeOrderCreated(func(e OrderCreated) { got <- e })
+	stopped := make(chan error, 1)
+	go func() { stopped <- receiver.ReceiveFrom(recvCtx, NewUnixTransport(path)) }()
+	go receiver.Start(recvCtx)
+	sender.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	expectOrder(t, got, "1")
+
+	// Restart the receiving side over the socket file the old one left
+	// behind; the sender redials the new listener.
+	stopReceiver()
+	if err := <-stopped; !errors.Is(err, context.Canceled) {
+		t.Fatalf("ReceiveFrom() = %v, want context.Canceled", err)
+	}
+	receiver, got = receiveOrders(t, ctx, NewUnixTransport(path), 10)
+	go receiver.Start(ctx)
+	sender.PublishOrderCreated(OrderCreated{OrderID: "2"})
+	expectOrder(t, got, "2")
+}
+
+func TestUnixTransportBidirectional(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// Each bus receives on its own socket and sends every event to the other.
+	a, gotA := receiveOrders(t, ctx, NewUnixTransport(filepath.Join(dir, "a.sock")), 10)
+	b, gotB := receiveOrders(t, ctx, NewUnixTransport(filepath.Join(dir, "b.sock")), 10)
+	startSendTo(t, ctx, a, NewUnixTransport(filepath.Join(dir, "b.sock")))
+	startSendTo(t, ctx, b, NewUnixTransport(filepath.Join(dir, "a.sock")))
+	go a.Start(ctx)
+	go b.Start(ctx)
+
+	a.PublishOrderCreated(OrderCreated{OrderID: "from-a"})
+	expectOrder(t, gotA, "from-a")
+	expectOrder(t, gotB, "from-a")
+
+	b.PublishOrderCreated(OrderCreated{OrderID: "from-b"})
+	expectOrder(t, gotB, "from-b")
+	expectOrder(t, gotA, "from-b")
+
+	// A received envelope must not be sent back to where it came from.
+	select {
+	case e := <-gotA:
+		t.Fatalf("bus a received %q again", e.OrderID)
+	case e := <-gotB:
+		t.Fatalf("bus b received %q again", e.OrderID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUnixTransportSocketInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bus.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	receiver, got := receiveOrders(t, ctx, NewUnixTransport(path), 10)
+	go receiver.Start(ctx)
+
+	// Wait until the first receiver is listening.
+	out := NewUnixTransport(path)
+	if err := out.Send(ctx, EventEnvelope{ID: "a", Event: EventOrderCreated, Payload: OrderCreated{OrderID: "1"}}); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	expectOrder(t, got, "1")
+
+	err := NewUnixTransport(path).Receive(ctx, func(EventEnvelope) error { return nil })
+	if err == nil {
+		t.Fatal("Receive() on a socket in use = nil, want an error")
+	}
+
+	if err := out.Send(ctx, EventEnvelope{ID: "b", Event: EventOrderCreated, Payload: OrderCreated{OrderID: "2"}}); err != nil {
+		t.Fatalf("Send() after the second Receive error: %v", err)
+	}
+	expectOrder(t, got, "2")
+}
+
+func TestUnixTransportBackpressure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bus.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	in := NewUnixTransport(path)
+	receiver, got := receiveOrders(t, ctx, in, 1)
+
+	out := NewUnixTransport(path)
+	sendCtx, sendCancel := context.WithTimeout(ctx, time.Second)
+	defer sendCancel()
+	if err := out.Send(sendCtx, EventEnvelope{ID: "a", Event: EventOrderCreated, Payload: OrderCreated{OrderID: "1"}}); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	err := out.Send(sendCtx, EventEnvelope{ID: "b", Event: EventOrderCreated, Payload: OrderCreated{OrderID: "2"}})
+	if !errors.Is(err, ErrDropped) {
+		t.Fatalf("Send() to a full receiver = %v, want ErrDropped", err)
+	}
+
+	// SendTo retries the rejected envelope once the receiver drains its queue.
+	sender := New(10)
+	startSendTo(t, ctx, sender, out)
+	sender.PublishOrderCreated(OrderCreated{OrderID: "2"})
+	time.Sleep(30 * time.Millisecond)
+	go receiver.Start(ctx)
+
+	expectOrder(t, got, "1")
+	expectOrder(t, got, "2")
+}
+
+func TestUnixTransportSendCancelled(t *testing.T) {
+	out := NewUnixTransport(filepath.Join(t.TempDir(), "nobody.sock"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := out.Send(ctx, EventEnvelope{ID: "a", Event: EventOrderCreated, Payload: OrderCreated{}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send() without a receiver = %v, want DeadlineExceeded", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Errorf("Close() error: %v", err)
+	}
+}
+`
+	runGeneratedTestsWith(t, orderEventsSource, func(in *model.GenerateInput) { in.Transport = true }, testFile)
+}
+
+func TestIntegration_Forwarding(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestForwardPreservesMetadata(t *testing.T) {
+	src := New(10)
+	dst := New(10)
+	src.ForwardOrderShipped(dst)
+
+	got := make(chan EventEnvelope, 1)
+	dst.addEnqueueHook(func(env EventEnvelope) { got <- env })
+	created := 0
+	dst.SubscribeOrderCreated(func(OrderCreated) { created++ })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Start(ctx)
+
+	md := map[string]string{"trace": "abc"}
+	src.PublishOrderShippedWithMetadata(OrderShipped{OrderID: "1", TrackingNo: "T1"}, md)
+	md["trace"] = "changed"
+	src.PublishOrderCreated(OrderCreated{OrderID: "2"})
+
+	select {
+	case env := <-got:
+		if env.Event != EventOrderShipped || env.Payload != (OrderShipped{OrderID: "1", TrackingNo: "T1"}) {
+			t.Errorf("forwarded envelope = %+v", env)
+		}
+		if env.Metadata["trace"] != "abc" {
+			t.Errorf("forwarded metadata = %v, want trace=abc", env.Metadata)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not forwarded")
+	}
+	if dst.queue.Len() != 1 {
+		t.Errorf("destination queue Len() = %d, want only the forwarded event", dst.queue.Len())
+	}
+}
+
+func TestForwardResumesAfterRestart(t *testing.T) {
+	src := New(10)
+	dst := New(10)
+	src.ForwardOrderCreated(dst)
+
+	got := make(chan EventEnvelope, 1)
+	dst.addEnqueueHook(func(env EventEnvelope) { got <- env })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		src.Start(ctx)
+		close(stopped)
+	}()
+	cancel()
+	<-stopped
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go src.Start(ctx)
+
+	src.PublishOrderCreated(OrderCreated{OrderID: "1"})
+
+	select {
+	case env := <-got:
+		if env.Payload != (OrderCreated{OrderID: "1"}) {
+			t.Errorf("forwarded envelope = %+v", env)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not forwarded after the source bus restarted")
+	}
+}
+
+func TestMetadataSurvivesTxAndJSON(t *testing.T) {
+	bus := New(10)
+	got := make(chan EventEnvelope, 1)
+	bus.addEnqueueHook(func(env EventEnvelope) { got <- env })
+
+	tx := bus.Begin()
+	tx.PublishOrderCreatedWithMetadata(OrderCreated{OrderID: "1"}, map[string]string{"tenant": "t1"})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	env := <-got
+	if env.Metadata["tenant"] != "t1" || env.ID == "" {
+		t.Fatalf("committed envelope = %+v", env)
+	}
+
+	data, err := env.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded EventEnvelope
+	if err := decoded.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Metadata["tenant"] != "t1" {
+		t.Errorf("decoded metadata = %v", decoded.Metadata)
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_IngressHandler(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func post(t *testing.T, h http.Handler, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestIngressPublishes(t *testing.T) {
+	bus := New(10)
+	var published []any
+	bus.OnPublish(func(_ Event, v any) { published = append(published, v) })
+	h := bus.IngressHandler(EventBusIngressOptions{})
+
+	rec := post(t, h, "/events/order.shipped", ` + "`" + `{"OrderID":"1","TrackingNo":"T1"}` + "`" + `)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", rec.Code, rec.Body)
+	}
+	if len(published) != 1 || published[0] != (OrderShipped{OrderID: "1", TrackingNo: "T1"}) {
+		t.Errorf("published = %+v", published)
+	}
+}
+
+func TestIngressErrors(t *testing.T) {
+	bus := New(1)
+	h := bus.IngressHandler(EventBusIngressOptions{
+		Validate: func(_ *http.Request, _ Event, v any) error {
+			if e, ok := v.(OrderCreated); ok && e.OrderID == "" {
+				return errors.New("order id is required")
+			}
+			return nil
+		},
+	})
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"unknown event", "/events/order.lost", "{}", http.StatusNotFound},
+		{"wrong prefix", "/hooks/order.created", "{}", http.StatusNotFound},
+		{"malformed body", "/events/order.created", "{", http.StatusBadRequest},
+		{"validation", "/events/order.created", "{}", http.StatusUnprocessableEntity},
+		{"accepted", "/events/order.created", ` + "`" + `{"OrderID":"1"}` + "`" + `, http.StatusAccepted},
+		{"queue full", "/events/order.created", ` + "`" + `{"OrderID":"2"}` + "`" + `, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		if rec := post(t, h, tt.path, tt.body); rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events/order.created", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET status = %d, Allow = %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestIngressBodyLimit(t *testing.T) {
+	h := New(10).IngressHandler(EventBusIngressOptions{MaxBodyBytes: 8})
+	rec := post(t, h, "/events/order.created", ` + "`" + `{"OrderID":"0123456789"}` + "`" + `)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+}
+
+func TestIngressUnderStripPrefix(t *testing.T) {
+	bus := New(10)
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", bus.IngressHandler(EventBusIngressOptions{})))
+
+	if rec := post(t, mux, "/api/events/order.created", ` + "`" + `{"OrderID":"1"}` + "`" + `); rec.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want 202", rec.Code)
+	}
+}
+`
+	runGeneratedTestsWith(t, orderEventsSource, func(in *model.GenerateInput) { in.HTTP = true }, testFile)
+}
+
+func TestIntegration_SSEHandler(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func subscriberCount(bus *EventBus, event Event) int {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	return len(bus.subscribers[event])
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSSEStreamsSelectedEvents(t *testing.T) {
+	bus := New(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	srv := httptest.NewServer(bus.SSEHandler(EventBusSSEOptions{}))
+	defer srv.Close()
+
+	reqCtx, stop := context.WithCancel(ctx)
+	req, _ := http.NewRequestWithContext(reqCtx, http.MethodGet, srv.URL+"?event=order.shipped", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	waitFor(t, "SSE subscription", func() bool { return subscriberCount(bus, EventOrderShipped) == 1 })
+	if n := subscriberCount(bus, EventOrderCreated); n != 0 {
+		t.Errorf("unselected event has %d subscribers", n)
+	}
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "skip"})
+	bus.PublishOrderShipped(OrderShipped{OrderID: "1", TrackingNo: "T1"})
+
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		if line = strings.TrimSuffix(line, "\n"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if !strings.HasPrefix(lines[0], "id: ") || lines[1] != "event: order.shipped" ||
+		lines[2] != ` + "`" + `data: {"OrderID":"1","TrackingNo":"T1"}` + "`" + ` {
+		t.Errorf("stream = %q", lines)
+	}
+
+	stop()
+	waitFor(t, "unsubscribe", func() bool { return subscriberCount(bus, EventOrderShipped) == 0 })
+}
+
+func TestSSERejectsUnknownEvents(t *testing.T) {
+	h := New(10).SSEHandler(EventBusSSEOptions{Events: []Event{EventOrderCreated}})
+	for _, query := range []string{"?event=order.lost", "?event=order.created,order.shipped"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+// blockingWriter is a ResponseWriter whose writes block until released,
+// simulating a client that stopped reading.
+type blockingWriter struct {
+	header  http.Header
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingWriter) Header() http.Header { return w.header }
+func (w *blockingWriter) WriteHeader(int)     {}
+func (w *blockingWriter) Flush()              {}
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestSSEDropsSlowClient(t *testing.T) {
+	bus := New(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	var mu sync.Mutex
+	drops := 0
+	bus.OnDrop(func(Event, any) {
+		mu.Lock()
+		drops++
+		mu.Unlock()
+	})
+
+	w := &blockingWriter{header: http.Header{}, release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		bus.SSEHandler(EventBusSSEOptions{Buffer: 1}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+	waitFor(t, "SSE subscription", func() bool { return subscriberCount(bus, EventOrderCreated) == 1 })
+
+	// The first event blocks in Write, the second fills the buffer and the
+	// third overflows it.
+	for _, id := range []string{"1", "2", "3"} {
+		bus.PublishOrderCreated(OrderCreated{OrderID: id})
+	}
+	waitFor(t, "drop", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return drops > 0
+	})
+	close(w.release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("slow client was not disconnected")
+	}
+	if n := subscriberCount(bus, EventOrderCreated); n != 0 {
+		t.Errorf("%d subscribers left after disconnect", n)
+	}
+}
+`
+	runGeneratedTestsWith(t, orderEventsSource, func(in *model.GenerateInput) { in.HTTP = true }, testFile)
+}
+
+func TestIntegration_Tap(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+type tapLine struct {
+	Event       Event
+	Payload     map[string]string
+	Outcome     string
+	Subscribers int
+	Panic       string
+}
+
+func TestTapWritesOutcomes(t *testing.T) {
+	bus := New(1)
+	bus.SubscribeOrderShipped(func(OrderShipped) { panic("boom") })
+
+	var out lockedBuffer
+	bus.Tap(&out, EventBusTapOptions{Events: []Event{EventOrderShipped}, Redact: []string{"TrackingNo"}})
+
+	bus.PublishOrderShipped(OrderShipped{OrderID: "1", TrackingNo: "T1"})
+	bus.PublishOrderShipped(OrderShipped{OrderID: "2", TrackingNo: "T2"}) // queue full
+	bus.PublishOrderCreated(OrderCreated{OrderID: "3"})                   // filtered out
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	deadline := time.Now().Add(time.Second)
+	for len(out.lines()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tap wrote %q", out.lines())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	want := []struct{ id, outcome string }{{"1", "published"}, {"2", "dropped"}, {"1", "panic"}}
+	lines := out.lines()
+	if len(lines) != len(want) {
+		t.Fatalf("tap wrote %d lines, want %d: %q", len(lines), len(want), lines)
+	}
+	for i, line := range lines {
+		var got tapLine
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if got.Event != EventOrderShipped || got.Outcome != want[i].outcome || got.Payload["OrderID"] != want[i].id {
+			t.Errorf("line %d = %s", i, line)
+		}
+		if got.Payload["TrackingNo"] != "[REDACTED]" {
+			t.Errorf("line %d: TrackingNo not redacted: %s", i, line)
+		}
+		if got.Subscribers != 1 {
+			t.Errorf("line %d: subscribers = %d, want 1", i, got.Subscribers)
+		}
+	}
+	if got := lines[2]; !strings.Contains(got, ` + "`" + `"panic":"boom"` + "`" + `) {
+		t.Errorf("panic line = %s", got)
+	}
+}
+
+func TestTapStop(t *testing.T) {
+	bus := New(10)
+
+	var out lockedBuffer
+	stop := bus.Tap(&out, EventBusTapOptions{})
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+
+	stop()
+	stop() // stopping twice is a no-op
+	bus.PublishOrderCreated(OrderCreated{OrderID: "2"})
+
+	if lines := out.lines(); len(lines) != 1 || !strings.Contains(lines[0], ` + "`" + `"OrderID":"1"` + "`" + `) {
+		t.Errorf("tap wrote %q, want only the event published before stop", lines)
+	}
+
+	bus.hookMu.RLock()
+	defer bus.hookMu.RUnlock()
+	if n := len(bus.onPublish) + len(bus.onDrop) + len(bus.onPanic); n != 0 {
+		t.Errorf("%d hooks left after stop, want 0", n)
+	}
+}
+`
+	runGeneratedTests(t, orderEventsSource, testFile)
+}
+
+func TestIntegration_Redaction(t *testing.T) {
+	source := `package demo
+
+type Contact struct {
+	Name  string
+	Phone string ` + "`" + `gobusgen:"redact"` + "`" + `
+}
+
+type UserRegistered struct {
+	UserID   string
+	Email    string ` + "`" + `json:"email" gobusgen:"redact"` + "`" + `
+	Contacts []Contact
+	Manager  *Contact
+	Devices  map[string][1]Contact
+}
+
+type OrderPlaced struct {
+	OrderID string
+}
+
+var Events = map[string]any{
+	"user.registered": UserRegistered{},
+	"order.placed":    OrderPlaced{},
+}
+`
+
+	testFile := `package demo
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedactedCopy(t *testing.T) {
+	p := UserRegistered{
+		UserID:   "u1",
+		Email:    "a@example.com",
+		Contacts: []Contact{{Name: "c1", Phone: "555-0101"}},
+		Manager:  &Contact{Name: "m1", Phone: "555-0102"},
+		Devices:  map[string][1]Contact{"d1": {{Name: "d1", Phone: "555-0103"}}},
+	}
+	want := UserRegistered{
+		UserID:   "u1",
+		Contacts: []Contact{{Name: "c1"}},
+		Manager:  &Contact{Name: "m1"},
+		Devices:  map[string][1]Contact{"d1": {{Name: "d1"}}},
+	}
+	if got, changed := eventBusRedactUserRegistered(p); !reflect.DeepEqual(got, want) || !changed {
+		t.Errorf("eventBusRedactUserRegistered() = %+v, %v; want %+v, true", got, changed, want)
+	}
+	if got := EventBusRedact(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("EventBusRedact() = %+v, want %+v", got, want)
+	}
+	if got := EventBusRedact([]any{p, OrderPlaced{OrderID: "o1"}}); !reflect.DeepEqual(got, []any{want, OrderPlaced{OrderID: "o1"}}) {
+		t.Errorf("EventBusRedact(batch) = %+v", got)
+	}
+	if p.Email == "" || p.Contacts[0].Phone == "" || p.Manager.Phone == "" || p.Devices["d1"][0].Phone == "" {
+		t.Errorf("redaction modified the original: %+v", p)
+	}
+	if got, changed := eventBusRedactUserRegistered(UserRegistered{UserID: "u2"}); !reflect.DeepEqual(got, UserRegistered{UserID: "u2"}) || changed {
+		t.Errorf("redacting nil nested values = %+v, %v; want unchanged", got, changed)
+	}
+}
+
+func TestFileSinkMarksOnlyRemovedFields(t *testing.T) {
+	sink := NewFileDeadLetterSink(filepath.Join(t.TempDir(), "dead.jsonl"))
+	for _, p := range []UserRegistered{
+		{UserID: "u1", Email: "a@example.com"},
+		{UserID: "u2"},
+	} {
+		if err := sink.Put(DeadLetter{Event: EventUserRegistered, Payload: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	letters, err := sink.Take(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 || !letters[0].Redacted || letters[1].Redacted {
+		t.Errorf("letters = %+v; want only the first marked Redacted", letters)
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBatchPanicRedacted(t *testing.T) {
+	bus := New(10)
+
+	var tap lockedBuffer
+	bus.Tap(&tap, EventBusTapOptions{})
+
+	bus.SubscribeUserRegisteredBatch(1, 0, func([]UserRegistered) { panic("boom") })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	bus.PublishUserRegistered(UserRegistered{UserID: "u1", Email: "a@example.com"})
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(tap.String(), ` + "`" + `"outcome":"panic"` + "`" + `) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the panic record: %q", tap.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if out := tap.String(); strings.Contains(out, "a@example.com") {
+		t.Errorf("tap leaked the email of a panicking batch: %s", out)
+	}
+}
+
+func TestSinksRedact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	bus := New(10, EventBusWithDeadLetterSink(NewFileDeadLetterSink(path)))
+
+	var tap lockedBuffer
+	bus.Tap(&tap, EventBusTapOptions{})
+
+	delivered := make(chan UserRegistered, 1)
+	bus.SubscribeUserRegistered(func(p UserRegistered) {
+		delivered <- p
+		panic("boom")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	bus.PublishUserRegistered(UserRegistered{UserID: "u1", Email: "a@example.com", Manager: &Contact{Phone: "555-0102"}})
+	if got := <-delivered; got.Email != "a@example.com" {
+		t.Errorf("subscriber got Email %q, want the original", got.Email)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if strings.Count(tap.String(), "\n") >= 2 && len(data) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out: tap %q, dead letters %q", tap.String(), data)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	data, _ := os.ReadFile(path)
+	for name, out := range map[string]string{"tap": tap.String(), "dead letters": string(data)} {
+		if strings.Contains(out, "a@example.com") || strings.Contains(out, "555-0102") {
+			t.Errorf("%s leaked a redacted field: %s", name, out)
+		}
+		if !strings.Contains(out, ` + "`" + `"UserID":"u1"` + "`" + `) {
+			t.Errorf("%s lost unredacted fields: %s", name, out)
+		}
+	}
+	if !strings.Contains(string(data), ` + "`" + `"redacted":true` + "`" + `) {
+		t.Errorf("dead letter not marked redacted: %s", data)
+	}
+
+	n, err := bus.Redrive(ctx, nil)
+	if err != nil || n != 0 {
+		t.Errorf("Redrive() = %d, %v; want 0, nil", n, err)
+	}
+	letters, err := bus.DeadLetterSink().Take(nil)
+	if err != nil || len(letters) != 1 || !letters[0].Redacted {
+		t.Errorf("sink after Redrive = %+v, %v; want the redacted letter", letters, err)
+	}
+}
+`
+	runGeneratedTests(t, source, testFile)
+}
+
+// TestIntegration_RedactionForeignPackage verifies that tagged fields of
+// payload field types declared in another package are redacted.
+func TestIntegration_RedactionForeignPackage(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"go.mod": "module demo\n\ngo 1.23\n",
+		"contact/contact.go": `package contact
+
+type Card struct {
+	Name  string
+	Email string ` + "`" + `gobusgen:"redact"` + "`" + `
+}
+`,
+		"events.go": `package demo
+
+import "demo/contact"
+
+type UserRegistered struct {
+	UserID string
+	Cards  []contact.Card
+}
+
+var Events = map[string]any{
+	"user.registered": UserRegistered{},
+}
+`,
+		"eventbus_test.go": `package demo
+
+import (
+	"testing"
+
+	"demo/contact"
+)
+
+func TestRedactForeignField(t *testing.T) {
+	p := UserRegistered{UserID: "u1", Cards: []contact.Card{{Name: "a", Email: "a@example.com"}}}
+	got := EventBusRedact(p).(UserRegistered)
+	if got.Cards[0] != (contact.Card{Name: "a"}) {
+		t.Errorf("Cards[0] = %+v, want the email redacted", got.Cards[0])
+	}
+	if p.Cards[0].Email != "a@example.com" {
+		t.Error("redaction modified the original")
+	}
+}
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	input, err := parser.Parse(dir, "Events")
+	if err != nil {
+		t.Fatalf("parser.Parse: %v", err)
+	}
+
+	src, err := generator.Generate(input)
+	if err != nil {
+		t.Fatalf("generator.Generate: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "eventbus.gen.go"), src, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("go", "test", "-count=1", "./...")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("runtime tests failed:\n%s\n%v", out, err)
+	}
+}
+
+func TestIntegration_DebugHandler(t *testing.T) {
+	testFile := `package demo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type debugState struct {
+	QueueDepth    int ` + "`" + `json:"queue_depth"` + "`" + `
+	QueueCapacity int ` + "`" + `json:"queue_capacity"` + "`" + `
+	Events        []struct {
+		Name        Event
+		Subscribers []string
+		Published   int
+		Dropped     int
+		Panics      int
+	}
+	Recent, Drops, Panics []struct {
+		ID      string
+		Event   Event
+		Payload OrderCreated
+		Panic   string
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	bus := New(1)
+	bus.SubscribeOrderCreated(func(OrderCreated) { panic("boom") })
+	h := bus.DebugHandler()
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	bus.PublishOrderCreated(OrderCreated{OrderID: "2"}) // queue full
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var state debugState
+	if err := json.Unmarshal(get("*/*").Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.QueueDepth != 1 || state.QueueCapacity != 1 {
+		t.Errorf("queue = %d/%d, want 1/1", state.QueueDepth, state.QueueCapacity)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Start(ctx)
+
+	deadline := time.Now().Add(time.Second)
+	for len(state.Panics) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for panic")
+		}
+		time.Sleep(time.Millisecond)
+		state = debugState{}
+		if err := json.Unmarshal(get("application/json").Body.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(state.Events) != 2 || state.Events[0].Name != EventOrderCreated {
+		t.Fatalf("events = %+v", state.Events)
+	}
+	created := state.Events[0]
+	if created.Published != 1 || created.Dropped != 1 || created.Panics != 1 || len(created.Subscribers) != 1 {
+		t.Errorf("order.created = %+v", created)
+	}
+	if len(state.Recent) != 1 || state.Recent[0].ID == "" || state.Recent[0].Payload.OrderID != "1" {
+		t.Errorf("recent = %+v", state.Recent)
+	}
+	if len(state.Drops) != 1 || state.Drops[0].Payload.OrderID != "2" {
+		t.Errorf("drops = %+v", state.Drops)
+	}
+	if state.Panics[0].Panic != "boom" {
+		t.Errorf("panics = %+v", state.Panics)
+	}
+
+	page := get("text/html,application/xhtml+xml")
+	if ct := page.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if body := page.Body.String(); !strings.Contains(body, "<td>order.created</td><td>1</td><td>1</td><td>1</td>") ||
+		!strings.Contains(body, "{&#34;OrderID&#34;:&#34;1&#34;}") {
+		t.Errorf("html page = %s", body)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", rec.Code)
+	}
+}
+
+func TestDebugHandlerBuiltOnce(t *testing.T) {
+	bus := New(10)
+	first := bus.DebugHandler()
+
+	bus.hookMu.RLock()
+	hooks := len(bus.onEnqueue) + len(bus.onDrop) + len(bus.onPanic)
+	bus.hookMu.RUnlock()
+
+	bus.PublishOrderCreated(OrderCreated{OrderID: "1"})
+	second := bus.DebugHandler()
+
+	bus.hookMu.RLock()
+	defer bus.hookMu.RUnlock()
+	if n := len(bus.onEnqueue) + len(bus.onDrop) + len(bus.onPanic); n != hooks {
+		t.Errorf("second DebugHandler call registered %d more hooks", n-hooks)
+	}
+
+	// Both handlers report the counts gathered since the first call.
+	for i, h := range []http.Handler{first, second} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		var state debugState
+		if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+		if state.Events[0].Published != 1 {
+			t.Errorf("handler %d: order.created published = %d, want 1", i, state.Events[0].Published)
+		}
+	}
+}
+`
+	runGeneratedTestsWith(t, orderEventsSource, func(in *model.GenerateInput) { in.HTTP = true }, testFile)
+}
@@ -1,6 +1,8 @@
 package generator
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -14,6 +16,63 @@ func lowerFirst(s string) string {
 	return strings.ToLower(s[:1]) + s[1:]
 }
 
+// jsonTag returns a backtick-quoted json struct tag. The template is a raw
+// string literal and cannot contain backticks itself.
+func jsonTag(s string) string {
+	return "`json:\"" + s + "\"`"
+}
+
+// redactCode returns the statements that set the fields tagged
+// gobusgen:"redact" inside the addressable value expr to their zero values
+// with the generic zero helper, recording in the local variable changed
+// whether any of them was not zero already. Nested pointers, slices and maps
+// are copied before they are changed, so the caller's payload is never
+// modified.
+func redactCode(zero, expr string, v *model.RedactValue) string {
+	var (
+		b    strings.Builder
+		vars int
+	)
+	writeRedact(&b, zero, expr, v, &vars)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// writeRedact writes the statements for redactCode. vars counts the local
+// variables declared so far so that each one gets a unique name.
+func writeRedact(b *strings.Builder, zero, expr string, v *model.RedactValue, vars *int) {
+	n := strconv.Itoa(*vars)
+	if v.Kind != model.RedactStruct {
+		*vars++
+	}
+
+	switch v.Kind {
+	case model.RedactStruct:
+		for _, f := range v.Fields {
+			if f.Value == nil {
+				fmt.Fprintf(b, "changed = %s(&%s.%s) || changed\n", zero, expr, f.Name)
+				continue
+			}
+			writeRedact(b, zero, expr+"."+f.Name, f.Value, vars)
+		}
+	case model.RedactPointer:
+		fmt.Fprintf(b, "if %s != nil {\nv%s := *%s\n", expr, n, expr)
+		writeRedact(b, zero, "v"+n, v.Elem, vars)
+		fmt.Fprintf(b, "%s = &v%s\n}\n", expr, n)
+	case model.RedactSlice:
+		fmt.Fprintf(b, "s%s := append(%s[:0:0], %s...)\nfor i%s := range s%s {\n", n, expr, expr, n, n)
+		writeRedact(b, zero, "s"+n+"[i"+n+"]", v.Elem, vars)
+		fmt.Fprintf(b, "}\n%s = s%s\n", expr, n)
+	case model.RedactArray:
+		fmt.Fprintf(b, "for i%s := range %s {\n", n, expr)
+		writeRedact(b, zero, expr+"[i"+n+"]", v.Elem, vars)
+		b.WriteString("}\n")
+	case model.RedactMap:
+		fmt.Fprintf(b, "m%s := maps.Clone(%s)\nfor k%s, v%s := range m%s {\n", n, expr, n, n, n)
+		writeRedact(b, zero, "v"+n, v.Elem, vars)
+		fmt.Fprintf(b, "m%s[k%s] = v%s\n}\n%s = m%s\n", n, n, n, expr, n)
+	}
+}
+
 func article(s string) string {
 	if s != "" {
 		switch s[0] {
@@ -21,144 +80,3359 @@ func article(s string) string {
 			return "an"
 		}
 	}
-	return "a"
+	return "a"
+}
+
+var tmpl = template.Must(template.New("eventbus").Funcs(template.FuncMap{
+	"pascalCase": model.PascalCase,
+	"lowerFirst": lowerFirst,
+	"article":    article,
+	"jsonTag":    jsonTag,
+	"redactCode": redactCode,
+}).Parse(eventBusTemplate))
+
+const eventBusTemplate = `// Code generated by gobusgen; DO NOT EDIT.
+package {{ .PackageName }}
+
+import (
+{{- if .Transport }}
+	"bufio"
+{{- end }}
+	"bytes"
+	"container/heap"
+	"context"
+{{- if .Outbox }}
+	"database/sql"
+{{- end }}
+	"encoding/json"
+	"errors"
+	"fmt"
+{{- if .HTTP }}
+	"html"
+{{- end }}
+	"io"
+	"iter"
+	"maps"
+	"math/rand/v2"
+{{- if .Transport }}
+	"net"
+{{- end }}
+{{- if .HTTP }}
+	"net/http"
+{{- end }}
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+{{- if .HTTP }}
+	"slices"
+{{- end }}
+	"strconv"
+{{- if or .HTTP .Outbox }}
+	"strings"
+{{- end }}
+	"sync"
+	"sync/atomic"
+{{- if .Transport }}
+	"syscall"
+{{- end }}
+	"time"
+)
+{{- $p := .Prefix -}}
+{{- $eventType := "Event" -}}{{- if $p -}}{{- $eventType = printf "%sEvent" $p -}}{{- end -}}
+{{- $busType := "EventBus" -}}{{- if $p -}}{{- $busType = printf "%sBus" $p -}}{{- end -}}
+{{- $ctor := "New" -}}{{- if $p -}}{{- $ctor = printf "New%sBus" $p -}}{{- end -}}
+{{- $env := printf "%sEnvelope" $eventType -}}
+{{- $envRecord := printf "%sEnvelopeRecord" (lowerFirst $busType) -}}
+{{- $newID := printf "%sNewEnvelopeID" (lowerFirst $busType) -}}
+{{- $chanQueue := printf "%sChanQueue" (lowerFirst $busType) -}}
+{{- $checkPayload := printf "%sCheckPayload" (lowerFirst $busType) -}}
+{{- $walRecord := printf "%sWALRecord" (lowerFirst $busType) -}}
+{{- $sub := printf "%sSubscription" (lowerFirst $busType) -}}
+{{- $subCfg := printf "%sSubscribeConfig" (lowerFirst $busType) -}}
+{{- $sysClock := printf "%sSystemClock" (lowerFirst $busType) -}}
+{{- $schedHeap := printf "%sScheduleHeap" (lowerFirst $busType) -}}
+{{- $scheduled := printf "Scheduled%s" $eventType -}}
+{{- $funcName := printf "%sFuncName" (lowerFirst $busType) -}}
+{{- $dlRecord := printf "%sDeadLetterRecord" (lowerFirst $busType) -}}
+{{- $hook := printf "%sHook" (lowerFirst $busType) -}}
+{{- $addHook := printf "%sAddHook" (lowerFirst $busType) -}}
+{{- $ackRecord := printf "%sTransportAck" (lowerFirst $busType) -}}
+{{- $tapRecord := printf "%sTapRecord" (lowerFirst $busType) -}}
+{{- $redactJSON := printf "%sRedactJSON" (lowerFirst $busType) -}}
+{{- $redactPayload := printf "%sRedactPayload" (lowerFirst $busType) -}}
+{{- $redactExported := printf "%sRedact" $busType -}}
+{{- $redact := printf "%sRedact" (lowerFirst $busType) -}}
+{{- $redactZero := printf "%sRedactZero" (lowerFirst $busType) -}}
+{{- $debugRecent := printf "%sDebugRecent" (lowerFirst $busType) -}}
+{{- $debugEntry := printf "%sDebugEntry" (lowerFirst $busType) -}}
+{{- $debugEvent := printf "%sDebugEvent" (lowerFirst $busType) -}}
+{{- $debugSnapshot := printf "%sDebugSnapshot" (lowerFirst $busType) -}}
+{{- $debugHTML := printf "%sWriteDebugHTML" (lowerFirst $busType) -}}
+{{- $syncFile := printf "%sWriteFileSync" (lowerFirst $busType) -}}
+{{- $syncDir := printf "%sSyncDir" (lowerFirst $busType) -}}
+{{- $txKey := printf "%sTxContextKey" (lowerFirst $busType) -}}
+{{- $subsMap := "newSubscribersMap" -}}{{- if $p -}}{{- $subsMap = printf "new%sBusSubscribersMap" $p -}}{{- end }}
+
+// {{ $eventType }} represents a typed event name.
+type {{ $eventType }} string
+
+const (
+{{- range .Events }}
+	{{ $pc := pascalCase .Name -}}
+	{{ $eventType }}{{ $pc }} {{ $eventType }} = "{{ .Name }}"
+{{- end }}
+)
+
+var (
+	// ErrUnknown{{ $eventType }} is returned for event names this bus does not declare.
+	ErrUnknown{{ $eventType }} = errors.New("unknown event")
+	// Err{{ $p }}Dropped is returned when an event is dropped because the queue is full.
+	Err{{ $p }}Dropped = errors.New("event dropped: queue is full")
+	// Err{{ $p }}PayloadType is returned when a payload does not have the type declared for its event.
+	Err{{ $p }}PayloadType = errors.New("wrong payload type")
+	// Err{{ $busType }}TxDone is returned when a {{ $busType }}Tx is used after Commit or Rollback.
+	Err{{ $busType }}TxDone = errors.New("transaction has already been committed or rolled back")
+)
+
+// All{{ $eventType }}s returns every declared event, sorted by name.
+func All{{ $eventType }}s() []{{ $eventType }} {
+	return []{{ $eventType }}{
+{{- range .Events }}
+		{{ $eventType }}{{ pascalCase .Name }},
+{{- end }}
+	}
+}
+
+// Parse{{ $eventType }} returns the event named s. It returns
+// ErrUnknown{{ $eventType }} if no such event is declared.
+func Parse{{ $eventType }}(s string) ({{ $eventType }}, error) {
+	event := {{ $eventType }}(s)
+	if !event.Valid() {
+		return "", fmt.Errorf("%w: %q", ErrUnknown{{ $eventType }}, s)
+	}
+	return event, nil
+}
+
+// Valid reports whether e is a declared event.
+func (e {{ $eventType }}) Valid() bool {
+	switch e {
+	case {{ range $i, $e := .Events }}{{ if $i }}, {{ end }}{{ $eventType }}{{ pascalCase $e.Name }}{{ end }}:
+		return true
+	}
+	return false
+}
+
+// PayloadType returns the payload type declared for e, or nil if e is not a
+// declared event.
+func (e {{ $eventType }}) PayloadType() reflect.Type {
+	switch e {
+{{- range .Events }}
+	case {{ $eventType }}{{ pascalCase .Name }}:
+		return reflect.TypeOf((*{{ .PayloadType }})(nil)).Elem()
+{{- end }}
+	}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler. Unknown events are rejected.
+func (e {{ $eventType }}) MarshalText() ([]byte, error) {
+	if !e.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrUnknown{{ $eventType }}, string(e))
+	}
+	return []byte(e), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Unknown events are rejected.
+func (e *{{ $eventType }}) UnmarshalText(text []byte) error {
+	event, err := Parse{{ $eventType }}(string(text))
+	if err != nil {
+		return err
+	}
+	*e = event
+	return nil
+}
+
+// {{ $busType }} provides type-safe publish/subscribe for in-process events.
+type {{ $busType }} struct {
+	mu          sync.RWMutex
+	subscribers map[{{ $eventType }}][]*{{ $sub }}
+	nextID      uint64
+	eventOpts   map[{{ $eventType }}][]{{ $busType }}SubscribeOption
+	queue       {{ $busType }}Queue
+	clock       {{ $busType }}Clock
+	deadLetters {{ $p }}DeadLetterSink
+
+	schedMu      sync.Mutex
+	schedule     {{ $schedHeap }}
+	schedTimer   {{ $busType }}Timer
+	schedStopped bool
+
+	hookMu      sync.RWMutex
+	onPublish   []{{ $hook }}[func({{ $eventType }}, any)]
+	onDrop      []{{ $hook }}[func({{ $eventType }}, any)]
+	onSubscribe []func({{ $eventType }})
+	onPanic     []{{ $hook }}[func({{ $eventType }}, any, any)]
+	onRetry     []func({{ $eventType }}, any, error, int)
+	onGiveUp    []func({{ $eventType }}, any, error, int)
+	onStop      []func()
+	onEnqueue   []{{ $hook }}[func({{ $env }})]
+	nextHookID  uint64
+{{- if .HTTP }}
+
+	debugOnce    sync.Once
+	debugHandler http.Handler
+{{- end }}
+}
+
+// {{ $hook }} is a registered hook with an ID, so that hooks the bus adds for
+// itself can be removed again.
+type {{ $hook }}[F any] struct {
+	id uint64
+	fn F
+}
+
+// {{ $p }}Publisher publishes every event declared for {{ $busType }}.
+// Depend on it instead of *{{ $busType }} to substitute a fake in tests.
+type {{ $p }}Publisher interface {
+{{- range .Events }}
+	Publish{{ pascalCase .Name }}(payload {{ .PayloadType }})
+{{- end }}
+}
+
+// {{ $p }}Subscriber subscribes to every event declared for {{ $busType }}.
+type {{ $p }}Subscriber interface {
+{{- range .Events }}
+	Subscribe{{ pascalCase .Name }}(fn func({{ .PayloadType }}), opts ...{{ $busType }}SubscribeOption)
+{{- end }}
+}
+{{ range .Events }}
+{{ $pc := pascalCase .Name -}}
+// {{ $p }}{{ $pc }}Publisher publishes {{ .Name }} events. Services that emit a
+// single event can depend on it instead of {{ $p }}Publisher.
+type {{ $p }}{{ $pc }}Publisher interface {
+	Publish{{ $pc }}(payload {{ .PayloadType }})
+}
+
+// {{ $p }}{{ $pc }}MetadataPublisher publishes {{ .Name }} events with
+// metadata. It is the destination type of Forward{{ $pc }}.
+type {{ $p }}{{ $pc }}MetadataPublisher interface {
+	Publish{{ $pc }}WithMetadata(payload {{ .PayloadType }}, md map[string]string)
+}
+{{ end }}
+var (
+	_ {{ $p }}Publisher  = (*{{ $busType }})(nil)
+	_ {{ $p }}Subscriber = (*{{ $busType }})(nil)
+)
+
+// {{ $env }} is a published event as it travels through the bus queue.
+type {{ $env }} struct {
+	ID      string
+	Time    time.Time
+	Event   {{ $eventType }}
+	Payload any
+	// Metadata carries caller-defined values such as trace or tenant IDs
+	// alongside the payload. It is nil unless set with a WithMetadata method.
+	Metadata map[string]string
+	// Subscriber, when set, limits delivery to the subscriptions with this
+	// name. Redrive sets it so that a dead letter is delivered again only to
+	// the subscriber that failed.
+	Subscriber string
+{{- if .Transport }}
+
+	// received is set on envelopes accepted by ReceiveFrom so that SendTo
+	// does not send them back to another process.
+	received bool
+{{- end }}
+}
+
+type {{ $envRecord }} struct {
+	ID      string          {{ jsonTag "id" }}
+	Time    time.Time       {{ jsonTag "time" }}
+	Event    {{ $eventType }}     {{ jsonTag "event" }}
+	Payload  json.RawMessage   {{ jsonTag "payload" }}
+	Metadata map[string]string {{ jsonTag "metadata,omitempty" }}
+	Subscriber string          {{ jsonTag "subscriber,omitempty" }}
+}
+
+// MarshalJSON encodes the envelope with its payload as JSON.
+func (env {{ $env }}) MarshalJSON() ([]byte, error) {
+	payload, err := json.Marshal(env.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal({{ $envRecord }}{
+		ID:       env.ID,
+		Time:     env.Time,
+		Event:    env.Event,
+		Payload:    payload,
+		Metadata:   env.Metadata,
+		Subscriber: env.Subscriber,
+	})
+}
+
+// UnmarshalJSON decodes an envelope, restoring the payload type of its event.
+func (env *{{ $env }}) UnmarshalJSON(data []byte) error {
+	var rec {{ $envRecord }}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+
+	payload, err := Decode{{ $eventType }}(rec.Event, rec.Payload)
+	if err != nil {
+		return err
+	}
+
+	*env = {{ $env }}{
+		ID:       rec.ID,
+		Time:     rec.Time,
+		Event:    rec.Event,
+		Payload:    payload,
+		Metadata:   rec.Metadata,
+		Subscriber: rec.Subscriber,
+	}
+	return nil
+}
+
+// {{ $busType }}Queue holds published envelopes until the Start loop dispatches them.
+type {{ $busType }}Queue interface {
+	// Push enqueues env without blocking and reports false when the queue is full.
+	Push(env {{ $env }}) bool
+	// Pop blocks until an envelope is available. It returns an error only
+	// once ctx is done.
+	Pop(ctx context.Context) ({{ $env }}, error)
+	// Ack reports that env has been dispatched to every subscriber.
+	Ack(env {{ $env }}) error
+	// Len returns the number of envelopes waiting to be dispatched.
+	Len() int
+	// Cap returns the number of envelopes the queue accepts before it is full.
+	Cap() int
+}
+
+// {{ $chanQueue }} is the default in-memory queue backed by a buffered channel.
+type {{ $chanQueue }} struct {
+	ch chan {{ $env }}
+}
+
+func (q {{ $chanQueue }}) Push(env {{ $env }}) bool {
+	select {
+	case q.ch <- env:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q {{ $chanQueue }}) Pop(ctx context.Context) ({{ $env }}, error) {
+	select {
+	case <-ctx.Done():
+		return {{ $env }}{}, ctx.Err()
+	case env := <-q.ch:
+		return env, nil
+	}
+}
+
+func (q {{ $chanQueue }}) Ack({{ $env }}) error { return nil }
+
+func (q {{ $chanQueue }}) Len() int { return len(q.ch) }
+
+func (q {{ $chanQueue }}) Cap() int { return cap(q.ch) }
+
+// {{ $busType }}FileQueue is a queue backed by a write-ahead log. Every envelope is
+// appended and synced to the log before Push returns, and acknowledged once
+// dispatched. Envelopes that were never acknowledged, for example because the
+// process crashed, are loaded again when the log is reopened and dispatched
+// first once Start runs. The log is rewritten to hold only unacknowledged
+// envelopes when it is reopened and once enough acknowledgements pile up.
+type {{ $busType }}FileQueue struct {
+	mu      sync.Mutex
+	f       *os.File
+	path    string
+	size    int
+	pending []{{ $env }}
+	unacked map[string]{{ $env }}
+	order   []string // IDs of logged envelopes in push order
+	acks    int      // ack lines written since the log was last rewritten
+	// compactAt is the number of ack lines after which Ack rewrites the log,
+	// provided they outnumber the unacknowledged envelopes.
+	compactAt int
+	notify    chan struct{}
+}
+
+type {{ $walRecord }} struct {
+	Ack      string       {{ jsonTag "ack,omitempty" }}
+	Envelope *{{ $env }} {{ jsonTag "envelope,omitempty" }}
+}
+
+// Open{{ $busType }}FileQueue opens or creates the write-ahead log at path. The queue
+// accepts up to size new envelopes; envelopes recovered from the log are
+// always loaded.
+func Open{{ $busType }}FileQueue(path string, size int) (*{{ $busType }}FileQueue, error) {
+	if size < 1 {
+		size = 1
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading queue log: %w", err)
+	}
+
+	var (
+		order []{{ $env }}
+		acked = map[string]bool{}
+	)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var rec {{ $walRecord }}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("decoding queue log line %d: %w", i+1, err)
+		}
+		if rec.Envelope != nil {
+			order = append(order, *rec.Envelope)
+		}
+		if rec.Ack != "" {
+			acked[rec.Ack] = true
+		}
+	}
+
+	q := &{{ $busType }}FileQueue{
+		path:      path,
+		size:      size,
+		unacked:   map[string]{{ $env }}{},
+		compactAt: 1024,
+		notify:    make(chan struct{}, 1),
+	}
+
+	for _, env := range order {
+		if acked[env.ID] {
+			continue
+		}
+		q.pending = append(q.pending, env)
+		q.unacked[env.ID] = env
+		q.order = append(q.order, env.ID)
+	}
+	if err := q.compact(); err != nil {
+		if q.f != nil {
+			_ = q.f.Close()
+		}
+		return nil, err
+	}
+	if len(q.pending) > 0 {
+		q.notify <- struct{}{}
+	}
+
+	return q, nil
+}
+
+// Push appends env to the log and enqueues it. It reports false when the
+// queue is full or the log cannot be written.
+func (q *{{ $busType }}FileQueue) Push(env {{ $env }}) bool {
+	line, err := json.Marshal({{ $walRecord }}{Envelope: &env})
+	if err != nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) >= q.size || q.append(line) != nil {
+		return false
+	}
+	q.pending = append(q.pending, env)
+	q.unacked[env.ID] = env
+	q.order = append(q.order, env.ID)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Pop returns the oldest envelope, blocking until one is available.
+func (q *{{ $busType }}FileQueue) Pop(ctx context.Context) ({{ $env }}, error) {
+	for {
+		q.mu.Lock()
+		if len(q.pending) > 0 {
+			env := q.pending[0]
+			q.pending[0] = {{ $env }}{}
+			q.pending = q.pending[1:]
+			q.mu.Unlock()
+			return env, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return {{ $env }}{}, ctx.Err()
+		case <-q.notify:
+		}
+	}
+}
+
+// Ack records that env was dispatched. The log is truncated once every
+// envelope in it has been acknowledged, and rewritten without the
+// acknowledged envelopes once compactAt ack lines have been written since the
+// last rewrite and outnumber the envelopes still waiting.
+func (q *{{ $busType }}FileQueue) Ack(env {{ $env }}) error {
+	line, err := json.Marshal({{ $walRecord }}{Ack: env.ID})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.unacked, env.ID)
+	if len(q.unacked) == 0 {
+		if err := q.f.Truncate(0); err != nil {
+			return err
+		}
+		q.order = q.order[:0]
+		q.acks = 0
+		return q.f.Sync()
+	}
+
+	q.acks++
+	if q.acks >= q.compactAt && q.acks > len(q.unacked) {
+		return q.compact()
+	}
+	return q.append(line)
+}
+
+// Len returns the number of envelopes waiting to be dispatched.
+func (q *{{ $busType }}FileQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Cap returns the number of envelopes the queue accepts before it is full.
+func (q *{{ $busType }}FileQueue) Cap() int {
+	return q.size
+}
+
+// Close closes the log file.
+func (q *{{ $busType }}FileQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.f.Close()
+}
+
+// compact rewrites the log to hold only the unacknowledged envelopes, in push
+// order, and switches appends to the new log. The new log is written to a
+// temporary file and synced before the rename, then the directory is synced
+// so the rename itself is durable. A crash at any point leaves either the old
+// or the new log in place.
+func (q *{{ $busType }}FileQueue) compact() error {
+	var (
+		buf   bytes.Buffer
+		order = make([]string, 0, len(q.unacked))
+	)
+	for _, id := range q.order {
+		env, ok := q.unacked[id]
+		if !ok {
+			continue
+		}
+		line, err := json.Marshal({{ $walRecord }}{Envelope: &env})
+		if err != nil {
+			return fmt.Errorf("encoding queue log: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		order = append(order, id)
+	}
+
+	tmp := q.path + ".tmp"
+	if err := {{ $syncFile }}(tmp, buf.Bytes()); err != nil {
+		return fmt.Errorf("compacting queue log: %w", err)
+	}
+	// Open the new log before the rename so appends never go to a file
+	// that has already been replaced.
+	f, err := os.OpenFile(tmp, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening queue log: %w", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("compacting queue log: %w", err)
+	}
+
+	if q.f != nil {
+		_ = q.f.Close()
+	}
+	q.f = f
+	q.order = order
+	q.acks = 0
+
+	if err := {{ $syncDir }}(filepath.Dir(q.path)); err != nil {
+		return fmt.Errorf("compacting queue log: %w", err)
+	}
+	return nil
+}
+
+func (q *{{ $busType }}FileQueue) append(line []byte) error {
+	if _, err := q.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return q.f.Sync()
+}
+
+// {{ $syncFile }} writes data to a new file at path and syncs it to disk.
+func {{ $syncFile }}(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// {{ $syncDir }} syncs the directory at path so that renames and new
+// entries in it survive a crash.
+func {{ $syncDir }}(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// {{ $sub }} is a registered handler, named after the handler function
+// unless overridden with {{ $busType }}WithName. Handlers that can fail set handle, which
+// is wrapped into fn with the subscription's retry policy. A non-nil filter is
+// consulted before delivery, and once subscriptions remove themselves on their
+// first delivery.
+type {{ $sub }} struct {
+	id     uint64
+	name   string
+	fn     func(any)
+	handle func(any) error
+	filter func(any) bool
+	once   bool
+	fired  atomic.Bool
+	// deliver, when set, receives the whole envelope instead of fn.
+	deliver func({{ $env }})
+}
+
+// {{ $busType }}Clock abstracts time for the timer based features of the bus so tests
+// can control it. The default clock uses the time package.
+type {{ $busType }}Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) {{ $busType }}Timer
+}
+
+// {{ $busType }}Timer is a pending call scheduled by {{ $busType }}Clock.AfterFunc.
+type {{ $busType }}Timer interface {
+	Stop() bool
+}
+
+type {{ $sysClock }} struct{}
+
+func ({{ $sysClock }}) Now() time.Time { return time.Now() }
+
+func ({{ $sysClock }}) AfterFunc(d time.Duration, f func()) {{ $busType }}Timer {
+	return time.AfterFunc(d, f)
+}
+
+// {{ $busType }}Option configures {{ article $busType }} {{ $busType }} created by {{ $ctor }}.
+type {{ $busType }}Option func(*{{ $busType }})
+
+// {{ $busType }}WithDeadLetterSink sets the sink that records events whose handlers
+// panicked or gave up after retries. The default keeps the most recent 1024
+// dead letters in memory.
+func {{ $busType }}WithDeadLetterSink(sink {{ $p }}DeadLetterSink) {{ $busType }}Option {
+	return func(bus *{{ $busType }}) {
+		bus.deadLetters = sink
+	}
+}
+
+// {{ $busType }}WithQueue replaces the default channel queue, for example with a
+// {{ $busType }}FileQueue that survives restarts. The size passed to {{ $ctor }} is
+// ignored when a queue is set.
+func {{ $busType }}WithQueue(queue {{ $busType }}Queue) {{ $busType }}Option {
+	return func(bus *{{ $busType }}) {
+		bus.queue = queue
+	}
+}
+
+// {{ $busType }}WithClock sets the clock used for scheduled publishes, debouncing,
+// throttling, coalescing and batch windows.
+func {{ $busType }}WithClock(clock {{ $busType }}Clock) {{ $busType }}Option {
+	return func(bus *{{ $busType }}) {
+		bus.clock = clock
+	}
+}
+
+// {{ $ctor }} creates {{ article $busType }} {{ $busType }} whose default queue buffers up to size events.
+func {{ $ctor }}(size int, opts ...{{ $busType }}Option) *{{ $busType }} {
+	if size < 1 {
+		size = 1
+	}
+
+	bus := &{{ $busType }}{
+		subscribers: {{ $subsMap }}(),
+		eventOpts:   map[{{ $eventType }}][]{{ $busType }}SubscribeOption{},
+		queue:       {{ $chanQueue }}{ch: make(chan {{ $env }}, size)},
+		clock:       {{ $sysClock }}{},
+		deadLetters: New{{ $p }}MemoryDeadLetterSink(1024),
+	}
+	bus.onStop = append(bus.onStop, bus.stopSchedule)
+	for _, opt := range opts {
+		opt(bus)
+	}
+
+	return bus
+}
+
+// {{ $busType }}SubscribeOption configures a subscription. Options can be passed to
+// the Subscribe methods or set for every subscription to an event with Configure.
+type {{ $busType }}SubscribeOption func(*{{ $subCfg }})
+
+type {{ $subCfg }} struct {
+	name           string
+	debounce       time.Duration
+	throttle       time.Duration
+	coalesceWindow time.Duration
+	coalesceKey    func(any) string
+	coalesceEvent  {{ $eventType }}
+	retry          {{ $busType }}RetryPolicy
+}
+
+// {{ $busType }}RetryPolicy controls how handlers registered with a Subscribe...Err
+// method are retried after returning an error. Retries are scheduled on the
+// bus clock and run outside the Start loop, so they never delay other events.
+type {{ $busType }}RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after each attempt. Values below 1 default to 2.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction in either direction.
+	Jitter float64
+	// Retryable reports whether err should be retried. Nil retries every error.
+	Retryable func(err error) bool
+}
+
+func (p {{ $busType }}RetryPolicy) backoff(attempt int) time.Duration {
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+
+	d := float64(p.InitialBackoff)
+	for range attempt - 1 {
+		d *= mult
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += (rand.Float64()*2 - 1) * p.Jitter * d
+	}
+
+	return time.Duration(d)
+}
+
+// {{ $busType }}WithRetry sets the retry policy for handlers that return errors.
+func {{ $busType }}WithRetry(policy {{ $busType }}RetryPolicy) {{ $busType }}SubscribeOption {
+	return func(cfg *{{ $subCfg }}) {
+		cfg.retry = policy
+	}
+}
+
+// {{ $busType }}WithName names the subscription in dead letters and diagnostics.
+func {{ $busType }}WithName(name string) {{ $busType }}SubscribeOption {
+	return func(cfg *{{ $subCfg }}) {
+		cfg.name = name
+	}
+}
+
+// {{ $busType }}WithDebounce delivers an event only once no further event has arrived
+// for d, discarding the events it replaced (trailing edge).
+func {{ $busType }}WithDebounce(d time.Duration) {{ $busType }}SubscribeOption {
+	return func(cfg *{{ $subCfg }}) {
+		cfg.debounce = d
+	}
+}
+
+// {{ $busType }}WithThrottle delivers the first event and discards the following
+// events until d has elapsed (leading edge).
+func {{ $busType }}WithThrottle(d time.Duration) {{ $busType }}SubscribeOption {
+	return func(cfg *{{ $subCfg }}) {
+		cfg.throttle = d
+	}
+}
+
+func {{ $subsMap }}() map[{{ $eventType }}][]*{{ $sub }} {
+	return map[{{ $eventType }}][]*{{ $sub }}{
+{{- range .Events }}
+	{{ $pc := pascalCase .Name -}}
+		{{ $eventType }}{{ $pc }}: {},
+{{- end }}
+	}
+}
+
+// Start begins processing events. It blocks until ctx is cancelled, at which
+// point pending batches and held back debounced or coalesced events are
+// delivered, retries waiting for their backoff are given up and dead-lettered,
+// and scheduled events that have not been published are discarded.
+// Start may be called again after it returns; events scheduled while the bus
+// is stopped are discarded.
+func (bus *{{ $busType }}) Start(ctx context.Context) {
+	bus.schedMu.Lock()
+	bus.schedStopped = false
+	bus.schedMu.Unlock()
+
+	for {
+		env, err := bus.queue.Pop(ctx)
+		if err != nil {
+			bus.runOnStop()
+			return
+		}
+
+		bus.dispatch(env)
+		// An envelope that cannot be acknowledged is delivered again after a
+		// restart, which is the at-least-once guarantee persistent queues give.
+		_ = bus.queue.Ack(env)
+	}
+}
+
+// dispatch delivers env to every subscriber of its event, or only to those
+// named env.Subscriber when it is set.
+func (bus *{{ $busType }}) dispatch(env {{ $env }}) {
+	bus.mu.RLock()
+	subs := make([]*{{ $sub }}, len(bus.subscribers[env.Event]))
+	copy(subs, bus.subscribers[env.Event])
+	bus.mu.RUnlock()
+
+	for _, sub := range subs {
+		if env.Subscriber != "" && sub.name != env.Subscriber {
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					bus.panicked(env.Event, sub.name, env.Payload, r, 1)
+				}
+			}()
+			if sub.filter != nil && !sub.filter(env.Payload) {
+				return
+			}
+			if sub.once {
+				if !sub.fired.CompareAndSwap(false, true) {
+					return
+				}
+				bus.unsubscribe(env.Event, sub.id)
+			}
+			if sub.deliver != nil {
+				sub.deliver(env)
+				return
+			}
+			sub.fn(env.Payload)
+		}()
+	}
+}
+
+// Configure sets default subscribe options for event. They apply to every
+// handler for event registered afterwards with a Subscribe method that takes
+// options, or with SubscribeOnce, before any options passed to the method
+// itself. Batches, channels, iterators, WaitFor and the subscriptions the bus
+// makes for forwarding or streaming are not affected.
+func (bus *{{ $busType }}) Configure(event {{ $eventType }}, opts ...{{ $busType }}SubscribeOption) {
+	bus.mu.Lock()
+	bus.eventOpts[event] = append(bus.eventOpts[event], opts...)
+	bus.mu.Unlock()
+}
+
+// publish enqueues the event without blocking and reports whether it was accepted.
+func (bus *{{ $busType }}) publish(event {{ $eventType }}, payload any) bool {
+	return bus.publishEnvelope({{ $env }}{
+		ID:      {{ $newID }}(),
+		Time:    bus.clock.Now(),
+		Event:   event,
+		Payload: payload,
+	})
+}
+
+// publishEnvelope enqueues env as is, keeping its ID and time.
+func (bus *{{ $busType }}) publishEnvelope(env {{ $env }}) bool {
+	if !bus.queue.Push(env) {
+		bus.runOnDrop(env.Event, env.Payload)
+		return false
+	}
+	bus.runOnEnqueue(env)
+	bus.runOnPublish(env.Event, env.Payload)
+	return true
+}
+
+// {{ $newID }} returns a random envelope ID that is unique across restarts.
+func {{ $newID }}() string {
+	return strconv.FormatUint(rand.Uint64(), 16) + strconv.FormatUint(rand.Uint64(), 16)
+}
+
+// {{ $scheduled }} is a handle to an event scheduled for later publishing.
+type {{ $scheduled }} struct {
+	bus     *{{ $busType }}
+	event   {{ $eventType }}
+	payload any
+	at      time.Time
+	index   int
+}
+
+// At returns the time the event is scheduled to be published.
+func (s *{{ $scheduled }}) At() time.Time {
+	return s.at
+}
+
+// Cancel removes the event from the schedule. It returns false if the event
+// was already published, cancelled, or discarded at shutdown.
+func (s *{{ $scheduled }}) Cancel() bool {
+	bus := s.bus
+	bus.schedMu.Lock()
+	defer bus.schedMu.Unlock()
+
+	if s.index < 0 {
+		return false
+	}
+	heap.Remove(&bus.schedule, s.index)
+	bus.armScheduleLocked()
+	return true
+}
+
+// {{ $schedHeap }} orders scheduled events by publish time.
+type {{ $schedHeap }} []*{{ $scheduled }}
+
+func (h {{ $schedHeap }}) Len() int           { return len(h) }
+func (h {{ $schedHeap }}) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h {{ $schedHeap }}) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *{{ $schedHeap }}) Push(x any) {
+	s := x.(*{{ $scheduled }})
+	s.index = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *{{ $schedHeap }}) Pop() any {
+	old := *h
+	n := len(old)
+	s := old[n-1]
+	old[n-1] = nil
+	s.index = -1
+	*h = old[:n-1]
+	return s
+}
+
+// scheduleAt adds the event to the timer heap. Events scheduled after the bus
+// has shut down are discarded.
+func (bus *{{ $busType }}) scheduleAt(event {{ $eventType }}, payload any, at time.Time) *{{ $scheduled }} {
+	s := &{{ $scheduled }}{bus: bus, event: event, payload: payload, at: at, index: -1}
+
+	bus.schedMu.Lock()
+	defer bus.schedMu.Unlock()
+
+	if bus.schedStopped {
+		return s
+	}
+	heap.Push(&bus.schedule, s)
+	bus.armScheduleLocked()
+	return s
+}
+
+// armScheduleLocked points the single scheduler timer at the earliest event.
+func (bus *{{ $busType }}) armScheduleLocked() {
+	if bus.schedTimer != nil {
+		bus.schedTimer.Stop()
+		bus.schedTimer = nil
+	}
+	if len(bus.schedule) == 0 {
+		return
+	}
+	bus.schedTimer = bus.clock.AfterFunc(bus.schedule[0].at.Sub(bus.clock.Now()), bus.runSchedule)
+}
+
+// runSchedule publishes every event that is due and re-arms the timer.
+func (bus *{{ $busType }}) runSchedule() {
+	now := bus.clock.Now()
+
+	bus.schedMu.Lock()
+	var due []*{{ $scheduled }}
+	for len(bus.schedule) > 0 && !bus.schedule[0].at.After(now) {
+		due = append(due, heap.Pop(&bus.schedule).(*{{ $scheduled }}))
+	}
+	bus.armScheduleLocked()
+	bus.schedMu.Unlock()
+
+	for _, s := range due {
+		bus.publish(s.event, s.payload)
+	}
+}
+
+func (bus *{{ $busType }}) stopSchedule() {
+	bus.schedMu.Lock()
+	defer bus.schedMu.Unlock()
+
+	bus.schedStopped = true
+	if bus.schedTimer != nil {
+		bus.schedTimer.Stop()
+		bus.schedTimer = nil
+	}
+	for _, s := range bus.schedule {
+		s.index = -1
+	}
+	bus.schedule = nil
+}
+
+// subscribe registers a handler subscription, applying the options set with
+// Configure for event and then opts. It panics when a coalesce option for
+// another event is among them, since its key function cannot read the payload.
+func (bus *{{ $busType }}) subscribe(event {{ $eventType }}, sub *{{ $sub }}, opts ...{{ $busType }}SubscribeOption) {
+	var cfg {{ $subCfg }}
+	bus.mu.RLock()
+	for _, opt := range bus.eventOpts[event] {
+		opt(&cfg)
+	}
+	bus.mu.RUnlock()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.coalesceKey != nil && cfg.coalesceEvent != event {
+		panic(fmt.Sprintf("{{ $busType }}: coalesce option for %s used on a %s subscription", cfg.coalesceEvent, event))
+	}
+	if cfg.name != "" {
+		sub.name = cfg.name
+	}
+	if sub.handle != nil {
+		sub.fn = bus.retry(event, sub.name, cfg.retry, sub.handle)
+	}
+	sub.fn = bus.limit(event, sub.name, cfg, sub.fn)
+	bus.register(event, sub)
+}
+
+// register adds sub to the subscribers of event as is. Subscriptions the bus
+// creates for WaitFor, batches, channels, iterators, streams and forwarding
+// use it directly so that options set with Configure do not delay or drop
+// their events.
+func (bus *{{ $busType }}) register(event {{ $eventType }}, sub *{{ $sub }}) {
+	bus.mu.Lock()
+	bus.nextID++
+	sub.id = bus.nextID
+	bus.subscribers[event] = append(bus.subscribers[event], sub)
+	bus.mu.Unlock()
+	bus.runOnSubscribe(event)
+}
+
+func (bus *{{ $busType }}) unsubscribe(event {{ $eventType }}, id uint64) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	subs := bus.subscribers[event]
+	for i, sub := range subs {
+		if sub.id == id {
+			bus.subscribers[event] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// limit wraps fn with the rate limiting described by cfg. Limits compose in
+// the order coalesce, debounce, throttle. Payloads held back by coalescing or
+// debouncing are delivered from a clock timer, and any still pending when the
+// bus shuts down are delivered then.
+func (bus *{{ $busType }}) limit(event {{ $eventType }}, name string, cfg {{ $subCfg }}, fn func(any)) func(any) {
+	if cfg.throttle > 0 {
+		fn = bus.throttle(cfg.throttle, fn)
+	}
+	if cfg.debounce > 0 {
+		fn = bus.debounce(event, name, cfg.debounce, fn)
+	}
+	if cfg.coalesceWindow > 0 && cfg.coalesceKey != nil {
+		fn = bus.coalesce(event, name, cfg.coalesceWindow, cfg.coalesceKey, fn)
+	}
+	return fn
+}
+
+func (bus *{{ $busType }}) throttle(d time.Duration, fn func(any)) func(any) {
+	var (
+		mu    sync.Mutex
+		until time.Time
+	)
+
+	return func(v any) {
+		now := bus.clock.Now()
+		mu.Lock()
+		if now.Before(until) {
+			mu.Unlock()
+			return
+		}
+		until = now.Add(d)
+		mu.Unlock()
+		fn(v)
+	}
+}
+
+func (bus *{{ $busType }}) debounce(event {{ $eventType }}, name string, d time.Duration, fn func(any)) func(any) {
+	var (
+		callMu  sync.Mutex
+		mu      sync.Mutex
+		timer   {{ $busType }}Timer
+		last    any
+		pending bool
+		gen     uint64
+	)
+
+	deliver := func(want uint64, force bool) {
+		callMu.Lock()
+		defer callMu.Unlock()
+
+		mu.Lock()
+		if !pending || (!force && want != gen) {
+			mu.Unlock()
+			return
+		}
+		v := last
+		last, pending = nil, false
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		mu.Unlock()
+
+		bus.safeCall(event, name, fn, v)
+	}
+
+	bus.hookMu.Lock()
+	bus.onStop = append(bus.onStop, func() { deliver(0, true) })
+	bus.hookMu.Unlock()
+
+	return func(v any) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		last, pending = v, true
+		gen++
+		if timer != nil {
+			timer.Stop()
+		}
+		armed := gen
+		timer = bus.clock.AfterFunc(d, func() { deliver(armed, false) })
+	}
+}
+
+func (bus *{{ $busType }}) coalesce(event {{ $eventType }}, name string, window time.Duration, key func(any) string, fn func(any)) func(any) {
+	var (
+		callMu  sync.Mutex
+		mu      sync.Mutex
+		pending = map[string]any{}
+		order   []string
+	)
+
+	deliver := func(keys ...string) {
+		callMu.Lock()
+		defer callMu.Unlock()
+
+		for _, k := range keys {
+			mu.Lock()
+			v, ok := pending[k]
+			delete(pending, k)
+			mu.Unlock()
+			if ok {
+				bus.safeCall(event, name, fn, v)
+			}
+		}
+	}
+
+	bus.hookMu.Lock()
+	bus.onStop = append(bus.onStop, func() {
+		mu.Lock()
+		keys := order
+		order = nil
+		mu.Unlock()
+		deliver(keys...)
+	})
+	bus.hookMu.Unlock()
+
+	return func(v any) {
+		k := key(v)
+
+		mu.Lock()
+		_, open := pending[k]
+		pending[k] = v
+		if !open {
+			order = append(order, k)
+		}
+		mu.Unlock()
+
+		if open {
+			return
+		}
+		bus.clock.AfterFunc(window, func() {
+			mu.Lock()
+			for i, o := range order {
+				if o == k {
+					order = append(order[:i:i], order[i+1:]...)
+					break
+				}
+			}
+			mu.Unlock()
+			deliver(k)
+		})
+	}
+}
+
+// retry adapts a handler that can fail into a subscription function. Failed
+// attempts are retried on the bus clock according to policy, and the final
+// failure is reported to the OnGiveUp hooks and the dead-letter sink. Retries
+// still waiting for their backoff when the bus shuts down are given up the
+// same way, so no handler runs after Start returns.
+func (bus *{{ $busType }}) retry(event {{ $eventType }}, name string, policy {{ $busType }}RetryPolicy, handle func(any) error) func(any) {
+	type pendingRetry struct {
+		timer {{ $busType }}Timer
+		v     any
+		err   error
+		n     int
+	}
+
+	var (
+		mu      sync.Mutex
+		pending []*pendingRetry
+	)
+
+	// take removes r from pending and reports whether it was still there.
+	take := func(r *pendingRetry) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, p := range pending {
+			if p == r {
+				pending = append(pending[:i:i], pending[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+
+	if policy.MaxAttempts > 1 {
+		bus.hookMu.Lock()
+		bus.onStop = append(bus.onStop, func() {
+			mu.Lock()
+			stopped := pending
+			pending = nil
+			timers := make([]{{ $busType }}Timer, 0, len(stopped))
+			for _, r := range stopped {
+				if r.timer != nil {
+					timers = append(timers, r.timer)
+				}
+			}
+			mu.Unlock()
+
+			for _, t := range timers {
+				t.Stop()
+			}
+			for _, r := range stopped {
+				bus.runOnGiveUp(event, r.v, r.err, r.n)
+				bus.deadLetter(event, name, r.v, r.err, nil, r.n)
+			}
+		})
+		bus.hookMu.Unlock()
+	}
+
+	var attempt func(v any, n int)
+	attempt = func(v any, n int) {
+		err := handle(v)
+		if err == nil {
+			return
+		}
+
+		if n >= policy.MaxAttempts || (policy.Retryable != nil && !policy.Retryable(err)) {
+			bus.runOnGiveUp(event, v, err, n)
+			bus.deadLetter(event, name, v, err, nil, n)
+			return
+		}
+
+		bus.runOnRetry(event, v, err, n)
+		r := &pendingRetry{v: v, err: err, n: n}
+		mu.Lock()
+		pending = append(pending, r)
+		mu.Unlock()
+
+		timer := bus.clock.AfterFunc(policy.backoff(n), func() {
+			if !take(r) {
+				return // given up when the bus stopped
+			}
+			defer func() {
+				if r := recover(); r != nil {
+					bus.panicked(event, name, v, r, n+1)
+				}
+			}()
+			attempt(v, n+1)
+		})
+
+		mu.Lock()
+		r.timer = timer
+		mu.Unlock()
+	}
+
+	return func(v any) { attempt(v, 1) }
+}
+
+// safeCall invokes fn outside the Start loop, recovering a panic the same way
+// the Start loop does.
+func (bus *{{ $busType }}) safeCall(event {{ $eventType }}, name string, fn func(any), v any) {
+	defer func() {
+		if r := recover(); r != nil {
+			bus.panicked(event, name, v, r, 1)
+		}
+	}()
+	fn(v)
+}
+
+// panicked reports a recovered subscriber panic to the OnPanic hooks and the
+// dead-letter sink.
+func (bus *{{ $busType }}) panicked(event {{ $eventType }}, name string, payload any, recovered any, attempts int) {
+	bus.runOnPanic(event, payload, recovered)
+	bus.deadLetter(event, name, payload, nil, recovered, attempts)
+}
+
+func (bus *{{ $busType }}) deadLetter(event {{ $eventType }}, name string, payload any, err error, recovered any, attempts int) {
+	dl := {{ $p }}DeadLetter{
+		Time:       bus.clock.Now(),
+		Event:      event,
+		Payload:    payload,
+		Subscriber: name,
+		Attempts:   attempts,
+	}
+	if err != nil {
+		dl.Error = err.Error()
+	}
+	if recovered != nil {
+		dl.Panic = fmt.Sprint(recovered)
+	}
+	// The sink is best effort; a failing sink must not disturb delivery.
+	_ = bus.deadLetters.Put(dl)
+}
+
+func {{ $funcName }}(fn any) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+		return f.Name()
+	}
+	return ""
+}
+
+// forward registers deliver for every envelope of event. Like any
+// subscription it only receives envelopes while Start is running.
+func (bus *{{ $busType }}) forward(event {{ $eventType }}, name string, deliver func({{ $env }})) {
+	bus.register(event, &{{ $sub }}{name: name, deliver: deliver})
+}
+
+// subscribeStream registers a subscription that hands payloads to send until
+// ctx is done. When send reports a full buffer the payload is passed to the
+// OnDrop hooks. Once ctx is done the subscription is removed and closeFn is
+// called; send is never invoked after closeFn.
+func (bus *{{ $busType }}) subscribeStream(ctx context.Context, event {{ $eventType }}, send func(any) bool, closeFn func()) {
+	var (
+		mu     sync.Mutex
+		closed bool
+	)
+
+	sub := &{{ $sub }}{
+		fn: func(v any) {
+			mu.Lock()
+			sent := closed || send(v)
+			mu.Unlock()
+			if !sent {
+				bus.runOnDrop(event, v)
+			}
+		},
+	}
+	bus.register(event, sub)
+
+	go func() {
+		<-ctx.Done()
+		bus.unsubscribe(event, sub.id)
+		mu.Lock()
+		closed = true
+		closeFn()
+		mu.Unlock()
+	}()
+}
+
+// subscribeBatch registers a subscription that collects payloads and passes
+// them to flush once maxSize payloads are pending, once maxWait has elapsed
+// since the first pending payload, or when the bus shuts down. Batches are
+// flushed one at a time and in order.
+func (bus *{{ $busType }}) subscribeBatch(event {{ $eventType }}, name string, maxSize int, maxWait time.Duration, flush func([]any)) {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+
+	var (
+		flushMu sync.Mutex
+		mu      sync.Mutex
+		pending []any
+		timer   {{ $busType }}Timer
+		gen     uint64
+	)
+
+	// deliver flushes the pending batch. Timer flushes pass the generation they
+	// were armed for so a batch that was already flushed by size is not split.
+	deliver := func(want uint64, force bool) {
+		flushMu.Lock()
+		defer flushMu.Unlock()
+
+		mu.Lock()
+		if len(pending) == 0 || (!force && want != gen) {
+			mu.Unlock()
+			return
+		}
+		batch := pending
+		pending = nil
+		gen++
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		mu.Unlock()
+
+		defer func() {
+			if r := recover(); r != nil {
+				bus.runOnPanic(event, batch, r)
+				for _, v := range batch {
+					bus.deadLetter(event, name, v, nil, r, 1)
+				}
+			}
+		}()
+		flush(batch)
+	}
+
+	bus.register(event, &{{ $sub }}{
+		name: name,
+		fn: func(v any) {
+			mu.Lock()
+			pending = append(pending, v)
+			full := len(pending) >= maxSize
+			if len(pending) == 1 && !full && maxWait > 0 {
+				armed := gen
+				timer = bus.clock.AfterFunc(maxWait, func() { deliver(armed, false) })
+			}
+			mu.Unlock()
+
+			if full {
+				deliver(0, true)
+			}
+		},
+	})
+
+	bus.hookMu.Lock()
+	bus.onStop = append(bus.onStop, func() { deliver(0, true) })
+	bus.hookMu.Unlock()
+}
+
+// {{ $p }}DeadLetter records an event whose handler panicked or gave up after
+// retries.
+type {{ $p }}DeadLetter struct {
+	Time       time.Time
+	Event      {{ $eventType }}
+	Payload    any
+	Error      string
+	Panic      string
+	Subscriber string
+	Attempts   int
+	// Redacted is set when payload fields tagged gobusgen:"redact" were zeroed
+	// before the letter was stored. Redrive leaves redacted letters in the sink.
+	Redacted bool
+}
+
+type {{ $dlRecord }} struct {
+	Time       time.Time       {{ jsonTag "time" }}
+	Event      {{ $eventType }}  {{ jsonTag "event" }}
+	Payload    json.RawMessage {{ jsonTag "payload" }}
+	Error      string          {{ jsonTag "error,omitempty" }}
+	Panic      string          {{ jsonTag "panic,omitempty" }}
+	Subscriber string          {{ jsonTag "subscriber,omitempty" }}
+	Attempts   int             {{ jsonTag "attempts" }}
+	Redacted   bool            {{ jsonTag "redacted,omitempty" }}
+}
+
+// MarshalJSON encodes the dead letter with its payload as JSON.
+func (dl {{ $p }}DeadLetter) MarshalJSON() ([]byte, error) {
+	payload, err := json.Marshal(dl.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal({{ $dlRecord }}{
+		Time:       dl.Time,
+		Event:      dl.Event,
+		Payload:    payload,
+		Error:      dl.Error,
+		Panic:      dl.Panic,
+		Subscriber: dl.Subscriber,
+		Attempts:   dl.Attempts,
+		Redacted:   dl.Redacted,
+	})
+}
+
+// UnmarshalJSON decodes a dead letter, restoring the payload type of its event.
+func (dl *{{ $p }}DeadLetter) UnmarshalJSON(data []byte) error {
+	var rec {{ $dlRecord }}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+
+	payload, err := Decode{{ $eventType }}(rec.Event, rec.Payload)
+	if err != nil {
+		return err
+	}
+
+	*dl = {{ $p }}DeadLetter{
+		Time:       rec.Time,
+		Event:      rec.Event,
+		Payload:    payload,
+		Error:      rec.Error,
+		Panic:      rec.Panic,
+		Subscriber: rec.Subscriber,
+		Attempts:   rec.Attempts,
+		Redacted:   rec.Redacted,
+	}
+	return nil
+}
+
+// {{ $p }}DeadLetterSink stores dead letters until they are redriven.
+type {{ $p }}DeadLetterSink interface {
+	// Put records a dead letter.
+	Put(dl {{ $p }}DeadLetter) error
+	// Take removes and returns the dead letters matching filter. A nil filter
+	// matches every dead letter.
+	Take(filter func({{ $p }}DeadLetter) bool) ([]{{ $p }}DeadLetter, error)
+}
+
+// {{ $p }}MemoryDeadLetterSink keeps dead letters in memory.
+type {{ $p }}MemoryDeadLetterSink struct {
+	mu      sync.Mutex
+	limit   int
+	letters []{{ $p }}DeadLetter
+}
+
+// New{{ $p }}MemoryDeadLetterSink creates an in-memory sink that keeps at most
+// limit dead letters, discarding the oldest first. A limit below 1 keeps all.
+func New{{ $p }}MemoryDeadLetterSink(limit int) *{{ $p }}MemoryDeadLetterSink {
+	return &{{ $p }}MemoryDeadLetterSink{limit: limit}
+}
+
+// Put records a dead letter.
+func (s *{{ $p }}MemoryDeadLetterSink) Put(dl {{ $p }}DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters = append(s.letters, dl)
+	if s.limit > 0 && len(s.letters) > s.limit {
+		s.letters = append(s.letters[:0:0], s.letters[len(s.letters)-s.limit:]...)
+	}
+	return nil
+}
+
+// Take removes and returns the dead letters matching filter.
+func (s *{{ $p }}MemoryDeadLetterSink) Take(filter func({{ $p }}DeadLetter) bool) ([]{{ $p }}DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var taken, kept []{{ $p }}DeadLetter
+	for _, dl := range s.letters {
+		if filter == nil || filter(dl) {
+			taken = append(taken, dl)
+		} else {
+			kept = append(kept, dl)
+		}
+	}
+	s.letters = kept
+	return taken, nil
+}
+
+// {{ $p }}FileDeadLetterSink stores dead letters as JSON lines in a file.
+// Payload fields tagged gobusgen:"redact" are written as zero values and the
+// letter is marked Redacted, so Redrive does not publish the incomplete payload.
+type {{ $p }}FileDeadLetterSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+// New{{ $p }}FileDeadLetterSink creates a sink that appends dead letters to the
+// JSONL file at path, creating it on first use.
+func New{{ $p }}FileDeadLetterSink(path string) *{{ $p }}FileDeadLetterSink {
+	return &{{ $p }}FileDeadLetterSink{path: path}
+}
+
+// Put appends a dead letter to the file.
+func (s *{{ $p }}FileDeadLetterSink) Put(dl {{ $p }}DeadLetter) error {
+	payload, redacted := {{ $redactPayload }}(dl.Payload)
+	dl.Payload = payload
+	dl.Redacted = dl.Redacted || redacted
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("encoding dead letter: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Take removes and returns the dead letters matching filter, rewriting the
+// file with the remaining lines. Lines that cannot be decoded are kept.
+func (s *{{ $p }}FileDeadLetterSink) Take(filter func({{ $p }}DeadLetter) bool) ([]{{ $p }}DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		taken []{{ $p }}DeadLetter
+		kept  bytes.Buffer
+	)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var dl {{ $p }}DeadLetter
+		if err := json.Unmarshal(line, &dl); err == nil && (filter == nil || filter(dl)) {
+			taken = append(taken, dl)
+			continue
+		}
+		kept.Write(line)
+		kept.WriteByte('\n')
+	}
+
+	if len(taken) == 0 {
+		return nil, nil
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, kept.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
+
+// DeadLetterSink returns the sink that records dead letters for this bus.
+func (bus *{{ $busType }}) DeadLetterSink() {{ $p }}DeadLetterSink {
+	return bus.deadLetters
+}
+
+// Redrive removes the dead letters matching filter from the sink and publishes
+// each one again to the subscriber that failed it, so subscribers that already
+// handled the event do not see it twice. A letter without a Subscriber goes to
+// every subscriber of its event. A nil filter matches every dead letter. Redacted letters are never matched and stay in the sink, because
+// their payloads are missing the redacted fields. Letters that cannot be
+// enqueued because the buffer is full, or that remain when ctx is done, are
+// returned to the sink. It returns the number of letters published.
+func (bus *{{ $busType }}) Redrive(ctx context.Context, filter func({{ $p }}DeadLetter) bool) (int, error) {
+	letters, err := bus.deadLetters.Take(func(dl {{ $p }}DeadLetter) bool {
+		return !dl.Redacted && (filter == nil || filter(dl))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("taking dead letters: %w", err)
+	}
+
+	// putBack returns letters that were taken but not published to the sink
+	// and joins any errors from doing so with err.
+	putBack := func(rest []{{ $p }}DeadLetter, err error) error {
+		errs := []error{err}
+		for _, dl := range rest {
+			errs = append(errs, bus.deadLetters.Put(dl))
+		}
+		return errors.Join(errs...)
+	}
+
+	n := 0
+	for i, dl := range letters {
+		if ctx.Err() != nil {
+			return n, putBack(letters[i:], ctx.Err())
+		}
+
+		env := {{ $env }}{
+			ID:         {{ $newID }}(),
+			Time:       bus.clock.Now(),
+			Event:      dl.Event,
+			Payload:    dl.Payload,
+			Subscriber: dl.Subscriber,
+		}
+		if bus.publishEnvelope(env) {
+			n++
+			continue
+		}
+		if err := bus.deadLetters.Put(dl); err != nil {
+			return n, putBack(letters[i+1:], fmt.Errorf("returning dead letter: %w", err))
+		}
+	}
+
+	return n, nil
+}
+
+// {{ $busType }}Tx buffers events in memory until Commit enqueues them on the bus or
+// Rollback discards them. It is safe for concurrent use.
+type {{ $busType }}Tx struct {
+	bus     *{{ $busType }}
+	mu      sync.Mutex
+	pending []{{ $env }}
+	done    bool
+}
+
+var _ {{ $p }}Publisher = (*{{ $busType }}Tx)(nil)
+
+// Begin starts a transaction whose events are published only on Commit.
+func (bus *{{ $busType }}) Begin() *{{ $busType }}Tx {
+	return &{{ $busType }}Tx{bus: bus}
+}
+
+func (tx *{{ $busType }}Tx) add(event {{ $eventType }}, payload any, md map[string]string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return
+	}
+	tx.pending = append(tx.pending, {{ $env }}{Event: event, Payload: payload, Metadata: maps.Clone(md)})
+}
+
+// Commit enqueues the buffered events in the order they were published. Every
+// event is attempted; if any are dropped because the queue is full, Commit
+// returns an error wrapping Err{{ $p }}Dropped. It returns Err{{ $busType }}TxDone if
+// the transaction has already finished.
+func (tx *{{ $busType }}Tx) Commit() error {
+	tx.mu.Lock()
+	if tx.done {
+		tx.mu.Unlock()
+		return Err{{ $busType }}TxDone
+	}
+	tx.done = true
+	pending := tx.pending
+	tx.pending = nil
+	tx.mu.Unlock()
+
+	dropped := 0
+	for _, env := range pending {
+		env.ID = {{ $newID }}()
+		env.Time = tx.bus.clock.Now()
+		if !tx.bus.publishEnvelope(env) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		return fmt.Errorf("%w: %d of %d transaction events", Err{{ $p }}Dropped, dropped, len(pending))
+	}
+	return nil
+}
+
+// Rollback discards the buffered events. It returns Err{{ $busType }}TxDone if the
+// transaction has already finished, so it is safe to defer after Commit.
+func (tx *{{ $busType }}Tx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return Err{{ $busType }}TxDone
+	}
+	tx.done = true
+	tx.pending = nil
+	return nil
+}
+{{ range .Events }}
+{{ $pc := pascalCase .Name -}}
+// Publish{{ $pc }} buffers a {{ .Name }} event until Commit. Events published
+// after the transaction has finished are discarded.
+func (tx *{{ $busType }}Tx) Publish{{ $pc }}(payload {{ .PayloadType }}) {
+	tx.add({{ $eventType }}{{ $pc }}, payload, nil)
+}
+
+// Publish{{ $pc }}WithMetadata buffers a {{ .Name }} event with metadata
+// until Commit.
+func (tx *{{ $busType }}Tx) Publish{{ $pc }}WithMetadata(payload {{ .PayloadType }}, md map[string]string) {
+	tx.add({{ $eventType }}{{ $pc }}, payload, md)
+}
+{{ end }}
+{{- if .Outbox }}
+// CommitOutbox finishes the transaction by inserting the buffered events into
+// store as part of sqlTx instead of publishing them. RelayOutbox publishes them
+// once sqlTx has committed. If an insert fails the transaction stays open so it
+// can still be rolled back.
+func (tx *{{ $busType }}Tx) CommitOutbox(ctx context.Context, sqlTx *sql.Tx, store {{ $p }}OutboxStore) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return Err{{ $busType }}TxDone
+	}
+
+	for _, env := range tx.pending {
+		env.ID = {{ $newID }}()
+		env.Time = tx.bus.clock.Now()
+		if err := store.Insert(ctx, sqlTx, env); err != nil {
+			return fmt.Errorf("inserting %s into outbox: %w", env.Event, err)
+		}
+	}
+	tx.done = true
+	tx.pending = nil
+	return nil
+}
+{{- end }}
+
+type {{ $txKey }} struct{}
+
+// {{ $busType }}ContextWithTx returns a copy of ctx that carries tx.
+func {{ $busType }}ContextWithTx(ctx context.Context, tx *{{ $busType }}Tx) context.Context {
+	return context.WithValue(ctx, {{ $txKey }}{}, tx)
+}
+
+// {{ $busType }}TxFromContext returns the transaction stored in ctx, if any.
+func {{ $busType }}TxFromContext(ctx context.Context) (*{{ $busType }}Tx, bool) {
+	tx, ok := ctx.Value({{ $txKey }}{}).(*{{ $busType }}Tx)
+	return tx, ok && tx != nil
+}
+
+// PublisherFrom returns the transaction stored in ctx when it belongs to this
+// bus, and the bus itself otherwise. Callers deep in a request can publish
+// through it without knowing whether a transaction is open.
+func (bus *{{ $busType }}) PublisherFrom(ctx context.Context) {{ $p }}Publisher {
+	if tx, ok := {{ $busType }}TxFromContext(ctx); ok && tx.bus == bus {
+		return tx
+	}
+	return bus
+}
+
+// {{ $p }}Recorder writes envelopes as JSON lines to an append-only log that
+// Replay can read back. Register it with {{ $busType }}.Record.
+type {{ $p }}Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// New{{ $p }}Recorder creates a recorder that writes to w.
+func New{{ $p }}Recorder(w io.Writer) *{{ $p }}Recorder {
+	return &{{ $p }}Recorder{enc: json.NewEncoder(w)}
+}
+
+// Write appends env to the log. After the first failed write the recorder
+// stops writing and keeps returning that error.
+func (r *{{ $p }}Recorder) Write(env {{ $env }}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.enc.Encode(env); err != nil {
+		r.err = fmt.Errorf("recording %s: %w", env.Event, err)
+	}
+	return r.err
+}
+
+// Err returns the first write error, if any.
+func (r *{{ $p }}Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Record writes every envelope accepted by the queue to rec, including its ID
+// and publish time. Write errors are available from rec.Err.
+func (bus *{{ $busType }}) Record(rec *{{ $p }}Recorder) {
+	bus.addEnqueueHook(func(env {{ $env }}) { _ = rec.Write(env) })
+}
+
+// {{ $busType }}ReplayOptions selects which recorded envelopes Replay dispatches and
+// how fast.
+type {{ $busType }}ReplayOptions struct {
+	// Events limits replay to these events. Empty replays every event.
+	Events []{{ $eventType }}
+	// Since skips envelopes published before it. Zero means no lower bound.
+	Since time.Time
+	// Until skips envelopes published at or after it. Zero means no upper bound.
+	Until time.Time
+	// Speed scales the original gaps between envelopes: 1 replays in real
+	// time and 2 twice as fast. Zero or less replays without waiting.
+	Speed float64
+}
+
+// Replay reads a log written by {{ article (printf "%sRecorder" $p) }} {{ $p }}Recorder from r and pushes the
+// selected envelopes onto the queue, where Start dispatches them to the current
+// subscribers. Replayed envelopes bypass the enqueue and publish hooks, so they
+// are not recorded or forwarded again. While the queue is full Replay waits for
+// room, so it does not finish until Start has caught up. It returns the number
+// of envelopes queued.
+func (bus *{{ $busType }}) Replay(ctx context.Context, r io.Reader, opts {{ $busType }}ReplayOptions) (int, error) {
+	var events map[{{ $eventType }}]bool
+	if len(opts.Events) > 0 {
+		events = make(map[{{ $eventType }}]bool, len(opts.Events))
+		for _, event := range opts.Events {
+			events[event] = true
+		}
+	}
+
+	dec := json.NewDecoder(r)
+	var last time.Time
+	n := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		var env {{ $env }}
+		if err := dec.Decode(&env); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, fmt.Errorf("reading event log: %w", err)
+		}
+
+		if events != nil && !events[env.Event] {
+			continue
+		}
+		if !opts.Since.IsZero() && env.Time.Before(opts.Since) {
+			continue
+		}
+		if !opts.Until.IsZero() && !env.Time.Before(opts.Until) {
+			continue
+		}
+
+		if opts.Speed > 0 && !last.IsZero() {
+			if gap := env.Time.Sub(last); gap > 0 {
+				if err := bus.sleep(ctx, time.Duration(float64(gap)/opts.Speed)); err != nil {
+					return n, err
+				}
+			}
+		}
+		last = env.Time
+
+		backoff := time.Millisecond
+		for !bus.queue.Push(env) {
+			if err := bus.sleep(ctx, backoff); err != nil {
+				return n, err
+			}
+			backoff = min(2*backoff, 100*time.Millisecond)
+		}
+		n++
+	}
+}
+
+// sleep waits for d on the bus clock and returns ctx.Err() if ctx is done first.
+func (bus *{{ $busType }}) sleep(ctx context.Context, d time.Duration) error {
+	wake := make(chan struct{})
+	timer := bus.clock.AfterFunc(d, func() { close(wake) })
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	case <-wake:
+		return nil
+	}
+}
+
+// {{ $busType }}TapOptions selects which events Tap writes and which payload fields
+// it hides.
+type {{ $busType }}TapOptions struct {
+	// Events limits the tap to these events. Empty taps every event.
+	Events []{{ $eventType }}
+	// Redact names top-level JSON payload fields whose values are replaced
+	// with "[REDACTED]".
+	Redact []string
+}
+
+type {{ $tapRecord }} struct {
+	Time        time.Time       {{ jsonTag "time" }}
+	Event       {{ $eventType }}     {{ jsonTag "event" }}
+	Payload     json.RawMessage {{ jsonTag "payload,omitempty" }}
+	Outcome     string          {{ jsonTag "outcome" }}
+	Subscribers int             {{ jsonTag "subscribers" }}
+	Panic       string          {{ jsonTag "panic,omitempty" }}
+}
+
+// Tap writes one JSON object per line to w for every event that is published,
+// dropped or panics a subscriber, with the event name, payload, outcome and
+// the number of subscribers at that moment. It is built on the OnPublish,
+// OnDrop and OnPanic hooks, so a bus without a tap pays nothing for it.
+// Payload fields tagged gobusgen:"redact" are always written as zero values.
+// Tap stops writing after the first write error. Calling stop removes the
+// hooks; once it returns nothing more is written to w.
+func (bus *{{ $busType }}) Tap(w io.Writer, opts {{ $busType }}TapOptions) (stop func()) {
+	var events map[{{ $eventType }}]bool
+	if len(opts.Events) > 0 {
+		events = make(map[{{ $eventType }}]bool, len(opts.Events))
+		for _, event := range opts.Events {
+			events[event] = true
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		enc     = json.NewEncoder(w)
+		failed  bool
+		stopped bool
+	)
+	write := func(event {{ $eventType }}, payload any, outcome string, recovered any) {
+		if events != nil && !events[event] {
+			return
+		}
+		bus.mu.RLock()
+		n := len(bus.subscribers[event])
+		bus.mu.RUnlock()
+
+		rec := {{ $tapRecord }}{
+			Time:        bus.clock.Now(),
+			Event:       event,
+			Outcome:     outcome,
+			Subscribers: n,
+		}
+		if data, err := json.Marshal({{ $redactExported }}(payload)); err == nil {
+			rec.Payload = {{ $redactJSON }}(data, opts.Redact)
+		}
+		if recovered != nil {
+			rec.Panic = fmt.Sprint(recovered)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failed || stopped {
+			return
+		}
+		failed = enc.Encode(rec) != nil
+	}
+
+	removers := []func(){
+		{{ $addHook }}(bus, &bus.onPublish, func(event {{ $eventType }}, payload any) { write(event, payload, "published", nil) }),
+		{{ $addHook }}(bus, &bus.onDrop, func(event {{ $eventType }}, payload any) { write(event, payload, "dropped", nil) }),
+		{{ $addHook }}(bus, &bus.onPanic, func(event {{ $eventType }}, payload any, recovered any) { write(event, payload, "panic", recovered) }),
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, remove := range removers {
+				remove()
+			}
+			// A hook that was already running finishes its write before
+			// stop returns; later ones see stopped and skip it.
+			mu.Lock()
+			stopped = true
+			mu.Unlock()
+		})
+	}
+}
+
+// {{ $redactJSON }} replaces the named top-level fields of the JSON object in data
+// with "[REDACTED]". Data that is not an object is returned unchanged.
+func {{ $redactJSON }}(data []byte, fields []string) json.RawMessage {
+	if len(fields) == 0 {
+		return data
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return data
+	}
+	for _, field := range fields {
+		if _, ok := obj[field]; ok {
+			obj[field] = json.RawMessage(strconv.Quote("[REDACTED]"))
+		}
+	}
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return data
+	}
+	return out
+}
+{{- if .HTTP }}
+
+// {{ $busType }}IngressOptions configures IngressHandler.
+type {{ $busType }}IngressOptions struct {
+	// MaxBodyBytes limits the request body size. It defaults to 1 MiB.
+	MaxBodyBytes int64
+	// Validate, when set, runs after decoding and before publishing. A
+	// non-nil error rejects the request with 422 Unprocessable Entity and the
+	// error text as the response body.
+	Validate func(r *http.Request, event {{ $eventType }}, payload any) error
+}
+
+// IngressHandler returns an http.Handler that publishes events posted to
+// /events/{name}. The body is decoded as JSON into the payload type declared
+// for name. It responds 202 Accepted once the event is queued, 404 for unknown
+// events, 400 when the body cannot be decoded, 422 when Validate rejects the
+// payload and 503 when the queue is full.
+func (bus *{{ $busType }}) IngressHandler(opts {{ $busType }}IngressOptions) http.Handler {
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 1 << 20
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, "/events/")
+		if !ok || name == "" || strings.Contains(name, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		event, err := Parse{{ $eventType }}(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, opts.MaxBodyBytes))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+			return
+		}
+		payload, err := Decode{{ $eventType }}(event, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if opts.Validate != nil {
+			if err := opts.Validate(r, event, payload); err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+
+		if !bus.publish(event, payload) {
+			http.Error(w, Err{{ $p }}Dropped.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// {{ $busType }}SSEOptions configures SSEHandler.
+type {{ $busType }}SSEOptions struct {
+	// Events limits which events clients may stream. Empty allows every event.
+	Events []{{ $eventType }}
+	// Buffer is the number of events queued for each client. A client that
+	// falls so far behind that its buffer is full is disconnected. It
+	// defaults to 64.
+	Buffer int
+}
+
+// SSEHandler returns an http.Handler that streams events to the client as
+// Server-Sent Events, one "event: <name>" and "data: <payload JSON>" record
+// per event with the envelope ID as "id". Clients select events with one or
+// more event query parameters, for example ?event=a&event=b or ?event=a,b,
+// and receive every allowed event without one. Unknown or disallowed names
+// are rejected with 400. The subscriptions are removed when the request ends.
+// Payload fields tagged gobusgen:"redact" are sent as zero values.
+func (bus *{{ $busType }}) SSEHandler(opts {{ $busType }}SSEOptions) http.Handler {
+	if opts.Buffer < 1 {
+		opts.Buffer = 64
+	}
+	allowed := opts.Events
+	if len(allowed) == 0 {
+		allowed = All{{ $eventType }}s()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		var events []{{ $eventType }}
+		for _, value := range r.URL.Query()["event"] {
+			for _, name := range strings.Split(value, ",") {
+				event := {{ $eventType }}(strings.TrimSpace(name))
+				if !slices.Contains(allowed, event) {
+					http.Error(w, fmt.Sprintf("%v: %q", ErrUnknown{{ $eventType }}, name), http.StatusBadRequest)
+					return
+				}
+				if !slices.Contains(events, event) {
+					events = append(events, event)
+				}
+			}
+		}
+		if len(events) == 0 {
+			events = allowed
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		ch := make(chan {{ $env }}, opts.Buffer)
+		subs := make([]*{{ $sub }}, len(events))
+		for i, event := range events {
+			subs[i] = &{{ $sub }}{name: "SSEHandler", deliver: func(env {{ $env }}) {
+				select {
+				case ch <- env:
+				default:
+					bus.runOnDrop(env.Event, env.Payload)
+					cancel()
+				}
+			}}
+			bus.register(event, subs[i])
+		}
+		defer func() {
+			for i, sub := range subs {
+				bus.unsubscribe(events[i], sub.id)
+			}
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case env := <-ch:
+				data, err := json.Marshal({{ $redactExported }}(env.Payload))
+				if err != nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", env.ID, env.Event, data); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+// {{ $debugRecent }} is the number of recent events, drops and panics a
+// DebugHandler keeps.
+const {{ $debugRecent }} = 100
+
+type {{ $debugEntry }} struct {
+	Time    time.Time       {{ jsonTag "time" }}
+	ID      string          {{ jsonTag "id,omitempty" }}
+	Event   {{ $eventType }}     {{ jsonTag "event" }}
+	Payload json.RawMessage {{ jsonTag "payload,omitempty" }}
+	Panic   string          {{ jsonTag "panic,omitempty" }}
+}
+
+type {{ $debugEvent }} struct {
+	Name        {{ $eventType }}   {{ jsonTag "name" }}
+	Subscribers []string {{ jsonTag "subscribers" }}
+	Published   int      {{ jsonTag "published" }}
+	Dropped     int      {{ jsonTag "dropped" }}
+	Panics      int      {{ jsonTag "panics" }}
+}
+
+type {{ $debugSnapshot }} struct {
+	Time          time.Time       {{ jsonTag "time" }}
+	QueueDepth    int             {{ jsonTag "queue_depth" }}
+	QueueCapacity int             {{ jsonTag "queue_capacity" }}
+	Events        []{{ $debugEvent }} {{ jsonTag "events" }}
+	Recent        []{{ $debugEntry }} {{ jsonTag "recent" }}
+	Drops         []{{ $debugEntry }} {{ jsonTag "drops" }}
+	Panics        []{{ $debugEntry }} {{ jsonTag "panics" }}
+}
+
+// DebugHandler returns an http.Handler that reports the state of the bus: the
+// queue depth and capacity, and for every event its subscriber names and
+// published, dropped and panic counters. It also lists the last 100 published
+// events, drops and panics. Counting starts when DebugHandler is first called
+// and uses the publish, drop and panic hooks; later calls return the same
+// handler. Payload fields tagged gobusgen:"redact" are shown as zero values.
+//
+// The handler responds with JSON, or with a small HTML page that refreshes
+// itself when the client accepts text/html. The format query parameter
+// ("json" or "html") overrides the Accept header.
+func (bus *{{ $busType }}) DebugHandler() http.Handler {
+	bus.debugOnce.Do(func() { bus.debugHandler = bus.newDebugHandler() })
+	return bus.debugHandler
+}
+
+func (bus *{{ $busType }}) newDebugHandler() http.Handler {
+	var (
+		mu                    sync.Mutex
+		counts                = make(map[{{ $eventType }}]*{{ $debugEvent }})
+		recent, drops, panics []{{ $debugEntry }}
+	)
+	entry := func(event {{ $eventType }}, payload any) {{ $debugEntry }} {
+		e := {{ $debugEntry }}{Time: bus.clock.Now(), Event: event}
+		if data, err := json.Marshal({{ $redactExported }}(payload)); err == nil {
+			e.Payload = data
+		}
+		return e
+	}
+	record := func(ring *[]{{ $debugEntry }}, e {{ $debugEntry }}, count func(*{{ $debugEvent }})) {
+		mu.Lock()
+		defer mu.Unlock()
+		c, ok := counts[e.Event]
+		if !ok {
+			c = &{{ $debugEvent }}{Name: e.Event}
+			counts[e.Event] = c
+		}
+		count(c)
+		*ring = append(*ring, e)
+		if len(*ring) > {{ $debugRecent }} {
+			*ring = append((*ring)[:0:0], (*ring)[len(*ring)-{{ $debugRecent }}:]...)
+		}
+	}
+
+	bus.addEnqueueHook(func(env {{ $env }}) {
+		e := entry(env.Event, env.Payload)
+		e.ID, e.Time = env.ID, env.Time
+		record(&recent, e, func(c *{{ $debugEvent }}) { c.Published++ })
+	})
+	bus.OnDrop(func(event {{ $eventType }}, payload any) {
+		record(&drops, entry(event, payload), func(c *{{ $debugEvent }}) { c.Dropped++ })
+	})
+	bus.OnPanic(func(event {{ $eventType }}, payload any, recovered any) {
+		e := entry(event, payload)
+		e.Panic = fmt.Sprint(recovered)
+		record(&panics, e, func(c *{{ $debugEvent }}) { c.Panics++ })
+	})
+
+	snapshot := func() {{ $debugSnapshot }} {
+		snap := {{ $debugSnapshot }}{
+			Time:          bus.clock.Now(),
+			QueueDepth:    bus.queue.Len(),
+			QueueCapacity: bus.queue.Cap(),
+		}
+
+		bus.mu.RLock()
+		for _, event := range All{{ $eventType }}s() {
+			names := make([]string, 0, len(bus.subscribers[event]))
+			for _, sub := range bus.subscribers[event] {
+				names = append(names, sub.name)
+			}
+			snap.Events = append(snap.Events, {{ $debugEvent }}{Name: event, Subscribers: names})
+		}
+		bus.mu.RUnlock()
+
+		mu.Lock()
+		for i := range snap.Events {
+			if c, ok := counts[snap.Events[i].Name]; ok {
+				snap.Events[i].Published = c.Published
+				snap.Events[i].Dropped = c.Dropped
+				snap.Events[i].Panics = c.Panics
+			}
+		}
+		snap.Recent = append([]{{ $debugEntry }}{}, recent...)
+		snap.Drops = append([]{{ $debugEntry }}{}, drops...)
+		snap.Panics = append([]{{ $debugEntry }}{}, panics...)
+		mu.Unlock()
+		return snap
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			format = "html"
+		}
+
+		snap := snapshot()
+		w.Header().Set("Cache-Control", "no-cache")
+		if format != "html" {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(snap)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		{{ $debugHTML }}(w, snap)
+	})
+}
+
+// {{ $debugHTML }} renders snap as a minimal HTML page that reloads every two seconds.
+func {{ $debugHTML }}(w io.Writer, snap {{ $debugSnapshot }}) {
+	esc := html.EscapeString
+	fmt.Fprint(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><meta http-equiv=\"refresh\" content=\"2\"><title>{{ $busType }}</title>")
+	fmt.Fprint(w, "<style>body{font-family:monospace}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:2px 6px;text-align:left}</style></head><body>\n")
+	fmt.Fprintf(w, "<h1>{{ $busType }}</h1>\n<p>Queue %d / %d at %s</p>\n", snap.QueueDepth, snap.QueueCapacity, esc(snap.Time.Format(time.RFC3339)))
+
+	fmt.Fprint(w, "<h2>Events</h2>\n<table><tr><th>Event</th><th>Published</th><th>Dropped</th><th>Panics</th><th>Subscribers</th></tr>\n")
+	for _, e := range snap.Events {
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%s</td></tr>\n",
+			esc(string(e.Name)), e.Published, e.Dropped, e.Panics, esc(strings.Join(e.Subscribers, ", ")))
+	}
+	fmt.Fprint(w, "</table>\n")
+
+	for _, section := range []struct {
+		title   string
+		entries []{{ $debugEntry }}
+	}{
+		{"Recent", snap.Recent},
+		{"Drops", snap.Drops},
+		{"Panics", snap.Panics},
+	} {
+		fmt.Fprintf(w, "<h2>%s</h2>\n<table><tr><th>Time</th><th>Event</th><th>Payload</th><th>Panic</th></tr>\n", section.title)
+		for i := len(section.entries) - 1; i >= 0; i-- {
+			e := section.entries[i]
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+				esc(e.Time.Format(time.RFC3339Nano)), esc(string(e.Event)), esc(string(e.Payload)), esc(e.Panic))
+		}
+		fmt.Fprint(w, "</table>\n")
+	}
+	fmt.Fprint(w, "</body></html>\n")
+}
+{{- end }}
+{{- if .Transport }}
+
+// {{ $p }}Transport carries envelopes between processes that generate their
+// bus from the same event map.
+type {{ $p }}Transport interface {
+	// Send delivers env and waits until the receiver acknowledges it. It
+	// returns Err{{ $p }}Dropped when the receiver's queue is full.
+	Send(ctx context.Context, env {{ $env }}) error
+	// Receive passes incoming envelopes to handle until ctx is done. The
+	// error returned by handle is reported back to the sender.
+	Receive(ctx context.Context, handle func({{ $env }}) error) error
+}
+
+// SendTo forwards envelopes accepted by this bus's queue to t until ctx is
+// done, then returns ctx.Err(). Only the given events are forwarded, or every
+// event if none are given. Envelopes wait in a buffer the size of the queue
+// capacity; when t falls behind and the buffer is full, new envelopes are not
+// forwarded and are reported to the OnDrop hooks. While the receiver's queue
+// is full the current envelope is retried with backoff, and envelopes the
+// receiver rejects for any other reason are dead-lettered. Envelopes this bus
+// received through ReceiveFrom are never sent, so two processes can SendTo each
+// other without events bouncing between them.
+func (bus *{{ $busType }}) SendTo(ctx context.Context, t {{ $p }}Transport, events ...{{ $eventType }}) error {
+	var selected map[{{ $eventType }}]bool
+	if len(events) > 0 {
+		selected = make(map[{{ $eventType }}]bool, len(events))
+		for _, event := range events {
+			selected[event] = true
+		}
+	}
+
+	pending := make(chan {{ $env }}, max(bus.queue.Cap(), 1))
+	remove := bus.addEnqueueHook(func(env {{ $env }}) {
+		if env.received || (env.Subscriber != "" && env.Subscriber != "SendTo") || (selected != nil && !selected[env.Event]) {
+			return
+		}
+		// A redriven envelope is meant for SendTo; the receiver delivers it
+		// to all of its subscribers.
+		env.Subscriber = ""
+		select {
+		case pending <- env:
+		default:
+			bus.runOnDrop(env.Event, env.Payload)
+		}
+	})
+	defer remove()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case env := <-pending:
+			if err := bus.send(ctx, t, env); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// send delivers env over t, backing off while the receiver's queue is full.
+func (bus *{{ $busType }}) send(ctx context.Context, t {{ $p }}Transport, env {{ $env }}) error {
+	backoff := 10 * time.Millisecond
+	for {
+		err := t.Send(ctx, env)
+		switch {
+		case err == nil:
+			return nil
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, Err{{ $p }}Dropped):
+			if err := bus.sleep(ctx, backoff); err != nil {
+				return err
+			}
+			backoff = min(2*backoff, time.Second)
+		default:
+			bus.deadLetter(env.Event, "SendTo", env.Payload, err, nil, 1)
+			return nil
+		}
+	}
+}
+
+// ReceiveFrom enqueues envelopes arriving on t until ctx is done. Envelopes
+// keep the ID and time assigned by the sending process. Unknown events are
+// rejected, and a full queue is reported to the sender as Err{{ $p }}Dropped
+// so that it retries.
+func (bus *{{ $busType }}) ReceiveFrom(ctx context.Context, t {{ $p }}Transport) error {
+	return t.Receive(ctx, func(env {{ $env }}) error {
+		if !env.Event.Valid() {
+			return fmt.Errorf("%w: %q", ErrUnknown{{ $eventType }}, env.Event)
+		}
+		env.received = true
+		if !bus.publishEnvelope(env) {
+			return Err{{ $p }}Dropped
+		}
+		return nil
+	})
+}
+
+// {{ $ackRecord }} is the receiver's reply to an envelope sent over a
+// {{ $p }}UnixTransport.
+type {{ $ackRecord }} struct {
+	ID      string {{ jsonTag "id" }}
+	Error   string {{ jsonTag "error,omitempty" }}
+	Dropped bool   {{ jsonTag "dropped,omitempty" }}
+}
+
+// {{ $p }}UnixTransport is a {{ $p }}Transport over a Unix domain socket. The
+// receiving process listens on the socket path and the sending process dials
+// it. Envelopes are written as JSON lines and each one is acknowledged before
+// the next is sent, so a slow receiver slows the sender down. Send reconnects
+// with backoff when the connection fails, which may deliver an envelope twice.
+type {{ $p }}UnixTransport struct {
+	path string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+var _ {{ $p }}Transport = (*{{ $p }}UnixTransport)(nil)
+
+// New{{ $p }}UnixTransport creates a transport for the socket at path.
+func New{{ $p }}UnixTransport(path string) *{{ $p }}UnixTransport {
+	return &{{ $p }}UnixTransport{path: path}
+}
+
+// Send delivers env to the listening process, dialing or redialing the
+// socket until it succeeds or ctx is done.
+func (t *{{ $p }}UnixTransport) Send(ctx context.Context, env {{ $env }}) error {
+	line, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("encoding envelope: %w", err)
+	}
+	line = append(line, '\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	backoff := 10 * time.Millisecond
+	for {
+		ack, err := t.roundTrip(ctx, line)
+		if err == nil {
+			switch {
+			case ack.Dropped:
+				return Err{{ $p }}Dropped
+			case ack.Error != "":
+				return fmt.Errorf("receiver rejected %s: %s", env.Event, ack.Error)
+			}
+			return nil
+		}
+
+		t.closeConn()
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, time.Second)
+	}
+}
+
+func (t *{{ $p }}UnixTransport) roundTrip(ctx context.Context, line []byte) ({{ $ackRecord }}, error) {
+	if t.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", t.path)
+		if err != nil {
+			return {{ $ackRecord }}{}, err
+		}
+		t.conn, t.r = conn, bufio.NewReader(conn)
+	}
+
+	conn := t.conn
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write(line); err != nil {
+		return {{ $ackRecord }}{}, err
+	}
+	reply, err := t.r.ReadBytes('\n')
+	if err != nil {
+		return {{ $ackRecord }}{}, err
+	}
+
+	var ack {{ $ackRecord }}
+	if err := json.Unmarshal(reply, &ack); err != nil {
+		return {{ $ackRecord }}{}, fmt.Errorf("decoding ack: %w", err)
+	}
+	return ack, nil
+}
+
+func (t *{{ $p }}UnixTransport) closeConn() {
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn, t.r = nil, nil
+	}
+}
+
+// Receive listens on the socket path and serves every connection until ctx
+// is done, then returns ctx.Err(). A stale socket file left by a previous
+// receiver is removed first, but Receive fails if another receiver is still
+// accepting connections on it.
+func (t *{{ $p }}UnixTransport) Receive(ctx context.Context, handle func({{ $env }}) error) error {
+	if info, err := os.Lstat(t.path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", t.path)
+		switch {
+		case err == nil:
+			_ = conn.Close()
+			return fmt.Errorf("listening on %s: socket is in use by another receiver", t.path)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			_ = os.Remove(t.path)
+		}
+	}
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "unix", t.path)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", t.path, err)
+	}
+	// Leave the socket file in place on close: a receiver that has already
+	// replaced the stale file must not lose its socket to an old listener
+	// that is still shutting down.
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	var (
+		mu    sync.Mutex
+		conns = map[net.Conn]struct{}{}
+		wg    sync.WaitGroup
+	)
+	shutdown := func() {
+		_ = ln.Close()
+		mu.Lock()
+		for conn := range conns {
+			_ = conn.Close()
+		}
+		mu.Unlock()
+	}
+	stop := context.AfterFunc(ctx, shutdown)
+	defer stop()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			shutdown()
+			wg.Wait()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("accepting on %s: %w", t.path, err)
+		}
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.serve(conn, handle)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+func (t *{{ $p }}UnixTransport) serve(conn net.Conn, handle func({{ $env }}) error) {
+	r := bufio.NewReader(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var ack {{ $ackRecord }}
+		var env {{ $env }}
+		if err := json.Unmarshal(line, &env); err != nil {
+			ack.Error = err.Error()
+		} else {
+			ack.ID = env.ID
+			if err := handle(env); err != nil {
+				ack.Error = err.Error()
+				ack.Dropped = errors.Is(err, Err{{ $p }}Dropped)
+			}
+		}
+
+		if err := enc.Encode(ack); err != nil {
+			return
+		}
+	}
+}
+
+// Close closes the sending connection, if any. A later Send dials again.
+func (t *{{ $p }}UnixTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeConn()
+	return nil
+}
+{{- end }}
+{{- if .Outbox }}
+
+// {{ $p }}OutboxStore persists events next to the data they describe so they
+// are published at least once after the surrounding database transaction
+// commits.
+type {{ $p }}OutboxStore interface {
+	// Insert stores env as part of tx. A nil tx inserts outside a transaction.
+	Insert(ctx context.Context, tx *sql.Tx, env {{ $env }}) error
+	// FetchPending returns up to limit undelivered envelopes, oldest first.
+	FetchPending(ctx context.Context, limit int) ([]{{ $env }}, error)
+	// MarkDelivered records that the envelopes with the given IDs were published.
+	MarkDelivered(ctx context.Context, ids []string) error
+}
+
+// {{ $busType }}RelayOptions configures RelayOutbox.
+type {{ $busType }}RelayOptions struct {
+	// Interval is how long the relay waits before polling again once the
+	// outbox is drained. It defaults to one second.
+	Interval time.Duration
+	// BatchSize is the maximum number of envelopes fetched per poll. It
+	// defaults to 100.
+	BatchSize int
+	// OnError is called with store errors. The relay keeps running and
+	// retries on the next poll.
+	OnError func(error)
+}
+
+// RelayOutbox publishes pending envelopes from store until ctx is done and
+// then returns ctx.Err(). Envelopes keep the ID and time assigned when they
+// were inserted. When the queue is full the relay stops the current batch and
+// retries the remaining envelopes on the next poll, so an envelope may be
+// published more than once if MarkDelivered fails.
+func (bus *{{ $busType }}) RelayOutbox(ctx context.Context, store {{ $p }}OutboxStore, opts {{ $busType }}RelayOptions) error {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 100
+	}
+
+	for {
+		n, err := bus.relayOutbox(ctx, store, opts.BatchSize)
+		if err != nil && ctx.Err() == nil && opts.OnError != nil {
+			opts.OnError(err)
+		}
+		if err == nil && n == opts.BatchSize {
+			continue
+		}
+
+		if err := bus.sleep(ctx, opts.Interval); err != nil {
+			return err
+		}
+	}
 }
 
-var tmpl = template.Must(template.New("eventbus").Funcs(template.FuncMap{
-	"pascalCase": model.PascalCase,
-	"lowerFirst": lowerFirst,
-	"article":    article,
-}).Parse(eventBusTemplate))
+func (bus *{{ $busType }}) relayOutbox(ctx context.Context, store {{ $p }}OutboxStore, limit int) (int, error) {
+	pending, err := store.FetchPending(ctx, limit)
+	if err != nil {
+		return 0, fmt.Errorf("fetching outbox: %w", err)
+	}
 
-const eventBusTemplate = `// Code generated by gobusgen; DO NOT EDIT.
-package {{ .PackageName }}
+	delivered := make([]string, 0, len(pending))
+	for _, env := range pending {
+		if !bus.publishEnvelope(env) {
+			break
+		}
+		delivered = append(delivered, env.ID)
+	}
+	if len(delivered) == 0 {
+		return 0, nil
+	}
 
-import (
-	"context"
-	"sync"
-)
-{{- $p := .Prefix -}}
-{{- $eventType := "Event" -}}{{- if $p -}}{{- $eventType = printf "%sEvent" $p -}}{{- end -}}
-{{- $busType := "EventBus" -}}{{- if $p -}}{{- $busType = printf "%sBus" $p -}}{{- end -}}
-{{- $ctor := "New" -}}{{- if $p -}}{{- $ctor = printf "New%sBus" $p -}}{{- end -}}
-{{- $env := "envelope" -}}{{- if $p -}}{{- $env = printf "%sEnvelope" (lowerFirst $p) -}}{{- end -}}
-{{- $subsMap := "newSubscribersMap" -}}{{- if $p -}}{{- $subsMap = printf "new%sBusSubscribersMap" $p -}}{{- end }}
+	if err := store.MarkDelivered(ctx, delivered); err != nil {
+		return len(delivered), fmt.Errorf("marking outbox delivered: %w", err)
+	}
+	return len(delivered), nil
+}
 
-// {{ $eventType }} represents a typed event name.
-type {{ $eventType }} string
+// {{ $p }}MemoryOutboxStore is an in-memory {{ $p }}OutboxStore for tests. It
+// ignores the *sql.Tx passed to Insert.
+type {{ $p }}MemoryOutboxStore struct {
+	mu      sync.Mutex
+	pending []{{ $env }}
+}
 
-const (
+// New{{ $p }}MemoryOutboxStore creates an empty in-memory outbox.
+func New{{ $p }}MemoryOutboxStore() *{{ $p }}MemoryOutboxStore {
+	return &{{ $p }}MemoryOutboxStore{}
+}
+
+// Insert stores env.
+func (s *{{ $p }}MemoryOutboxStore) Insert(_ context.Context, _ *sql.Tx, env {{ $env }}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, env)
+	return nil
+}
+
+// FetchPending returns up to limit undelivered envelopes in insertion order.
+func (s *{{ $p }}MemoryOutboxStore) FetchPending(_ context.Context, limit int) ([]{{ $env }}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := min(limit, len(s.pending))
+	return append([]{{ $env }}(nil), s.pending[:n]...), nil
+}
+
+// MarkDelivered removes the envelopes with the given IDs.
+func (s *{{ $p }}MemoryOutboxStore) MarkDelivered(_ context.Context, ids []string) error {
+	delivered := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		delivered[id] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.pending[:0]
+	for _, env := range s.pending {
+		if !delivered[env.ID] {
+			kept = append(kept, env)
+		}
+	}
+	s.pending = kept
+	return nil
+}
+
+// Len returns the number of undelivered envelopes.
+func (s *{{ $p }}MemoryOutboxStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// {{ $p }}SQLOutboxStore is {{ article (printf "%sOutboxStore" $p) }} {{ $p }}OutboxStore backed by database/sql. It
+// stores envelopes as JSON in a table created with Schema.
+type {{ $p }}SQLOutboxStore struct {
+	db          *sql.DB
+	table       string
+	placeholder func(n int) string
+}
+
+// New{{ $p }}SQLOutboxStore creates a store that uses table in db. An empty
+// table defaults to "event_outbox". placeholder returns the bind parameter for
+// the nth argument, starting at 1; nil uses "?", and PostgreSQL drivers need
+// a func returning "$1", "$2" and so on.
+func New{{ $p }}SQLOutboxStore(db *sql.DB, table string, placeholder func(n int) string) *{{ $p }}SQLOutboxStore {
+	if table == "" {
+		table = "event_outbox"
+	}
+	if placeholder == nil {
+		placeholder = func(int) string { return "?" }
+	}
+	return &{{ $p }}SQLOutboxStore{db: db, table: table, placeholder: placeholder}
+}
+
+// Schema returns the CREATE TABLE statement for the outbox table.
+func (s *{{ $p }}SQLOutboxStore) Schema() string {
+	return "CREATE TABLE IF NOT EXISTS " + s.table + " (\n" +
+		"\tid VARCHAR(64) PRIMARY KEY,\n" +
+		"\tcreated_at TIMESTAMP NOT NULL,\n" +
+		"\tenvelope TEXT NOT NULL,\n" +
+		"\tdelivered_at TIMESTAMP NULL\n" +
+		")"
+}
+
+// Insert stores env as part of tx, or directly in the database if tx is nil.
+func (s *{{ $p }}SQLOutboxStore) Insert(ctx context.Context, tx *sql.Tx, env {{ $env }}) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("encoding envelope: %w", err)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (id, created_at, envelope) VALUES (%s, %s, %s)",
+		s.table, s.placeholder(1), s.placeholder(2), s.placeholder(3))
+	if tx != nil {
+		_, err = tx.ExecContext(ctx, query, env.ID, env.Time.UTC(), string(data))
+	} else {
+		_, err = s.db.ExecContext(ctx, query, env.ID, env.Time.UTC(), string(data))
+	}
+	return err
+}
+
+// FetchPending returns up to limit undelivered envelopes, oldest first.
+func (s *{{ $p }}SQLOutboxStore) FetchPending(ctx context.Context, limit int) ([]{{ $env }}, error) {
+	query := fmt.Sprintf("SELECT envelope FROM %s WHERE delivered_at IS NULL ORDER BY created_at, id LIMIT %d", s.table, limit)
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var envs []{{ $env }}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var env {{ $env }}
+		if err := json.Unmarshal([]byte(data), &env); err != nil {
+			return nil, fmt.Errorf("decoding outbox envelope: %w", err)
+		}
+		envs = append(envs, env)
+	}
+	return envs, rows.Err()
+}
+
+// MarkDelivered sets delivered_at for the envelopes with the given IDs.
+func (s *{{ $p }}SQLOutboxStore) MarkDelivered(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := make([]any, 0, len(ids)+1)
+	args = append(args, time.Now().UTC())
+	params := make([]string, len(ids))
+	for i, id := range ids {
+		params[i] = s.placeholder(i + 2)
+		args = append(args, id)
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET delivered_at = %s WHERE id IN (%s)",
+		s.table, s.placeholder(1), strings.Join(params, ", "))
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+{{- end }}
+
+// {{ $checkPayload }} reports whether payload has the type declared for event.
+func {{ $checkPayload }}(event {{ $eventType }}, payload any) error {
+	switch event {
 {{- range .Events }}
 	{{ $pc := pascalCase .Name -}}
-	{{ $eventType }}{{ $pc }} {{ $eventType }} = "{{ .Name }}"
+	case {{ $eventType }}{{ $pc }}:
+		if _, ok := payload.({{ .PayloadType }}); !ok {
+			return fmt.Errorf("%w: %s wants {{ .PayloadType }}, got %T", Err{{ $p }}PayloadType, event, payload)
+		}
+		return nil
 {{- end }}
-)
+	}
 
-// {{ $busType }} provides type-safe publish/subscribe for in-process events.
-type {{ $busType }} struct {
-	mu          sync.RWMutex
-	subscribers map[{{ $eventType }}][]any
-	ch          chan {{ $env }}
+	return fmt.Errorf("%w: %q", ErrUnknown{{ $eventType }}, event)
+}
 
-	hookMu      sync.RWMutex
-	onPublish   []func({{ $eventType }}, any)
-	onDrop      []func({{ $eventType }}, any)
-	onSubscribe []func({{ $eventType }})
-	onPanic     []func({{ $eventType }}, any, any)
+{{- if .Redact }}
+// {{ $redactZero }} sets *v to its zero value and reports whether it was not
+// zero already.
+func {{ $redactZero }}[T any](v *T) bool {
+	if reflect.ValueOf(v).Elem().IsZero() {
+		return false
+	}
+	var zero T
+	*v = zero
+	return true
 }
 
-type {{ $env }} struct {
-	event   {{ $eventType }}
-	payload any
+{{ end -}}
+{{- range .Redact }}
+// {{ $redact }}{{ pascalCase .Name }} returns a copy of p with the fields tagged
+// gobusgen:"redact" set to their zero values, including fields of nested
+// values, and reports whether any of them was not zero. Nested pointers,
+// slices and maps are copied rather than modified.
+func {{ $redact }}{{ pascalCase .Name }}(p {{ .Name }}) ({{ .Name }}, bool) {
+	changed := false
+	{{ redactCode $redactZero "p" .Value }}
+	return p, changed
 }
 
-// {{ $ctor }} creates {{ article $busType }} {{ $busType }} with the given channel buffer size.
-func {{ $ctor }}(size int) *{{ $busType }} {
-	if size < 1 {
-		size = 1
+{{ end -}}
+// {{ $redactExported }} returns a copy of payload with the fields tagged
+// gobusgen:"redact" set to their zero values, for use by loggers, trace
+// exporters and other sinks that record payloads. Batches are redacted element
+// by element. Payloads without tagged fields are returned unchanged.
+func {{ $redactExported }}(payload any) any {
+	redacted, _ := {{ $redactPayload }}(payload)
+	return redacted
+}
+
+// {{ $redactPayload }} implements {{ $redactExported }} and also reports whether
+// a tagged field that was not zero was removed.
+func {{ $redactPayload }}(payload any) (any, bool) {
+{{- if .Redact }}
+	switch p := payload.(type) {
+	{{- range .Redact }}
+	case {{ .Name }}:
+		return {{ $redact }}{{ pascalCase .Name }}(p)
+	case []{{ .Name }}:
+		out := make([]{{ .Name }}, len(p))
+		changed := false
+		for i := range p {
+			var c bool
+			out[i], c = {{ $redact }}{{ pascalCase .Name }}(p[i])
+			changed = changed || c
+		}
+		return out, changed
+	{{- end }}
+	case []any:
+		// Panicking batch handlers report their batch as []any.
+		out := make([]any, len(p))
+		changed := false
+		for i := range p {
+			var c bool
+			out[i], c = {{ $redactPayload }}(p[i])
+			changed = changed || c
+		}
+		return out, changed
+	}
+{{- end }}
+	return payload, false
+}
+
+// Encode{{ $eventType }} encodes payload as JSON after checking that it has the
+// payload type declared for event.
+func Encode{{ $eventType }}(event {{ $eventType }}, payload any) ([]byte, error) {
+	if err := {{ $checkPayload }}(event, payload); err != nil {
+		return nil, err
 	}
 
-	return &{{ $busType }}{
-		subscribers: {{ $subsMap }}(),
-		ch:          make(chan {{ $env }}, size),
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s payload: %w", event, err)
 	}
+	return data, nil
 }
 
-func {{ $subsMap }}() map[{{ $eventType }}][]any {
-	return map[{{ $eventType }}][]any{
+// Decode{{ $eventType }} decodes JSON data into the payload type declared for event.
+// The returned value holds the payload type itself, not a pointer to it.
+func Decode{{ $eventType }}(event {{ $eventType }}, data []byte) (any, error) {
+	switch event {
 {{- range .Events }}
 	{{ $pc := pascalCase .Name -}}
-		{{ $eventType }}{{ $pc }}: {},
+	case {{ $eventType }}{{ $pc }}:
+		var payload {{ .PayloadType }}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, fmt.Errorf("decoding %s payload: %w", event, err)
+		}
+		return payload, nil
 {{- end }}
 	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknown{{ $eventType }}, event)
 }
 
-// Start begins processing events. It blocks until ctx is cancelled.
-func (bus *{{ $busType }}) Start(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case env := <-bus.ch:
-			bus.mu.RLock()
-			subs := make([]any, len(bus.subscribers[env.event]))
-			copy(subs, bus.subscribers[env.event])
-			bus.mu.RUnlock()
+// PublishRaw decodes a JSON payload for event and publishes it as if the
+// typed Publish method had been called. It returns ErrUnknown{{ $eventType }}
+// for events this bus does not declare and Err{{ $p }}Dropped when the queue is full.
+func (bus *{{ $busType }}) PublishRaw(ctx context.Context, event {{ $eventType }}, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-			for _, sub := range subs {
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							bus.runOnPanic(env.event, env.payload, r)
-						}
-					}()
-					if fn, ok := sub.(func(any)); ok {
-						fn(env.payload)
-					}
-				}()
-			}
-		}
+	payload, err := Decode{{ $eventType }}(event, data)
+	if err != nil {
+		return err
+	}
+
+	if !bus.publish(event, payload) {
+		return Err{{ $p }}Dropped
+	}
+	return nil
+}
+
+// Publish publishes payload for event without a compile-time type check. It
+// returns ErrUnknown{{ $eventType }} for events this bus does not declare,
+// Err{{ $p }}PayloadType when payload does not have the declared type, and
+// Err{{ $p }}Dropped when the queue is full.
+func (bus *{{ $busType }}) Publish(event {{ $eventType }}, payload any) error {
+	if err := {{ $checkPayload }}(event, payload); err != nil {
+		return err
 	}
+
+	if !bus.publish(event, payload) {
+		return Err{{ $p }}Dropped
+	}
+	return nil
+}
+
+// SubscribeAny registers a handler that receives the payloads of event as
+// any. It returns ErrUnknown{{ $eventType }} for events this bus does not declare.
+func (bus *{{ $busType }}) SubscribeAny(event {{ $eventType }}, fn func(any), opts ...{{ $busType }}SubscribeOption) error {
+	if !event.Valid() {
+		return fmt.Errorf("%w: %q", ErrUnknown{{ $eventType }}, event)
+	}
+
+	bus.subscribe(event, &{{ $sub }}{name: {{ $funcName }}(fn), fn: fn}, opts...)
+	return nil
 }
 
 {{ range .Events }}
 {{ $pc := pascalCase .Name -}}
 // Publish{{ $pc }} publishes a {{ .Name }} event.
 func (bus *{{ $busType }}) Publish{{ $pc }}(payload {{ .PayloadType }}) {
+	bus.publish({{ $eventType }}{{ $pc }}, payload)
+}
+
+// Publish{{ $pc }}WithMetadata publishes a {{ .Name }} event carrying md in
+// its envelope. md is copied.
+func (bus *{{ $busType }}) Publish{{ $pc }}WithMetadata(payload {{ .PayloadType }}, md map[string]string) {
+	bus.publishEnvelope({{ $env }}{
+		ID:       {{ $newID }}(),
+		Time:     bus.clock.Now(),
+		Event:    {{ $eventType }}{{ $pc }},
+		Payload:  payload,
+		Metadata: maps.Clone(md),
+	})
+}
+
+// Publish{{ $pc }}After publishes a {{ .Name }} event once d has elapsed.
+func (bus *{{ $busType }}) Publish{{ $pc }}After(d time.Duration, payload {{ .PayloadType }}) *{{ $scheduled }} {
+	return bus.scheduleAt({{ $eventType }}{{ $pc }}, payload, bus.clock.Now().Add(d))
+}
+
+// Publish{{ $pc }}At publishes a {{ .Name }} event at t.
+func (bus *{{ $busType }}) Publish{{ $pc }}At(t time.Time, payload {{ .PayloadType }}) *{{ $scheduled }} {
+	return bus.scheduleAt({{ $eventType }}{{ $pc }}, payload, t)
+}
+
+// Subscribe{{ $pc }} registers a handler for {{ .Name }} events.
+func (bus *{{ $busType }}) Subscribe{{ $pc }}(fn func({{ .PayloadType }}), opts ...{{ $busType }}SubscribeOption) {
+	bus.subscribe({{ $eventType }}{{ $pc }}, &{{ $sub }}{
+		name: {{ $funcName }}(fn),
+		fn: func(v any) {
+			payload, ok := v.({{ .PayloadType }})
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	}, opts...)
+}
+
+// Subscribe{{ $pc }}Err registers a handler for {{ .Name }} events that can
+// fail. Failed attempts are retried according to the retry policy set with
+// {{ $busType }}WithRetry, and failures that are not retried are reported to the
+// OnGiveUp hooks.
+func (bus *{{ $busType }}) Subscribe{{ $pc }}Err(fn func({{ .PayloadType }}) error, opts ...{{ $busType }}SubscribeOption) {
+	bus.subscribe({{ $eventType }}{{ $pc }}, &{{ $sub }}{
+		name: {{ $funcName }}(fn),
+		handle: func(v any) error {
+			payload, ok := v.({{ .PayloadType }})
+			if !ok {
+				return nil
+			}
+			return fn(payload)
+		},
+	}, opts...)
+}
+
+// Subscribe{{ $pc }}Once registers a handler for the next {{ .Name }} event.
+// The handler is removed before it is called and never runs more than once.
+func (bus *{{ $busType }}) Subscribe{{ $pc }}Once(fn func({{ .PayloadType }})) {
+	bus.subscribe({{ $eventType }}{{ $pc }}, &{{ $sub }}{
+		name: {{ $funcName }}(fn),
+		once: true,
+		fn: func(v any) {
+			payload, ok := v.({{ .PayloadType }})
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	})
+}
+
+// Subscribe{{ $pc }}Where registers a handler for {{ .Name }} events that
+// satisfy pred. Events rejected by pred are not delivered to fn.
+func (bus *{{ $busType }}) Subscribe{{ $pc }}Where(pred func({{ .PayloadType }}) bool, fn func({{ .PayloadType }}), opts ...{{ $busType }}SubscribeOption) {
+	bus.subscribe({{ $eventType }}{{ $pc }}, &{{ $sub }}{
+		name: {{ $funcName }}(fn),
+		filter: func(v any) bool {
+			payload, ok := v.({{ .PayloadType }})
+			return ok && pred(payload)
+		},
+		fn: func(v any) {
+			payload, ok := v.({{ .PayloadType }})
+			if !ok {
+				return
+			}
+			fn(payload)
+		},
+	}, opts...)
+}
+
+// WaitFor{{ $pc }} blocks until a {{ .Name }} event satisfying pred is
+// dispatched and returns its payload. A nil pred matches every event. The
+// temporary subscription is removed when WaitFor{{ $pc }} returns, and
+// ctx.Err() is returned if ctx is done first.
+func (bus *{{ $busType }}) WaitFor{{ $pc }}(ctx context.Context, pred func({{ .PayloadType }}) bool) ({{ .PayloadType }}, error) {
+	ch := make(chan {{ .PayloadType }}, 1)
+	sub := &{{ $sub }}{
+		name: "WaitFor{{ $pc }}",
+		once: true,
+		filter: func(v any) bool {
+			payload, ok := v.({{ .PayloadType }})
+			return ok && (pred == nil || pred(payload))
+		},
+		fn: func(v any) {
+			ch <- v.({{ .PayloadType }})
+		},
+	}
+	bus.register({{ $eventType }}{{ $pc }}, sub)
+
 	select {
-	case bus.ch <- {{ $env }}{event: {{ $eventType }}{{ $pc }}, payload: payload}:
-		bus.runOnPublish({{ $eventType }}{{ $pc }}, payload)
-	default:
-		bus.runOnDrop({{ $eventType }}{{ $pc }}, payload)
+	case payload := <-ch:
+		return payload, nil
+	case <-ctx.Done():
+		bus.unsubscribe({{ $eventType }}{{ $pc }}, sub.id)
+		var zero {{ .PayloadType }}
+		return zero, ctx.Err()
 	}
 }
 
-// Subscribe{{ $pc }} registers a handler for {{ .Name }} events.
-func (bus *{{ $busType }}) Subscribe{{ $pc }}(fn func({{ .PayloadType }})) {
-	bus.mu.Lock()
-	bus.subscribers[{{ $eventType }}{{ $pc }}] = append(bus.subscribers[{{ $eventType }}{{ $pc }}], func(v any) {
+// Forward{{ $pc }} republishes every {{ .Name }} event on dst with its
+// metadata while this bus is running. Forwarding stops when Start returns and
+// resumes if Start is called again. dst is typically another bus, possibly from
+// a different generated package, that declares the same payload type.
+func (bus *{{ $busType }}) Forward{{ $pc }}(dst {{ $p }}{{ $pc }}MetadataPublisher) {
+	bus.forward({{ $eventType }}{{ $pc }}, "Forward{{ $pc }}", func(env {{ $env }}) {
+		if payload, ok := env.Payload.({{ .PayloadType }}); ok {
+			dst.Publish{{ $pc }}WithMetadata(payload, env.Metadata)
+		}
+	})
+}
+
+// {{ $busType }}Coalesce{{ $pc }} holds {{ .Name }} events by the key returned from
+// key and delivers only the last event per key once window has passed since
+// the first event for that key. Subscribing to another event with it panics.
+func {{ $busType }}Coalesce{{ $pc }}(window time.Duration, key func({{ .PayloadType }}) string) {{ $busType }}SubscribeOption {
+	return func(cfg *{{ $subCfg }}) {
+		cfg.coalesceWindow = window
+		cfg.coalesceEvent = {{ $eventType }}{{ $pc }}
+		cfg.coalesceKey = func(v any) string {
+			payload, _ := v.({{ .PayloadType }})
+			return key(payload)
+		}
+	}
+}
+
+// Subscribe{{ $pc }}Batch registers a handler that receives {{ .Name }} events
+// in batches. A batch is delivered once it holds maxSize events, once maxWait
+// has passed since its first event, or when the bus shuts down. A maxWait of
+// zero disables the time window.
+func (bus *{{ $busType }}) Subscribe{{ $pc }}Batch(maxSize int, maxWait time.Duration, fn func([]{{ .PayloadType }})) {
+	bus.subscribeBatch({{ $eventType }}{{ $pc }}, {{ $funcName }}(fn), maxSize, maxWait, func(items []any) {
+		batch := make([]{{ .PayloadType }}, 0, len(items))
+		for _, v := range items {
+			if payload, ok := v.({{ .PayloadType }}); ok {
+				batch = append(batch, payload)
+			}
+		}
+		fn(batch)
+	})
+}
+
+// {{ $pc }}Chan returns a channel that receives {{ .Name }} events until ctx
+// is done, after which the subscription is removed and the channel is closed.
+// The channel buffers up to size events. When the consumer falls behind and
+// the buffer is full, new events are discarded for this channel only and
+// reported to the OnDrop hooks.
+func (bus *{{ $busType }}) {{ $pc }}Chan(ctx context.Context, size int) <-chan {{ .PayloadType }} {
+	if size < 1 {
+		size = 1
+	}
+
+	ch := make(chan {{ .PayloadType }}, size)
+	bus.subscribeStream(ctx, {{ $eventType }}{{ $pc }}, func(v any) bool {
 		payload, ok := v.({{ .PayloadType }})
 		if !ok {
-			return
+			return true
 		}
-		fn(payload)
-	})
-	bus.mu.Unlock()
-	bus.runOnSubscribe({{ $eventType }}{{ $pc }})
+		select {
+		case ch <- payload:
+			return true
+		default:
+			return false
+		}
+	}, func() { close(ch) })
+
+	return ch
+}
+
+// {{ $pc }}Seq returns an iterator over {{ .Name }} events. The subscription
+// is created when iteration starts and removed when the loop exits or ctx is
+// done. Events are buffered up to the bus queue capacity with the same overflow
+// policy as {{ $pc }}Chan: events arriving while the buffer is full are
+// discarded and reported to the OnDrop hooks.
+func (bus *{{ $busType }}) {{ $pc }}Seq(ctx context.Context) iter.Seq[{{ .PayloadType }}] {
+	return func(yield func({{ .PayloadType }}) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		ch := bus.{{ $pc }}Chan(ctx, bus.queue.Cap())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case payload, ok := <-ch:
+				if !ok || !yield(payload) {
+					return
+				}
+			}
+		}
+	}
 }
 {{ end }}
 // OnPublish registers a hook that fires after an event is successfully enqueued.
 func (bus *{{ $busType }}) OnPublish(fn func({{ $eventType }}, any)) {
-	bus.hookMu.Lock()
-	bus.onPublish = append(bus.onPublish, fn)
-	bus.hookMu.Unlock()
+	{{ $addHook }}(bus, &bus.onPublish, fn)
 }
 
-// OnDrop registers a hook that fires when an event is dropped due to a full buffer.
+// OnDrop registers a hook that fires when an event is dropped due to a full
+// buffer, either the bus buffer or the buffer of a channel or iterator subscriber.
 func (bus *{{ $busType }}) OnDrop(fn func({{ $eventType }}, any)) {
-	bus.hookMu.Lock()
-	bus.onDrop = append(bus.onDrop, fn)
-	bus.hookMu.Unlock()
+	{{ $addHook }}(bus, &bus.onDrop, fn)
 }
 
 // OnSubscribe registers a hook that fires after a subscriber is registered.
@@ -170,28 +3444,80 @@ func (bus *{{ $busType }}) OnSubscribe(fn func({{ $eventType }})) {
 
 // OnPanic registers a hook that fires when a subscriber panics.
 func (bus *{{ $busType }}) OnPanic(fn func({{ $eventType }}, any, any)) {
+	{{ $addHook }}(bus, &bus.onPanic, fn)
+}
+
+// OnRetry registers a hook that fires when a handler returns an error and
+// another attempt is scheduled. The int is the number of the failed attempt,
+// starting at 1.
+func (bus *{{ $busType }}) OnRetry(fn func({{ $eventType }}, any, error, int)) {
+	bus.hookMu.Lock()
+	bus.onRetry = append(bus.onRetry, fn)
+	bus.hookMu.Unlock()
+}
+
+// OnGiveUp registers a hook that fires when a handler returns an error that
+// will not be retried. The int is the total number of attempts made.
+func (bus *{{ $busType }}) OnGiveUp(fn func({{ $eventType }}, any, error, int)) {
+	bus.hookMu.Lock()
+	bus.onGiveUp = append(bus.onGiveUp, fn)
+	bus.hookMu.Unlock()
+}
+
+// addEnqueueHook registers fn to run with every envelope accepted by the
+// queue and returns a func that removes it again.
+func (bus *{{ $busType }}) addEnqueueHook(fn func({{ $env }})) (remove func()) {
+	return {{ $addHook }}(bus, &bus.onEnqueue, fn)
+}
+
+// {{ $addHook }} appends fn to hooks, one of the hook lists of bus, and returns
+// a func that removes it again.
+func {{ $addHook }}[F any](bus *{{ $busType }}, hooks *[]{{ $hook }}[F], fn F) (remove func()) {
 	bus.hookMu.Lock()
-	bus.onPanic = append(bus.onPanic, fn)
+	bus.nextHookID++
+	id := bus.nextHookID
+	*hooks = append(*hooks, {{ $hook }}[F]{id: id, fn: fn})
 	bus.hookMu.Unlock()
+
+	return func() {
+		bus.hookMu.Lock()
+		defer bus.hookMu.Unlock()
+		for i, h := range *hooks {
+			if h.id == id {
+				*hooks = append((*hooks)[:i:i], (*hooks)[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (bus *{{ $busType }}) runOnEnqueue(env {{ $env }}) {
+	bus.hookMu.RLock()
+	hooks := make([]{{ $hook }}[func({{ $env }})], len(bus.onEnqueue))
+	copy(hooks, bus.onEnqueue)
+	bus.hookMu.RUnlock()
+	for _, h := range hooks {
+		h.fn(env)
+	}
 }
 
 func (bus *{{ $busType }}) runOnPublish(event {{ $eventType }}, payload any) {
 	bus.hookMu.RLock()
-	hooks := make([]func({{ $eventType }}, any), len(bus.onPublish))
+	hooks := make([]{{ $hook }}[func({{ $eventType }}, any)], len(bus.onPublish))
 	copy(hooks, bus.onPublish)
 	bus.hookMu.RUnlock()
-	for _, fn := range hooks {
-		fn(event, payload)
+	for _, h := range hooks {
+		h.fn(event, payload)
 	}
 }
 
 func (bus *{{ $busType }}) runOnDrop(event {{ $eventType }}, payload any) {
 	bus.hookMu.RLock()
-	hooks := make([]func({{ $eventType }}, any), len(bus.onDrop))
+	hooks := make([]{{ $hook }}[func({{ $eventType }}, any)], len(bus.onDrop))
 	copy(hooks, bus.onDrop)
 	bus.hookMu.RUnlock()
-	for _, fn := range hooks {
-		fn(event, payload)
+	for _, h := range hooks {
+		h.fn(event, payload)
 	}
 }
 
@@ -207,17 +3533,129 @@ func (bus *{{ $busType }}) runOnSubscribe(event {{ $eventType }}) {
 
 func (bus *{{ $busType }}) runOnPanic(event {{ $eventType }}, payload any, recovered any) {
 	bus.hookMu.RLock()
-	hooks := make([]func({{ $eventType }}, any, any), len(bus.onPanic))
+	hooks := make([]{{ $hook }}[func({{ $eventType }}, any, any)], len(bus.onPanic))
 	copy(hooks, bus.onPanic)
 	bus.hookMu.RUnlock()
-	for _, fn := range hooks {
+	for _, h := range hooks {
 		func() {
 			defer func() { recover() }()
-			fn(event, payload, recovered)
+			h.fn(event, payload, recovered)
 		}()
 	}
 }
 
+func (bus *{{ $busType }}) runOnRetry(event {{ $eventType }}, payload any, err error, attempt int) {
+	bus.hookMu.RLock()
+	hooks := make([]func({{ $eventType }}, any, error, int), len(bus.onRetry))
+	copy(hooks, bus.onRetry)
+	bus.hookMu.RUnlock()
+	for _, fn := range hooks {
+		fn(event, payload, err, attempt)
+	}
+}
+
+func (bus *{{ $busType }}) runOnGiveUp(event {{ $eventType }}, payload any, err error, attempts int) {
+	bus.hookMu.RLock()
+	hooks := make([]func({{ $eventType }}, any, error, int), len(bus.onGiveUp))
+	copy(hooks, bus.onGiveUp)
+	bus.hookMu.RUnlock()
+	for _, fn := range hooks {
+		fn(event, payload, err, attempts)
+	}
+}
+
+func (bus *{{ $busType }}) runOnStop() {
+	bus.hookMu.RLock()
+	hooks := make([]func(), len(bus.onStop))
+	copy(hooks, bus.onStop)
+	bus.hookMu.RUnlock()
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+{{- if .Fake }}
+
+// Fake{{ $busType }} is a {{ $p }}Publisher that records published events
+// instead of delivering them. Its zero value is ready to use and it is safe
+// for concurrent use.
+type Fake{{ $busType }} struct {
+	mu        sync.Mutex
+	published []{{ $env }}
+}
+
+var _ {{ $p }}Publisher = (*Fake{{ $busType }})(nil)
+
+func (f *Fake{{ $busType }}) record(event {{ $eventType }}, payload any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, {{ $env }}{
+		ID:      {{ $newID }}(),
+		Time:    time.Now(),
+		Event:   event,
+		Payload: payload,
+	})
+}
+
+// Published returns every recorded event in publish order.
+func (f *Fake{{ $busType }}) Published() []{{ $env }} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]{{ $env }}(nil), f.published...)
+}
+
+// Count returns how many times event was published.
+func (f *Fake{{ $busType }}) Count(event {{ $eventType }}) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, env := range f.published {
+		if env.Event == event {
+			n++
+		}
+	}
+	return n
+}
+
+// Reset discards all recorded events.
+func (f *Fake{{ $busType }}) Reset() {
+	f.mu.Lock()
+	f.published = nil
+	f.mu.Unlock()
+}
+
+// RequirePublished fails t unless event was published exactly n times.
+func (f *Fake{{ $busType }}) RequirePublished(t interface {
+	Helper()
+	Fatalf(format string, args ...any)
+}, event {{ $eventType }}, n int) {
+	t.Helper()
+	if got := f.Count(event); got != n {
+		t.Fatalf("%s published %d times, want %d", event, got, n)
+	}
+}
+{{ range .Events }}
+{{ $pc := pascalCase .Name -}}
+// Publish{{ $pc }} records a {{ .Name }} event.
+func (f *Fake{{ $busType }}) Publish{{ $pc }}(payload {{ .PayloadType }}) {
+	f.record({{ $eventType }}{{ $pc }}, payload)
+}
+
+// Published{{ $pc }} returns the recorded {{ .Name }} payloads in publish order.
+func (f *Fake{{ $busType }}) Published{{ $pc }}() []{{ .PayloadType }} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var payloads []{{ .PayloadType }}
+	for _, env := range f.published {
+		if env.Event == {{ $eventType }}{{ $pc }} {
+			payloads = append(payloads, env.Payload.({{ .PayloadType }}))
+		}
+	}
+	return payloads
+}
+{{ end }}
+{{- end }}
+
 // Reference the source variable to suppress unused-variable lint.
 var _ = {{ .VarName }}
 `
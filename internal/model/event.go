@@ -11,12 +11,50 @@ type EventDef struct {
 	PayloadType string // e.g. "MutationEvent"
 }
 
+// RedactType describes a payload type whose values contain fields tagged
+// gobusgen:"redact", either directly or inside nested values.
+type RedactType struct {
+	Name  string       // e.g. "UserRegistrationEvent"
+	Value *RedactValue // where the tagged fields are
+}
+
+// RedactKind is the kind of value a RedactValue descends into.
+type RedactKind int
+
+const (
+	RedactStruct  RedactKind = iota // struct: redact Fields
+	RedactPointer                   // pointer: redact a copy of the pointee
+	RedactSlice                     // slice: redact a copy of each element
+	RedactArray                     // array: redact each element
+	RedactMap                       // map: redact a copy of each value
+)
+
+// RedactValue describes where the fields tagged gobusgen:"redact" are inside
+// a value.
+type RedactValue struct {
+	Kind   RedactKind
+	Elem   *RedactValue  // element of pointer, slice, array and map values
+	Fields []RedactField // fields of struct values
+}
+
+// RedactField is a struct field that is tagged gobusgen:"redact" or holds
+// values with tagged fields.
+type RedactField struct {
+	Name  string       // e.g. "Email"; embedded fields are named after their type
+	Value *RedactValue // nil when the field is tagged and set to its zero value
+}
+
 // GenerateInput is the complete input for the code generator.
 type GenerateInput struct {
 	PackageName string
 	VarName     string // name of the source map variable (e.g. "Events")
 	Prefix      string // prefix for generated symbols (e.g. "Command" → CommandEvent, CommandBus)
 	Events      []EventDef
+	Fake        bool         // also generate a recording fake bus for tests
+	Outbox      bool         // also generate the transactional outbox and its SQL store
+	Transport   bool         // also generate SendTo, ReceiveFrom and the Unix socket transport
+	HTTP        bool         // also generate the net/http handlers
+	Redact      []RedactType // payload types with fields to redact
 }
 
 // DerivePrefix returns a prefix from the var name.
@@ -29,6 +29,7 @@ func Parse(dir string, varName string) (model.GenerateInput, error) {
 	var (
 		found       []model.EventDef
 		foundPkg    string
+		foundFiles  map[string]*ast.File
 		foundPrefix *string
 		matchCount  int
 	)
@@ -52,6 +53,7 @@ func Parse(dir string, varName string) (model.GenerateInput, error) {
 			matchCount++
 			found = events
 			foundPkg = pkgName
+			foundFiles = pkg.Files
 			foundPrefix = prefix
 		}
 	}
@@ -72,6 +74,11 @@ func Parse(dir string, varName string) (model.GenerateInput, error) {
 		return found[i].Name < found[j].Name
 	})
 
+	redact, err := collectRedactTypes(dir, varName, foundFiles, found)
+	if err != nil {
+		return model.GenerateInput{}, err
+	}
+
 	prefix := model.DerivePrefix(varName)
 	if foundPrefix != nil {
 		prefix = *foundPrefix
@@ -82,6 +89,7 @@ func Parse(dir string, varName string) (model.GenerateInput, error) {
 		VarName:     varName,
 		Prefix:      prefix,
 		Events:      found,
+		Redact:      redact,
 	}, nil
 }
 
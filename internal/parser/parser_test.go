@@ -3,6 +3,7 @@ package parser_test
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -12,11 +13,19 @@ import (
 
 func writeFile(t *testing.T, dir, name, content string) {
 	t.Helper()
-	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
 		t.Fatal(err)
 	}
 }
 
+// goMod is written next to sources that use gobusgen tags, which Parse
+// type-checks.
+const goMod = "module example.com/events\n\ngo 1.23\n"
+
 func TestParse(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -663,6 +672,216 @@ var Events = map[string]any{
 				},
 			},
 		},
+		{
+			name: "redact tagged fields",
+			files: map[string]string{
+				"go.mod": goMod,
+				"events.go": `package events
+
+import "time"
+
+type Contact struct{}
+
+type SignupEvent struct {
+	ID           string
+	Email, Phone string ` + "`json:\"email\" gobusgen:\"redact\"`" + `
+	Contact      ` + "`gobusgen:\"redact\"`" + `
+	At           time.Time
+}
+
+type PlainEvent struct {
+	Name string ` + "`json:\"name\"`" + `
+}
+
+var Events = map[string]any{
+	"user.signup":  SignupEvent{},
+	"user.invited": SignupEvent{},
+	"user.renamed": PlainEvent{},
+}
+`,
+				"events.gen.go": `// Code generated by gobusgen; DO NOT EDIT.
+package events
+
+func eventBusRedactSignupEvent(p SignupEvent) SignupEvent { return p }
+`,
+			},
+			varName: "Events",
+			want: model.GenerateInput{
+				PackageName: "events",
+				VarName:     "Events",
+				Events: []model.EventDef{
+					{Name: "user.invited", PayloadType: "SignupEvent"},
+					{Name: "user.renamed", PayloadType: "PlainEvent"},
+					{Name: "user.signup", PayloadType: "SignupEvent"},
+				},
+				Redact: []model.RedactType{
+					{Name: "SignupEvent", Value: &model.RedactValue{
+						Kind:   model.RedactStruct,
+						Fields: []model.RedactField{{Name: "Email"}, {Name: "Phone"}, {Name: "Contact"}},
+					}},
+				},
+			},
+		},
+		{
+			name: "redact nested and foreign fields",
+			files: map[string]string{
+				"go.mod": goMod,
+				"contact/contact.go": `package contact
+
+type Card struct {
+	Name  string
+	Email string ` + "`gobusgen:\"redact\"`" + `
+}
+`,
+				"events.go": `package events
+
+import "example.com/events/contact"
+
+type Device struct {
+	Token string ` + "`gobusgen:\"redact\"`" + `
+}
+
+type Devices = map[string][2]Device
+
+type SignupEvent struct {
+	Card     contact.Card
+	Referrer *contact.Card
+	Devices  Devices
+	Tags     []string
+}
+
+var Events = map[string]any{
+	"user.signup":  SignupEvent{},
+	"card.updated": contact.Card{},
+}
+`,
+			},
+			varName: "Events",
+			want: model.GenerateInput{
+				PackageName: "events",
+				VarName:     "Events",
+				Events: []model.EventDef{
+					{Name: "card.updated", PayloadType: "contact.Card"},
+					{Name: "user.signup", PayloadType: "SignupEvent"},
+				},
+				Redact: []model.RedactType{
+					{Name: "contact.Card", Value: &model.RedactValue{
+						Kind:   model.RedactStruct,
+						Fields: []model.RedactField{{Name: "Email"}},
+					}},
+					{Name: "SignupEvent", Value: &model.RedactValue{
+						Kind: model.RedactStruct,
+						Fields: []model.RedactField{
+							{Name: "Card", Value: &model.RedactValue{
+								Kind:   model.RedactStruct,
+								Fields: []model.RedactField{{Name: "Email"}},
+							}},
+							{Name: "Referrer", Value: &model.RedactValue{
+								Kind: model.RedactPointer,
+								Elem: &model.RedactValue{
+									Kind:   model.RedactStruct,
+									Fields: []model.RedactField{{Name: "Email"}},
+								},
+							}},
+							{Name: "Devices", Value: &model.RedactValue{
+								Kind: model.RedactMap,
+								Elem: &model.RedactValue{
+									Kind: model.RedactArray,
+									Elem: &model.RedactValue{
+										Kind:   model.RedactStruct,
+										Fields: []model.RedactField{{Name: "Token"}},
+									},
+								},
+							}},
+						},
+					}},
+				},
+			},
+		},
+		{
+			name: "unexported foreign redact field",
+			files: map[string]string{
+				"go.mod": goMod,
+				"contact/contact.go": `package contact
+
+type Card struct {
+	email string ` + "`gobusgen:\"redact\"`" + `
+}
+`,
+				"events.go": `package events
+
+import "example.com/events/contact"
+
+type SignupEvent struct {
+	Card contact.Card
+}
+
+var Events = map[string]any{
+	"user.signup": SignupEvent{},
+}
+`,
+			},
+			varName: "Events",
+			wantErr: `payload type SignupEvent: field Card: field email is not exported by package example.com/events/contact`,
+		},
+		{
+			name: "recursive redact type",
+			files: map[string]string{
+				"go.mod": goMod,
+				"events.go": `package events
+
+type Comment struct {
+	Author  string ` + "`gobusgen:\"redact\"`" + `
+	Replies []Comment
+}
+
+type CommentEvent struct {
+	Comment Comment
+}
+
+var Events = map[string]any{
+	"comment.added": CommentEvent{},
+}
+`,
+			},
+			varName: "Events",
+			wantErr: `payload type CommentEvent: field Comment: type Comment is recursive`,
+		},
+		{
+			name: "redact tag outside a module",
+			files: map[string]string{
+				"events.go": `package events
+
+type SignupEvent struct {
+	Email string ` + "`gobusgen:\"redact\"`" + `
+}
+
+var Events = map[string]any{
+	"user.signup": SignupEvent{},
+}
+`,
+			},
+			varName: "Events",
+			wantErr: "redaction requires the package to be in a Go module",
+		},
+		{
+			name: "unknown gobusgen tag option",
+			files: map[string]string{
+				"go.mod": goMod,
+				"events.go": `package events
+
+type SignupEvent struct {
+	Email string ` + "`gobusgen:\"redcat\"`" + `
+}
+
+var Events = map[string]any{
+	"user.signup": SignupEvent{},
+}
+`,
+			},
+			varName: "Events",
+			wantErr: `payload type SignupEvent: field Email: unknown gobusgen tag option "redcat"`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -712,6 +931,10 @@ var Events = map[string]any{
 					t.Errorf("Events[%d].PayloadType = %q, want %q", i, ev.PayloadType, tt.want.Events[i].PayloadType)
 				}
 			}
+
+			if !reflect.DeepEqual(got.Redact, tt.want.Redact) {
+				t.Errorf("Redact = %+v, want %+v", got.Redact, tt.want.Redact)
+			}
 		})
 	}
 }
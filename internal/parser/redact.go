@@ -0,0 +1,314 @@
+package parser
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/hay-kot/gobusgen/internal/model"
+)
+
+// collectRedactTypes type-checks the package in dir and finds the payload
+// types of the varName map whose values contain fields tagged
+// gobusgen:"redact", including fields of nested structs reached through
+// pointers, slices, arrays and maps, and types declared in other packages.
+// Each type is reported once, in the order of the first event that uses it.
+//
+// The package is only type-checked when one of its files has a gobusgen
+// struct tag or imports a package outside the standard library, where tagged
+// types may be declared. Other packages need not be in a module. Tagged
+// fields that the generated code cannot reach are reported as errors rather
+// than left unredacted.
+func collectRedactTypes(dir, varName string, files map[string]*ast.File, events []model.EventDef) ([]model.RedactType, error) {
+	if !hasGobusgenTag(files) && !importsNonStdlib(files) {
+		return nil, nil
+	}
+
+	pkg, payloads, err := loadPayloadTypes(dir, varName)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &redactWalker{
+		pkg:    pkg.Types,
+		done:   make(map[*types.Named]*model.RedactValue),
+		active: make(map[*types.Named]bool),
+		cyclic: make(map[*types.Named]bool),
+	}
+
+	var (
+		redact []model.RedactType
+		seen   = make(map[string]bool)
+	)
+
+	for _, e := range events {
+		if seen[e.PayloadType] {
+			continue
+		}
+		seen[e.PayloadType] = true
+
+		t, ok := payloads[e.PayloadType]
+		if !ok || !isValidType(t) {
+			if len(pkg.Errors) > 0 {
+				return nil, fmt.Errorf("payload type %s: %s", e.PayloadType, pkg.Errors[0].Msg)
+			}
+			return nil, fmt.Errorf("payload type %s: type not found", e.PayloadType)
+		}
+
+		v, err := w.value(t)
+		if err != nil {
+			return nil, fmt.Errorf("payload type %s: %w", e.PayloadType, err)
+		}
+		if v == nil {
+			continue
+		}
+
+		redact = append(redact, model.RedactType{Name: e.PayloadType, Value: v})
+	}
+
+	return redact, nil
+}
+
+// loadPayloadTypes loads the package in dir with type information and returns
+// it together with the type of each payload in the varName map, keyed by the
+// payload's type expression (e.g. "MyType" or "pkg.Type"). Type errors in the
+// package, such as a stale generated file, do not stop the load.
+func loadPayloadTypes(dir, varName string) (*packages.Package, map[string]types.Type, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo,
+		Dir:  dir,
+	}
+
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading package %s: redaction requires the package to be in a Go module: %w", dir, err)
+	}
+	if len(pkgs) != 1 || pkgs[0].Types == nil || pkgs[0].TypesInfo == nil {
+		return nil, nil, fmt.Errorf("loading package %s: redaction requires the package to be in a Go module", dir)
+	}
+	for _, e := range pkgs[0].Errors {
+		if e.Kind == packages.ListError {
+			return nil, nil, fmt.Errorf("loading package %s: redaction requires the package to be in a Go module: %s", dir, e.Msg)
+		}
+	}
+
+	pkg := pkgs[0]
+	payloads := make(map[string]types.Type)
+
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.VAR {
+				continue
+			}
+
+			for _, spec := range genDecl.Specs {
+				vs, ok := spec.(*ast.ValueSpec)
+				if !ok || len(vs.Names) == 0 || vs.Names[0].Name != varName || len(vs.Values) == 0 {
+					continue
+				}
+
+				comp, ok := vs.Values[0].(*ast.CompositeLit)
+				if !ok {
+					continue
+				}
+
+				for _, elt := range comp.Elts {
+					kv, ok := elt.(*ast.KeyValueExpr)
+					if !ok {
+						continue
+					}
+					if valComp, ok := kv.Value.(*ast.CompositeLit); ok && valComp.Type != nil {
+						payloads[types.ExprString(valComp.Type)] = pkg.TypesInfo.TypeOf(valComp)
+					}
+				}
+			}
+		}
+	}
+
+	return pkg, payloads, nil
+}
+
+// hasGobusgenTag reports whether a struct field in files, other than in
+// generated files, has a gobusgen struct tag.
+func hasGobusgenTag(files map[string]*ast.File) bool {
+	found := false
+
+	for _, file := range files {
+		if isGeneratedFile(file) {
+			continue
+		}
+
+		ast.Inspect(file, func(n ast.Node) bool {
+			field, ok := n.(*ast.Field)
+			if !ok || field.Tag == nil || found {
+				return !found
+			}
+
+			tag, err := strconv.Unquote(field.Tag.Value)
+			if err == nil {
+				_, found = reflect.StructTag(tag).Lookup("gobusgen")
+			}
+			return !found
+		})
+	}
+
+	return found
+}
+
+// importsNonStdlib reports whether a file in files, other than a generated
+// file, imports a package that is not in the standard library.
+func importsNonStdlib(files map[string]*ast.File) bool {
+	for _, file := range files {
+		if isGeneratedFile(file) {
+			continue
+		}
+
+		for _, imp := range file.Imports {
+			path, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				continue
+			}
+			if pkg, err := build.Default.Import(path, "", build.FindOnly); err != nil || !pkg.Goroot {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isValidType(t types.Type) bool {
+	return t != nil && t != types.Typ[types.Invalid]
+}
+
+// redactWalker finds the fields tagged gobusgen:"redact" inside types.
+type redactWalker struct {
+	pkg    *types.Package // package the generated code is written to
+	done   map[*types.Named]*model.RedactValue
+	active map[*types.Named]bool // named types being walked
+	cyclic map[*types.Named]bool // named types reached from themselves
+}
+
+// value returns where the tagged fields are inside values of type t, or nil
+// when there are none.
+func (w *redactWalker) value(t types.Type) (*model.RedactValue, error) {
+	switch t := t.(type) {
+	case *types.Alias:
+		return w.value(types.Unalias(t))
+	case *types.Named:
+		if v, ok := w.done[t]; ok {
+			return v, nil
+		}
+		if w.active[t] {
+			w.cyclic[t] = true
+			return nil, nil
+		}
+
+		w.active[t] = true
+		v, err := w.value(t.Underlying())
+		delete(w.active, t)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil && w.cyclic[t] {
+			return nil, fmt.Errorf("type %s is recursive and has fields tagged gobusgen:\"redact\"; redacting recursive types is not supported", types.TypeString(t, types.RelativeTo(w.pkg)))
+		}
+
+		w.done[t] = v
+		return v, nil
+	case *types.Struct:
+		fields, err := w.fields(t)
+		if err != nil || len(fields) == 0 {
+			return nil, err
+		}
+		return &model.RedactValue{Kind: model.RedactStruct, Fields: fields}, nil
+	case *types.Pointer:
+		return w.elem(model.RedactPointer, t.Elem())
+	case *types.Slice:
+		return w.elem(model.RedactSlice, t.Elem())
+	case *types.Array:
+		return w.elem(model.RedactArray, t.Elem())
+	case *types.Map:
+		key, err := w.value(t.Key())
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			return nil, fmt.Errorf("map key type %s has fields tagged gobusgen:\"redact\"; redacting map keys is not supported", types.TypeString(t.Key(), types.RelativeTo(w.pkg)))
+		}
+		return w.elem(model.RedactMap, t.Elem())
+	default:
+		// Basic types, interfaces, channels and functions have no fields
+		// the generator can see.
+		return nil, nil
+	}
+}
+
+func (w *redactWalker) elem(kind model.RedactKind, t types.Type) (*model.RedactValue, error) {
+	elem, err := w.value(t)
+	if err != nil || elem == nil {
+		return nil, err
+	}
+	return &model.RedactValue{Kind: kind, Elem: elem}, nil
+}
+
+// fields returns the fields of st that are tagged gobusgen:"redact" or hold
+// values with tagged fields. Embedded fields are named after their type.
+func (w *redactWalker) fields(st *types.Struct) ([]model.RedactField, error) {
+	var fields []model.RedactField
+
+	for i := range st.NumFields() {
+		f := st.Field(i)
+
+		tagged, err := hasRedactTag(st.Tag(i))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name(), err)
+		}
+
+		var v *model.RedactValue
+		if !tagged {
+			v, err = w.value(f.Type())
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", f.Name(), err)
+			}
+			if v == nil {
+				continue
+			}
+		}
+
+		if f.Name() == "_" {
+			continue
+		}
+		if !f.Exported() && f.Pkg() != w.pkg {
+			return nil, fmt.Errorf("field %s is not exported by package %s, so the generated code cannot redact it", f.Name(), f.Pkg().Path())
+		}
+
+		fields = append(fields, model.RedactField{Name: f.Name(), Value: v})
+	}
+
+	return fields, nil
+}
+
+// hasRedactTag reports whether tag has the gobusgen:"redact" option.
+func hasRedactTag(tag string) (bool, error) {
+	val, ok := reflect.StructTag(tag).Lookup("gobusgen")
+	if !ok {
+		return false, nil
+	}
+
+	for opt := range strings.SplitSeq(val, ",") {
+		if opt != "redact" {
+			return false, fmt.Errorf("unknown gobusgen tag option %q", opt)
+		}
+	}
+
+	return true, nil
+}
@@ -90,6 +90,7 @@ func run() (noColor bool, err error) {
 		},
 	}
 	app = commands.NewGenerateCmd(flags).Register(app)
+	app = commands.NewMonitorCmd(flags).Register(app)
 	// +scaffold:command:register
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)